@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"sse-broker/funcs"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pelletier/go-toml/v2"
@@ -18,72 +23,520 @@ type Config struct {
 		AccessLogPath string `toml:"access_log_path"`
 		ErrorLogPath  string `toml:"error_log_path"`
 		BrokerLogPath string `toml:"broker_log_path"`
+		DrainDelay    int    `toml:"drain_delay"`
+		// 超时，单位秒
+		ReadHeaderTimeout int  `toml:"read_header_timeout"`
+		ReadTimeout       int  `toml:"read_timeout"`
+		WriteTimeout      int  `toml:"write_timeout"`
+		IdleTimeout       int  `toml:"idle_timeout"`
+		H2C               bool `toml:"h2c"`
+		TLS               struct {
+			Enable         bool   `toml:"enable"`
+			CertFile       string `toml:"cert_file"`
+			KeyFile        string `toml:"key_file"`
+			ReloadInterval int    `toml:"reload_interval"`
+		} `toml:"tls"`
 	} `toml:"server"`
 	JWT struct {
-		Secret string `toml:"secret"`
-		Expire int    `toml:"expire"`
+		Secret        string `toml:"secret" secret:"true"`
+		Expire        int    `toml:"expire"`
+		SecretOverlap int    `toml:"secret_overlap"`
 	} `toml:"jwt"`
 	Redis struct {
-		Addrs    []string `toml:"addrs"`
-		Password string   `toml:"password"`
-		DB       int      `toml:"db"`
-		PoolSize int      `toml:"pool_size"`
+		Mode              string   `toml:"mode"`
+		Addrs             []string `toml:"addrs"`
+		Username          string   `toml:"username"`
+		Password          string   `toml:"password" secret:"true"`
+		DB                int      `toml:"db"`
+		PoolSize          int      `toml:"pool_size"`
+		MasterName        string   `toml:"master_name"`
+		SentinelUsername  string   `toml:"sentinel_username"`
+		SentinelPassword  string   `toml:"sentinel_password" secret:"true"`
+		DialTimeout       int      `toml:"dial_timeout"`
+		ReadTimeout       int      `toml:"read_timeout"`
+		WriteTimeout      int      `toml:"write_timeout"`
+		MaxRetries        int      `toml:"max_retries"`
+		MinRetryBackoffMs int      `toml:"min_retry_backoff_ms"`
+		MaxRetryBackoffMs int      `toml:"max_retry_backoff_ms"`
+		KeyPrefix         string   `toml:"key_prefix"`
+		HashTag           bool     `toml:"hash_tag"`
+		TLS               struct {
+			Enable             bool   `toml:"enable"`
+			CAFile             string `toml:"ca_file"`
+			CertFile           string `toml:"cert_file"`
+			KeyFile            string `toml:"key_file"`
+			ServerName         string `toml:"server_name"`
+			InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+		} `toml:"tls"`
 	} `toml:"redis"`
 	SSE struct {
-		HeartbeatInterval    int `toml:"heartbeat_interval"`
-		DeviceFrameCacheSize int `toml:"device_frame_cache_size"`
-		DeviceFrameExpire    int `toml:"device_frame_cache_expire"`
+		HeartbeatInterval    int    `toml:"heartbeat_interval"`
+		DeviceFrameCacheSize int    `toml:"device_frame_cache_size"`
+		DeviceFrameExpire    int    `toml:"device_frame_cache_expire"`
+		DeviceQueueSize      int    `toml:"device_queue_size"`
+		DeviceQueueOverflow  string `toml:"device_queue_overflow"`
+		FrameIDScope         string `toml:"frame_id_scope"`
+		MaxPayloadSize       int    `toml:"max_payload_size"`
 	} `toml:"sse"`
+	API struct {
+		Keys []struct {
+			Name string `toml:"name"`
+			Key  string `toml:"key" secret:"true"`
+			Role string `toml:"role"`
+		} `toml:"keys"`
+	} `toml:"api"`
+	Proxy struct {
+		TrustedProxies []string `toml:"trusted_proxies"`
+		ProxyProtocol  bool     `toml:"proxy_protocol"`
+	} `toml:"proxy"`
+	CORS struct {
+		AllowedOrigins   []string `toml:"allowed_origins"`
+		AllowCredentials bool     `toml:"allow_credentials"`
+		MaxAge           int      `toml:"max_age"`
+		RestrictEvents   bool     `toml:"restrict_events"`
+	} `toml:"cors"`
+	Compression struct {
+		Enable        bool     `toml:"enable"`
+		Encodings     []string `toml:"encodings"`
+		GzipLevel     int      `toml:"gzip_level"`
+		BrotliQuality int      `toml:"brotli_quality"`
+		FlushSize     int      `toml:"flush_size"`
+	} `toml:"compression"`
+	Events struct {
+		Mode             string `toml:"mode"`
+		Unknown          string `toml:"unknown"`
+		QuarantineMaxLen int64  `toml:"quarantine_maxlen"`
+		Types            []struct {
+			Name       string   `toml:"name"`
+			Schema     string   `toml:"schema"`
+			SchemaFile string   `toml:"schema_file"`
+			Publishers []string `toml:"publishers"`
+			Mode       string   `toml:"mode"`
+		} `toml:"types"`
+	} `toml:"events"`
+	Audit struct {
+		Enable            bool   `toml:"enable"`
+		Path              string `toml:"path"`
+		RedisStream       bool   `toml:"redis_stream"`
+		RedisStreamMaxLen int64  `toml:"redis_stream_maxlen"`
+	} `toml:"audit"`
+	Log struct {
+		Level            string            `toml:"level"`
+		Format           string            `toml:"format"`
+		Levels           map[string]string `toml:"levels"`
+		MaxSizeMB        int               `toml:"max_size_mb"`
+		MaxAgeDays       int               `toml:"max_age_days"`
+		MaxBackups       int               `toml:"max_backups"`
+		Daily            bool              `toml:"daily"`
+		SampleInitial    int               `toml:"sample_initial"`
+		SampleThereafter int               `toml:"sample_thereafter"`
+	} `toml:"log"`
 }
 
-func loadConfig(baseDir string, configPath string) (*Config, error) {
+// 生成日志配置
+func (c *Config) logOptions() funcs.LogOptions {
+	return funcs.LogOptions{
+		Level:            c.Log.Level,
+		Format:           c.Log.Format,
+		Levels:           c.Log.Levels,
+		SampleInitial:    c.Log.SampleInitial,
+		SampleThereafter: c.Log.SampleThereafter,
+	}
+}
+
+// 生成日志轮转配置，三类日志文件共用
+func (c *Config) rotateOptions() funcs.RotateOptions {
+	return funcs.RotateOptions{
+		MaxSize:    int64(c.Log.MaxSizeMB) * 1024 * 1024,
+		Daily:      c.Log.Daily,
+		MaxAge:     time.Duration(c.Log.MaxAgeDays) * 24 * time.Hour,
+		MaxBackups: c.Log.MaxBackups,
+	}
+}
+
+// 相对路径以启动目录为基准
+func resolvePath(baseDir string, path string) string {
+	if path != "" && !filepath.IsAbs(path) {
+		return filepath.Join(baseDir, path)
+	}
+	return path
+}
+
+// 生成Redis连接配置，相对路径的证书文件以启动目录为基准
+func (c *Config) redisOptions(baseDir string) funcs.RedisOptions {
+	options := funcs.RedisOptions{
+		Mode:             c.Redis.Mode,
+		Addrs:            c.Redis.Addrs,
+		Username:         c.Redis.Username,
+		Password:         c.Redis.Password,
+		DB:               c.Redis.DB,
+		PoolSize:         c.Redis.PoolSize,
+		MasterName:       c.Redis.MasterName,
+		SentinelUsername: c.Redis.SentinelUsername,
+		SentinelPassword: c.Redis.SentinelPassword,
+		DialTimeout:      time.Duration(c.Redis.DialTimeout) * time.Second,
+		ReadTimeout:      time.Duration(c.Redis.ReadTimeout) * time.Second,
+		WriteTimeout:     time.Duration(c.Redis.WriteTimeout) * time.Second,
+		MaxRetries:       c.Redis.MaxRetries,
+		MinRetryBackoff:  time.Duration(c.Redis.MinRetryBackoffMs) * time.Millisecond,
+		MaxRetryBackoff:  time.Duration(c.Redis.MaxRetryBackoffMs) * time.Millisecond,
+	}
+	options.TLS.Enable = c.Redis.TLS.Enable
+	options.TLS.CAFile = resolvePath(baseDir, c.Redis.TLS.CAFile)
+	options.TLS.CertFile = resolvePath(baseDir, c.Redis.TLS.CertFile)
+	options.TLS.KeyFile = resolvePath(baseDir, c.Redis.TLS.KeyFile)
+	options.TLS.ServerName = c.Redis.TLS.ServerName
+	options.TLS.InsecureSkipVerify = c.Redis.TLS.InsecureSkipVerify
+	return options
+}
+
+// 加载配置：配置文件 < 环境变量 < 命令行 -set；required为false时配置文件不存在则只用默认值和覆盖项
+// 校验失败时返回全部错误
+func loadConfig(baseDir string, configPath string, required bool, overrides []string) (*Config, error) {
 	if !filepath.IsAbs(configPath) {
 		configPath = filepath.Join(baseDir, configPath)
 	}
 	config := Config{}
 	file, err := os.Open(configPath)
-	if err != nil {
-		fmt.Printf("Failed to open config file %s: %v", configPath, err)
+	if err == nil {
+		defer file.Close()
+		decoder := toml.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			var strictErr *toml.StrictMissingError
+			if errors.As(err, &strictErr) {
+				return nil, fmt.Errorf("unknown keys in config file %s:\n%s", configPath, strictErr.String())
+			}
+			return nil, fmt.Errorf("failed to decode config file %s: %w", configPath, err)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open config file %s: %w", configPath, err)
+	}
+
+	var errs []error
+	errs = append(errs, applyEnvOverrides(&config, os.Environ())...)
+	errs = append(errs, applyFlagOverrides(&config, overrides)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := config.validate(baseDir); err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	decoder := toml.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		fmt.Printf("Failed to decode config file: %v", err)
+	return &config, nil
+}
+
+// 解析受信任的代理，支持CIDR和单个IP
+func (c *Config) trustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range c.Proxy.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy.trusted_proxies %q: %w", proxy, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy.trusted_proxies %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// 校验允许的来源：* 或 scheme://host[:port]，host 可以 *. 开头匹配子域名
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return errors.New("expect scheme://host[:port] without path")
+	}
+	return nil
+}
+
+// 填充默认值并校验，返回全部错误
+func (config *Config) validate(baseDir string) error {
+	var errs []error
+	if config.Server.Port == 0 {
+		config.Server.Port = 8080
+	}
+	if config.Server.Port < 0 || config.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid server.port: %d", config.Server.Port))
+	}
+	// 没有配置文件、只用环境变量配置时，日志路径与示例配置一致
+	for _, logPath := range []struct {
+		value *string
+		def   string
+	}{
+		{&config.Server.AccessLogPath, "logs/access.log"},
+		{&config.Server.ErrorLogPath, "logs/error.log"},
+		{&config.Server.BrokerLogPath, "logs/broker.log"},
+	} {
+		if *logPath.value == "" {
+			*logPath.value = logPath.def
+		}
+	}
+	if config.Server.DrainDelay < 0 {
+		errs = append(errs, fmt.Errorf("invalid server.drain_delay: %d", config.Server.DrainDelay))
+	}
+	for _, timeout := range []struct {
+		name  string
+		value *int
+		def   int
+	}{
+		{"read_header_timeout", &config.Server.ReadHeaderTimeout, 10},
+		{"read_timeout", &config.Server.ReadTimeout, 30},
+		{"write_timeout", &config.Server.WriteTimeout, 30},
+		{"idle_timeout", &config.Server.IdleTimeout, 120},
+	} {
+		if *timeout.value == 0 {
+			*timeout.value = timeout.def
+		}
+		if *timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("invalid server.%s: %d", timeout.name, *timeout.value))
+		}
+	}
+	if config.Server.TLS.Enable {
+		if config.Server.H2C {
+			errs = append(errs, errors.New("server.h2c cannot be used with server.tls"))
+		}
+		for name, file := range map[string]string{"cert_file": config.Server.TLS.CertFile, "key_file": config.Server.TLS.KeyFile} {
+			if file == "" {
+				errs = append(errs, fmt.Errorf("server.tls.%s is required", name))
+			} else if _, err := os.Stat(resolvePath(baseDir, file)); err != nil {
+				errs = append(errs, fmt.Errorf("server.tls.%s: file %s not found", name, file))
+			}
+		}
+		if config.Server.TLS.ReloadInterval == 0 {
+			config.Server.TLS.ReloadInterval = 10
+		}
+		if config.Server.TLS.ReloadInterval < 0 {
+			errs = append(errs, fmt.Errorf("invalid server.tls.reload_interval: %d", config.Server.TLS.ReloadInterval))
+		}
+	}
+	if config.JWT.Secret == "" {
+		errs = append(errs, fmt.Errorf("jwt.secret is required"))
+	}
+	if config.JWT.Expire == 0 {
+		config.JWT.Expire = 30
+	}
+	if config.JWT.Expire < 0 {
+		errs = append(errs, fmt.Errorf("invalid jwt.expire: %d", config.JWT.Expire))
+	}
+	if config.JWT.SecretOverlap == 0 {
+		config.JWT.SecretOverlap = 3600
+	}
+	if config.JWT.SecretOverlap < 0 {
+		errs = append(errs, fmt.Errorf("invalid jwt.secret_overlap: %d", config.JWT.SecretOverlap))
+	}
+	if _, err := config.trustedProxies(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, origin := range config.CORS.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			errs = append(errs, fmt.Errorf("invalid cors.allowed_origins %q: %w", origin, err))
+		}
+	}
+	if config.CORS.AllowCredentials && slices.Contains(config.CORS.AllowedOrigins, "*") {
+		errs = append(errs, errors.New("cors.allow_credentials cannot be used with the * origin"))
+	}
+	if config.CORS.MaxAge == 0 {
+		config.CORS.MaxAge = 600
+	}
+	if config.CORS.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("invalid cors.max_age: %d", config.CORS.MaxAge))
 	}
 	if config.SSE.HeartbeatInterval <= 0 {
 		config.SSE.HeartbeatInterval = 30
 	}
-	return &config, nil
+	if config.SSE.DeviceFrameCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid sse.device_frame_cache_size: %d", config.SSE.DeviceFrameCacheSize))
+	}
+	// 为0时帧缓存写入后立即过期，使用默认的7天
+	if config.SSE.DeviceFrameExpire == 0 {
+		config.SSE.DeviceFrameExpire = 604800
+	}
+	if config.SSE.DeviceFrameExpire < 0 {
+		errs = append(errs, fmt.Errorf("invalid sse.device_frame_cache_expire: %d", config.SSE.DeviceFrameExpire))
+	}
+	if config.Redis.KeyPrefix == "" {
+		config.Redis.KeyPrefix = "sse_"
+	}
+	if strings.ContainsAny(config.Redis.KeyPrefix, " {}") {
+		errs = append(errs, fmt.Errorf("invalid redis.key_prefix: %q, spaces and braces are not allowed", config.Redis.KeyPrefix))
+	}
+	redisOptions := config.redisOptions(baseDir)
+	if err := redisOptions.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid redis config:\n%w", err))
+	}
+	if config.SSE.DeviceQueueSize <= 0 {
+		config.SSE.DeviceQueueSize = 256
+	}
+	if config.SSE.DeviceQueueOverflow == "" {
+		config.SSE.DeviceQueueOverflow = "drop_oldest"
+	}
+	switch config.SSE.DeviceQueueOverflow {
+	case "drop_oldest", "drop_newest", "disconnect":
+	default:
+		errs = append(errs, fmt.Errorf("invalid sse.device_queue_overflow: %s", config.SSE.DeviceQueueOverflow))
+	}
+	if config.SSE.MaxPayloadSize == 0 {
+		config.SSE.MaxPayloadSize = 65536
+	}
+	if config.SSE.MaxPayloadSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid sse.max_payload_size: %d", config.SSE.MaxPayloadSize))
+	}
+	if config.SSE.FrameIDScope == "" {
+		config.SSE.FrameIDScope = "device"
+	}
+	switch config.SSE.FrameIDScope {
+	case "device", "user":
+	default:
+		errs = append(errs, fmt.Errorf("invalid sse.frame_id_scope: %s", config.SSE.FrameIDScope))
+	}
+	names := make(map[string]bool)
+	for i, apiKey := range config.API.Keys {
+		if apiKey.Name == "" || apiKey.Key == "" {
+			errs = append(errs, fmt.Errorf("invalid api.keys[%d]: name and key are required", i))
+		}
+		if names[apiKey.Name] {
+			errs = append(errs, fmt.Errorf("invalid api.keys[%d]: duplicate name %s", i, apiKey.Name))
+		}
+		names[apiKey.Name] = true
+		if apiKey.Role != "" && apiKey.Role != "admin" {
+			errs = append(errs, fmt.Errorf("invalid api.keys[%d].role: %s, only admin is supported", i, apiKey.Role))
+		}
+	}
+	if len(config.Compression.Encodings) == 0 {
+		config.Compression.Encodings = []string{"br", "gzip"}
+	}
+	for _, encoding := range config.Compression.Encodings {
+		if encoding != "br" && encoding != "gzip" {
+			errs = append(errs, fmt.Errorf("invalid compression.encodings: %s, only br and gzip are supported", encoding))
+		}
+	}
+	if config.Compression.GzipLevel == 0 {
+		config.Compression.GzipLevel = 5
+	}
+	if config.Compression.GzipLevel < 1 || config.Compression.GzipLevel > 9 {
+		errs = append(errs, fmt.Errorf("invalid compression.gzip_level: %d, must be 1-9", config.Compression.GzipLevel))
+	}
+	if config.Compression.BrotliQuality == 0 {
+		config.Compression.BrotliQuality = 4
+	}
+	if config.Compression.BrotliQuality < 1 || config.Compression.BrotliQuality > 11 {
+		errs = append(errs, fmt.Errorf("invalid compression.brotli_quality: %d, must be 1-11", config.Compression.BrotliQuality))
+	}
+	if config.Compression.FlushSize <= 0 {
+		config.Compression.FlushSize = 256
+	}
+	if config.Events.Mode == "" {
+		config.Events.Mode = "reject"
+	}
+	if config.Events.Mode != "reject" && config.Events.Mode != "quarantine" {
+		errs = append(errs, fmt.Errorf("invalid events.mode: %s", config.Events.Mode))
+	}
+	if config.Events.Unknown == "" {
+		config.Events.Unknown = "allow"
+	}
+	if config.Events.Unknown != "allow" && config.Events.Unknown != "reject" {
+		errs = append(errs, fmt.Errorf("invalid events.unknown: %s", config.Events.Unknown))
+	}
+	if config.Events.QuarantineMaxLen <= 0 {
+		config.Events.QuarantineMaxLen = 10000
+	}
+	eventNames := make(map[string]bool)
+	for i := range config.Events.Types {
+		eventType := &config.Events.Types[i]
+		if eventType.Name == "" {
+			errs = append(errs, fmt.Errorf("invalid events.types[%d]: name is required", i))
+			continue
+		}
+		if eventNames[eventType.Name] {
+			errs = append(errs, fmt.Errorf("invalid events.types[%d]: duplicate name %s", i, eventType.Name))
+		}
+		eventNames[eventType.Name] = true
+		if eventType.Mode != "" && eventType.Mode != "reject" && eventType.Mode != "quarantine" {
+			errs = append(errs, fmt.Errorf("invalid events.types[%d].mode: %s", i, eventType.Mode))
+		}
+		for _, publisher := range eventType.Publishers {
+			if !names[publisher] {
+				errs = append(errs, fmt.Errorf("invalid events.types[%d].publishers: %s is not a name in api.keys", i, publisher))
+			}
+		}
+		// schema_file 的内容读入 schema，文件变化后热加载即可生效
+		if eventType.SchemaFile != "" {
+			if eventType.Schema != "" {
+				errs = append(errs, fmt.Errorf("invalid events.types[%d]: schema and schema_file cannot be used together", i))
+				continue
+			}
+			data, err := os.ReadFile(resolvePath(baseDir, eventType.SchemaFile))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid events.types[%d].schema_file: %v", i, err))
+				continue
+			}
+			eventType.Schema = string(data)
+		}
+		if eventType.Schema != "" {
+			if _, err := funcs.CompileSchema([]byte(eventType.Schema)); err != nil {
+				errs = append(errs, fmt.Errorf("invalid events.types[%d].schema: %v", i, err))
+			}
+		}
+	}
+	if config.Audit.Path == "" {
+		config.Audit.Path = "logs/audit.jsonl"
+	}
+	if !filepath.IsAbs(config.Audit.Path) {
+		config.Audit.Path = filepath.Join(baseDir, config.Audit.Path)
+	}
+	if config.Audit.RedisStreamMaxLen <= 0 {
+		config.Audit.RedisStreamMaxLen = 100000
+	}
+	logOptions := config.logOptions()
+	if err := logOptions.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log config: %w", err))
+	}
+	if config.Log.MaxSizeMB < 0 || config.Log.MaxAgeDays < 0 || config.Log.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("invalid log config: rotation settings cannot be negative"))
+	}
+	return errors.Join(errs...)
 }
 
-func initLogger(baseDir string, config *Config) (accessLogFile, errorLogFile, appLogFile *os.File) {
+// 打开日志文件并初始化结构化日志，三类日志都按[log]的配置轮转
+func initLogger(baseDir string, config *Config) (accessLogFile, errorLogFile, appLogFile *funcs.RotatingWriter, err error) {
+	rotate := config.rotateOptions()
+
 	// access log path
-	if !filepath.IsAbs(config.Server.AccessLogPath) {
-		config.Server.AccessLogPath = filepath.Join(baseDir, config.Server.AccessLogPath)
-	}
-	funcs.TouchDir(filepath.Dir(config.Server.AccessLogPath))
-	accessLogFile, err := os.OpenFile(config.Server.AccessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	accessLogFile, err = funcs.NewRotatingWriter(resolvePath(baseDir, config.Server.AccessLogPath), rotate)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		return nil, nil, nil, err
 	}
 	gin.DefaultWriter = io.MultiWriter(accessLogFile, os.Stdout)
 
 	// error log path
-	if !filepath.IsAbs(config.Server.ErrorLogPath) {
-		config.Server.ErrorLogPath = filepath.Join(baseDir, config.Server.ErrorLogPath)
-	}
-	funcs.TouchDir(filepath.Dir(config.Server.ErrorLogPath))
-	errorLogFile, err = os.OpenFile(config.Server.ErrorLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	errorLogFile, err = funcs.NewRotatingWriter(resolvePath(baseDir, config.Server.ErrorLogPath), rotate)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		return nil, nil, nil, err
 	}
 	gin.DefaultErrorWriter = io.MultiWriter(errorLogFile, os.Stderr)
 
 	// app log path
-	if !filepath.IsAbs(config.Server.BrokerLogPath) {
-		config.Server.BrokerLogPath = filepath.Join(baseDir, config.Server.BrokerLogPath)
+	appLogFile, err = funcs.NewRotatingWriter(resolvePath(baseDir, config.Server.BrokerLogPath), rotate)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := funcs.InitLogger(config.logOptions(), io.MultiWriter(os.Stdout, appLogFile)); err != nil {
+		return nil, nil, nil, err
 	}
-	appLogFile = funcs.InitializeLogFile(config.Server.BrokerLogPath, true)
-	return accessLogFile, errorLogFile, appLogFile
+	return accessLogFile, errorLogFile, appLogFile, nil
 }
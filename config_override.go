@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// 环境变量前缀：SSE_BROKER_<SECTION>_<KEY>，如 SSE_BROKER_REDIS_ADDRS；加 _FILE 后缀时从文件读取值
+const ENV_PREFIX = "SSE_BROKER_"
+
+// 指定配置文件路径的环境变量，不属于配置项
+const ENV_CONFIG_PATH = ENV_PREFIX + "CONFIG"
+
+const REDACTED = "******"
+
+// 配置项：以点分隔的路径(如 redis.tls.ca_file)及对应字段
+type configField struct {
+	path  string
+	value reflect.Value
+}
+
+// 按toml标签展开全部配置项，嵌套的结构体(配置节)继续展开
+func configFields(v reflect.Value, prefix string, fields *[]configField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		path := tag
+		if prefix != "" {
+			path = prefix + "." + tag
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			configFields(field, path, fields)
+			continue
+		}
+		*fields = append(*fields, configField{path: path, value: field})
+	}
+}
+
+// 配置项对应的环境变量名
+func envName(path string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// 按字段类型解析字符串值：列表以逗号分隔，映射为 k=v 以逗号分隔，其他复杂类型为JSON
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(raw), value.Addr().Interface())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if value.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(raw), value.Addr().Interface())
+		}
+		items := make(map[string]string)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("invalid entry %q, expect key=value", item)
+			}
+			items[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// 读取 _FILE 环境变量指向的文件，去掉末尾换行
+func readValueFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// 应用环境变量覆盖；未知的 SSE_BROKER_ 变量视为错误，避免拼写错误被忽略
+func applyEnvOverrides(config *Config, environ []string) []error {
+	var fields []configField
+	configFields(reflect.ValueOf(config).Elem(), "", &fields)
+	byName := make(map[string]configField, len(fields)*2)
+	for _, field := range fields {
+		byName[envName(field.path)] = field
+	}
+	var errs []error
+	sort.Strings(environ)
+	for _, env := range environ {
+		name, raw, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, ENV_PREFIX) || name == ENV_CONFIG_PATH {
+			continue
+		}
+		field, ok := byName[name]
+		if !ok && strings.HasSuffix(name, "_FILE") {
+			field, ok = byName[strings.TrimSuffix(name, "_FILE")]
+			if ok {
+				value, err := readValueFile(raw)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", name, err))
+					continue
+				}
+				raw = value
+			}
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown config override", name))
+			continue
+		}
+		if err := setConfigValue(field.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// 应用命令行 -set path=value 覆盖，优先级高于环境变量
+func applyFlagOverrides(config *Config, overrides []string) []error {
+	var fields []configField
+	configFields(reflect.ValueOf(config).Elem(), "", &fields)
+	byPath := make(map[string]configField, len(fields))
+	for _, field := range fields {
+		byPath[field.path] = field
+	}
+	var errs []error
+	for _, override := range overrides {
+		path, raw, ok := strings.Cut(override, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("-set %s: expect path=value", override))
+			continue
+		}
+		field, ok := byPath[strings.TrimSpace(path)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("-set %s: unknown config path", path))
+			continue
+		}
+		if err := setConfigValue(field.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("-set %s: %w", path, err))
+		}
+	}
+	return errs
+}
+
+// 将带 secret 标签的非空字段替换为占位符
+func redactSecrets(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := v.Field(i)
+			if t.Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+				if field.String() != "" {
+					field.SetString(REDACTED)
+				}
+				continue
+			}
+			redactSecrets(field)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redactSecrets(v.Index(i))
+		}
+	}
+}
+
+// 输出生效的配置，密钥已隐藏
+func printConfig(config *Config) error {
+	// 先经TOML深拷贝，避免修改运行中的配置
+	data, err := toml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var redacted Config
+	if err := toml.Unmarshal(data, &redacted); err != nil {
+		return err
+	}
+	redactSecrets(reflect.ValueOf(&redacted).Elem())
+	data, err = toml.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
+
+// 可重复的 -set 参数
+type overrideFlags []string
+
+func (f *overrideFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *overrideFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sse-broker/funcs"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigValue(t *testing.T) {
+	var target struct {
+		Name  string
+		Port  int
+		On    bool
+		List  []string
+		Map   map[string]string
+		Keys  []struct{ Name string }
+		Other float64
+	}
+	v := reflect.ValueOf(&target).Elem()
+	tests := []struct {
+		field   string
+		raw     string
+		want    interface{}
+		wantErr bool
+	}{
+		{field: "Name", raw: " a b ", want: " a b "},
+		{field: "Port", raw: " 8080 ", want: 8080},
+		{field: "Port", raw: "80x", wantErr: true},
+		{field: "On", raw: "true", want: true},
+		{field: "On", raw: "1", want: true},
+		{field: "On", raw: "yes", wantErr: true},
+		// 列表以逗号分隔，去掉空白和空项
+		{field: "List", raw: "a, b,,c ", want: []string{"a", "b", "c"}},
+		{field: "List", raw: "", want: []string(nil)},
+		// 映射为 k=v，值中可以再有等号
+		{field: "Map", raw: "api=debug, redis = warn,,x=a=b", want: map[string]string{"api": "debug", "redis": "warn", "x": "a=b"}},
+		{field: "Map", raw: "", want: map[string]string{}},
+		{field: "Map", raw: "api", wantErr: true},
+		// 其他复杂类型为JSON
+		{field: "Keys", raw: `[{"Name":"backend"}]`, want: []struct{ Name string }{{Name: "backend"}}},
+		{field: "Keys", raw: "backend", wantErr: true},
+		{field: "Other", raw: "1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		field := v.FieldByName(tt.field)
+		field.Set(reflect.Zero(field.Type()))
+		err := setConfigValue(field, tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s=%q: want error, got %v", tt.field, tt.raw, field.Interface())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s=%q: %v", tt.field, tt.raw, err)
+			continue
+		}
+		if got := field.Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%q: got %#v, want %#v", tt.field, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{}
+	config.Server.Port = 8080
+	errs := applyEnvOverrides(&config, []string{
+		"PATH=/usr/bin",
+		"SSE_BROKER_CONFIG=/etc/sse/config.toml",
+		"SSE_BROKER_REDIS_ADDRS=h1:6379, h2:6379",
+		"SSE_BROKER_REDIS_TLS_ENABLE=true",
+		"SSE_BROKER_LOG_LEVELS=api=debug,redis=warn",
+		"SSE_BROKER_JWT_SECRET_FILE=" + secretFile,
+		`SSE_BROKER_API_KEYS=[{"name":"backend","key":"k1"}]`,
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if config.Server.Port != 8080 {
+		t.Errorf("server.port = %d, want untouched 8080", config.Server.Port)
+	}
+	if want := []string{"h1:6379", "h2:6379"}; !reflect.DeepEqual(config.Redis.Addrs, want) {
+		t.Errorf("redis.addrs = %v, want %v", config.Redis.Addrs, want)
+	}
+	if !config.Redis.TLS.Enable {
+		t.Errorf("redis.tls.enable not set")
+	}
+	if want := map[string]string{"api": "debug", "redis": "warn"}; !reflect.DeepEqual(config.Log.Levels, want) {
+		t.Errorf("log.levels = %v, want %v", config.Log.Levels, want)
+	}
+	if config.JWT.Secret != "s3cret" {
+		t.Errorf("jwt.secret = %q, want value of the file without line break", config.JWT.Secret)
+	}
+	if len(config.API.Keys) != 1 || config.API.Keys[0].Name != "backend" || config.API.Keys[0].Key != "k1" {
+		t.Errorf("api.keys = %+v", config.API.Keys)
+	}
+}
+
+func TestApplyEnvOverridesErrors(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"SSE_BROKER_REDIS_ADDR=h1:6379", "SSE_BROKER_REDIS_ADDR: unknown config override"},
+		{"SSE_BROKER_NOPE_FILE=/tmp/x", "SSE_BROKER_NOPE_FILE: unknown config override"},
+		{"SSE_BROKER_SERVER_PORT=http", `SSE_BROKER_SERVER_PORT: invalid integer "http"`},
+		{"SSE_BROKER_LOG_LEVELS=debug", "SSE_BROKER_LOG_LEVELS: invalid entry"},
+		{"SSE_BROKER_JWT_SECRET_FILE=" + filepath.Join(t.TempDir(), "missing"), "SSE_BROKER_JWT_SECRET_FILE:"},
+		// 配置节本身不是配置项
+		{"SSE_BROKER_REDIS=x", "SSE_BROKER_REDIS: unknown config override"},
+	}
+	for _, tt := range tests {
+		config := Config{}
+		errs := applyEnvOverrides(&config, []string{tt.env})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.env, errs, tt.want)
+		}
+	}
+	// 全部错误一次返回
+	config := Config{}
+	if errs := applyEnvOverrides(&config, []string{"SSE_BROKER_A=1", "SSE_BROKER_B=2"}); len(errs) != 2 {
+		t.Errorf("got %d errors, want 2: %v", len(errs), errs)
+	}
+}
+
+func TestApplyFlagOverrides(t *testing.T) {
+	config := Config{}
+	errs := applyFlagOverrides(&config, []string{"server.port=9000", "redis.addrs=a:1,b:2", " sse.frame_id_scope =user"})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if config.Server.Port != 9000 || len(config.Redis.Addrs) != 2 || config.SSE.FrameIDScope != "user" {
+		t.Errorf("overrides not applied: port=%d addrs=%v scope=%q", config.Server.Port, config.Redis.Addrs, config.SSE.FrameIDScope)
+	}
+	errs = applyFlagOverrides(&config, []string{"server.port", "server.nope=1", "server=1", "server.port=x"})
+	if len(errs) != 4 {
+		t.Errorf("got %d errors, want 4: %v", len(errs), errs)
+	}
+}
+
+// 优先级：配置文件 < 环境变量 < -set
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	content := "[server]\nport = 1000\n[jwt]\nsecret = \"file-secret\"\n[redis]\naddrs = [\"file:6379\"]\n"
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("env-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(dir, "config.toml", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != 1000 || config.JWT.Secret != "file-secret" {
+		t.Errorf("file values not loaded: port=%d secret=%q", config.Server.Port, config.JWT.Secret)
+	}
+
+	t.Setenv("SSE_BROKER_SERVER_PORT", "2000")
+	t.Setenv("SSE_BROKER_JWT_SECRET_FILE", secretFile)
+	config, err = loadConfig(dir, "config.toml", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != 2000 || config.JWT.Secret != "env-secret" {
+		t.Errorf("env overrides not applied: port=%d secret=%q", config.Server.Port, config.JWT.Secret)
+	}
+
+	config, err = loadConfig(dir, "config.toml", true, []string{"server.port=3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != 3000 || config.JWT.Secret != "env-secret" || config.Redis.Addrs[0] != "file:6379" {
+		t.Errorf("-set not applied on top: port=%d secret=%q addrs=%v", config.Server.Port, config.JWT.Secret, config.Redis.Addrs)
+	}
+
+	t.Setenv("SSE_BROKER_SERVER_PROT", "1")
+	if _, err := loadConfig(dir, "config.toml", true, nil); err == nil || !strings.Contains(err.Error(), "SSE_BROKER_SERVER_PROT") {
+		t.Errorf("unknown variable not reported: %v", err)
+	}
+}
+
+// 没有配置文件时只用环境变量配置，未设置的项使用与示例配置一致的默认值
+func TestLoadConfigFromEnvOnly(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SSE_BROKER_JWT_SECRET", "env-secret")
+	t.Setenv("SSE_BROKER_REDIS_ADDRS", "redis:6379")
+	config, err := loadConfig(dir, "config.toml", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.JWT.Secret != "env-secret" || !reflect.DeepEqual(config.Redis.Addrs, []string{"redis:6379"}) {
+		t.Errorf("env values not loaded: secret=%q addrs=%v", config.JWT.Secret, config.Redis.Addrs)
+	}
+	if config.Server.Port != 8080 || config.SSE.HeartbeatInterval != 30 || config.SSE.DeviceFrameExpire != 604800 {
+		t.Errorf("defaults not applied: port=%d heartbeat=%d frame_expire=%d", config.Server.Port, config.SSE.HeartbeatInterval, config.SSE.DeviceFrameExpire)
+	}
+	for _, path := range []string{config.Server.AccessLogPath, config.Server.ErrorLogPath, config.Server.BrokerLogPath} {
+		if path == "" {
+			t.Fatal("log path has no default")
+		}
+		writer, err := funcs.NewRotatingWriter(resolvePath(dir, path), config.rotateOptions())
+		if err != nil {
+			t.Fatalf("open log %s: %v", path, err)
+		}
+		writer.Close()
+	}
+}
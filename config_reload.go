@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sse-broker/funcs"
+	"sse-broker/sse"
+	"strings"
+	"sync"
+)
+
+// 可热加载的配置项，以 . 或 _ 结尾的为路径前缀；其余配置项变化后需重启才能生效
+var liveConfigPaths = []string{
+	"server.drain_delay",
+	"jwt.",
+	"sse.",
+	"api.",
+	"cors.",
+	"compression.",
+	"events.",
+	"audit.enable",
+	"audit.redis_stream",
+	"audit.redis_stream_maxlen",
+	"log.level",
+	"log.levels",
+	"log.format",
+	"log.sample_",
+}
+
+// 上述范围内仍须重启才能生效的配置
+var restartConfigPaths = []string{
+	"sse.frame_id_scope",
+}
+
+// 保护配置的替换
+var reloadMu sync.Mutex
+
+func isLiveConfigPath(path string) bool {
+	for _, restart := range restartConfigPaths {
+		if path == restart {
+			return false
+		}
+	}
+	for _, live := range liveConfigPaths {
+		if path == live {
+			return true
+		}
+		if (strings.HasSuffix(live, ".") || strings.HasSuffix(live, "_")) && strings.HasPrefix(path, live) {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前生效的配置
+func currentConfig() *Config {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	return config
+}
+
+// 重新加载配置文件和覆盖项，可热加载的配置立即生效，其余保持原值并在结果中列出
+func reloadConfig() (*sse.ReloadReport, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadCertificate()
+	newConfig, err := loadConfig(baseDir, configPath, configRequired, configOverrides)
+	if err != nil {
+		return nil, err
+	}
+	var oldFields, newFields []configField
+	configFields(reflect.ValueOf(config).Elem(), "", &oldFields)
+	configFields(reflect.ValueOf(newConfig).Elem(), "", &newFields)
+	report := &sse.ReloadReport{Applied: []string{}, RestartRequired: []string{}}
+	logChanged := false
+	for i := range newFields {
+		if reflect.DeepEqual(oldFields[i].value.Interface(), newFields[i].value.Interface()) {
+			continue
+		}
+		path := newFields[i].path
+		if isLiveConfigPath(path) {
+			report.Applied = append(report.Applied, path)
+			logChanged = logChanged || strings.HasPrefix(path, "log.")
+		} else {
+			report.RestartRequired = append(report.RestartRequired, path)
+			newFields[i].value.Set(oldFields[i].value)
+		}
+	}
+	if logChanged {
+		if err := funcs.InitLogger(newConfig.logOptions(), io.MultiWriter(os.Stdout, appLogFile)); err != nil {
+			return nil, err
+		}
+	}
+	report.ClusterPending = sse.Reload(newSSEConfig(baseDir, newConfig))
+	config = newConfig
+	slog.Info("Config reloaded", "applied", report.Applied, "restart_required", report.RestartRequired, "cluster_pending", report.ClusterPending)
+	return report, nil
+}
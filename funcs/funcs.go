@@ -4,8 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -36,38 +35,12 @@ func GetExecutionPath() string {
 	}
 }
 
-func InitializeLogFile(logFilePath string, stdOut bool) *os.File {
-	// 设置日志前缀包含长文件名和行号
-	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime | log.Lmicroseconds)
-
-	// 指定日志文件的路径
-	logFilDir := filepath.Dir(logFilePath)
-	// 确保目录存在
-	if err := os.MkdirAll(logFilDir, 0755); err != nil {
-		log.Fatalf("Failed to create directory: %v", err)
-	}
-	// 打开或创建日志文件
-	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-	}
-
-	if stdOut {
-		//设置 MultiWriter，同时输出到文件和 stdout
-		mw := io.MultiWriter(os.Stdout, logFile)
-		log.SetOutput(mw)
-	} else {
-		log.SetOutput(logFile)
-	}
-	return logFile
-}
-
 func IsPathExist(path string) bool {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		return false
 	} else if err != nil {
-		log.Printf("An error occurred while checking the path %s: %v\n", path, err)
+		slog.Warn("An error occurred while checking the path", "path", path, "error", err)
 		return false
 	} else {
 		return true
@@ -0,0 +1,506 @@
+package funcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema JSON Schema 的常用子集：type、enum、const、properties、required、additionalProperties、
+// minProperties/maxProperties、items、minItems/maxItems、uniqueItems、minLength/maxLength、pattern、
+// minimum/maximum、exclusiveMinimum/exclusiveMaximum(数值，或 draft-04 的布尔写法)、multipleOf、
+// allOf/anyOf/oneOf/not；title、description 等只作说明的关键字忽略，其他关键字(format、$ref 等)编译时报错，
+// 避免写了却不生效
+type Schema struct {
+	Types                []string
+	Enum                 []interface{}
+	Const                interface{}
+	HasConst             bool
+	Properties           map[string]*Schema
+	Required             []string
+	AdditionalProperties *Schema // 为nil时允许任意附加属性
+	NoAdditional         bool    // additionalProperties: false
+	Items                *Schema
+	MinProperties        *int
+	MaxProperties        *int
+	MinItems, MaxItems   *int
+	UniqueItems          bool
+	MinLength, MaxLength *int
+	Pattern              *regexp.Regexp
+	Minimum, Maximum     *float64
+	ExclusiveMinimum     *float64
+	ExclusiveMaximum     *float64
+	MultipleOf           *big.Rat
+	AllOf, AnyOf, OneOf  []*Schema
+	Not                  *Schema
+	Raw                  json.RawMessage // 原始定义
+}
+
+// CompileSchema 解析JSON Schema，不支持的写法返回错误
+func CompileSchema(data []byte) (*Schema, error) {
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid schema json: %v", err)
+	}
+	schema, err := compileSchema(raw, "#")
+	if err != nil {
+		return nil, err
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, data)
+	schema.Raw = compact.Bytes()
+	return schema, nil
+}
+
+// 支持的关键字
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "properties": true, "required": true, "additionalProperties": true,
+	"minProperties": true, "maxProperties": true, "items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minimum": true, "maximum": true,
+	"exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+}
+
+// 只作说明、不影响校验的关键字
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+func compileSchema(raw interface{}, path string) (*Schema, error) {
+	if b, ok := raw.(bool); ok {
+		// true 接受任何值，false 拒绝任何值
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{Not: &Schema{}}, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", path)
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !schemaKeywords[name] && !schemaAnnotations[name] {
+			return nil, fmt.Errorf("%s: %s is not supported", path, name)
+		}
+	}
+	s := &Schema{}
+	var err error
+	if v, ok := m["type"]; ok {
+		switch t := v.(type) {
+		case string:
+			s.Types = []string{t}
+		case []interface{}:
+			for _, item := range t {
+				name, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s/type: must be a string or an array of strings", path)
+				}
+				s.Types = append(s.Types, name)
+			}
+		default:
+			return nil, fmt.Errorf("%s/type: must be a string or an array of strings", path)
+		}
+		for _, name := range s.Types {
+			switch name {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fmt.Errorf("%s/type: unknown type %q", path, name)
+			}
+		}
+	}
+	if v, ok := m["enum"]; ok {
+		values, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/enum: must be an array", path)
+		}
+		s.Enum = values
+	}
+	if v, ok := m["const"]; ok {
+		s.Const = v
+		s.HasConst = true
+	}
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be an object", path)
+		}
+		s.Properties = make(map[string]*Schema, len(props))
+		for name, prop := range props {
+			if s.Properties[name], err = compileSchema(prop, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["required"]; ok {
+		names, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be an array of strings", path)
+		}
+		for _, item := range names {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: must be an array of strings", path)
+			}
+			s.Required = append(s.Required, name)
+		}
+	}
+	if v, ok := m["additionalProperties"]; ok {
+		if b, ok := v.(bool); ok {
+			s.NoAdditional = !b
+		} else if s.AdditionalProperties, err = compileSchema(v, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := m["items"]; ok {
+		if s.Items, err = compileSchema(v, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	for name, target := range map[string]**int{
+		"minItems": &s.MinItems, "maxItems": &s.MaxItems, "minLength": &s.MinLength, "maxLength": &s.MaxLength,
+		"minProperties": &s.MinProperties, "maxProperties": &s.MaxProperties,
+	} {
+		if v, ok := m[name]; ok {
+			n, ok := schemaNumber(v)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, fmt.Errorf("%s/%s: must be a non-negative integer", path, name)
+			}
+			i := int(n)
+			*target = &i
+		}
+	}
+	for name, target := range map[string]**float64{
+		"minimum": &s.Minimum, "maximum": &s.Maximum, "exclusiveMinimum": &s.ExclusiveMinimum, "exclusiveMaximum": &s.ExclusiveMaximum,
+	} {
+		if v, ok := m[name]; ok {
+			// draft-04 中 exclusiveMinimum/exclusiveMaximum 为布尔值，在下面单独处理
+			if _, ok := v.(bool); ok && strings.HasPrefix(name, "exclusive") {
+				continue
+			}
+			n, ok := schemaNumber(v)
+			if !ok {
+				return nil, fmt.Errorf("%s/%s: must be a number", path, name)
+			}
+			*target = &n
+		}
+	}
+	// draft-04：exclusiveMinimum/exclusiveMaximum 为 true 时 minimum/maximum 不含边界
+	for _, bound := range []struct {
+		name, base string
+		exclusive  **float64
+		inclusive  **float64
+	}{
+		{"exclusiveMinimum", "minimum", &s.ExclusiveMinimum, &s.Minimum},
+		{"exclusiveMaximum", "maximum", &s.ExclusiveMaximum, &s.Maximum},
+	} {
+		if b, ok := m[bound.name].(bool); ok && b {
+			if *bound.inclusive == nil {
+				return nil, fmt.Errorf("%s/%s: %s is required when it is a boolean", path, bound.name, bound.base)
+			}
+			*bound.exclusive, *bound.inclusive = *bound.inclusive, nil
+		}
+	}
+	if v, ok := m["multipleOf"]; ok {
+		n, ok := v.(json.Number)
+		var r *big.Rat
+		if ok {
+			r, ok = new(big.Rat).SetString(n.String())
+		}
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("%s/multipleOf: must be a number greater than 0", path)
+		}
+		s.MultipleOf = r
+	}
+	if v, ok := m["uniqueItems"]; ok {
+		if s.UniqueItems, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("%s/uniqueItems: must be a boolean", path)
+		}
+	}
+	if v, ok := m["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be a string", path)
+		}
+		if s.Pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %v", path, err)
+		}
+	}
+	for name, target := range map[string]*[]*Schema{"allOf": &s.AllOf, "anyOf": &s.AnyOf, "oneOf": &s.OneOf} {
+		if v, ok := m[name]; ok {
+			items, ok := v.([]interface{})
+			if !ok || len(items) == 0 {
+				return nil, fmt.Errorf("%s/%s: must be a non-empty array", path, name)
+			}
+			for i, item := range items {
+				sub, err := compileSchema(item, fmt.Sprintf("%s/%s/%d", path, name, i))
+				if err != nil {
+					return nil, err
+				}
+				*target = append(*target, sub)
+			}
+		}
+	}
+	if v, ok := m["not"]; ok {
+		if s.Not, err = compileSchema(v, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// ValidateJSON 校验JSON文本，返回第一处不符合的位置和原因
+func (s *Schema) ValidateJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid json: %v", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid json: unexpected data after the value")
+	}
+	return s.Validate(value)
+}
+
+// Validate 校验已解析的值，数字须为 json.Number
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate(value, "$")
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		if _, err := v.Int64(); err == nil || !strings.ContainsAny(v.String(), ".eE") {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return "unknown"
+}
+
+// 比较两个JSON值是否相等，数字按数值比较(1 与 1.0 相等)，数组和对象逐项比较
+func jsonEqual(a, b interface{}) bool {
+	switch va := a.(type) {
+	case json.Number:
+		vb, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		ra, okA := new(big.Rat).SetString(va.String())
+		rb, okB := new(big.Rat).SetString(vb.String())
+		return okA && okB && ra.Cmp(rb) == 0
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !jsonEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for name, item := range va {
+			other, ok := vb[name]
+			if !ok || !jsonEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func (s *Schema) validate(value interface{}, path string) error {
+	actual := jsonType(value)
+	if len(s.Types) > 0 {
+		matched := false
+		for _, t := range s.Types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.Types, " or "), actual)
+		}
+	}
+	if s.HasConst && !jsonEqual(value, s.Const) {
+		return fmt.Errorf("%s: must be %v", path, s.Const)
+	}
+	if s.Enum != nil {
+		matched := false
+		for _, item := range s.Enum {
+			if jsonEqual(value, item) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: must be one of %v", path, s.Enum)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s.MinProperties != nil && len(v) < *s.MinProperties {
+			return fmt.Errorf("%s: must have at least %d properties", path, *s.MinProperties)
+		}
+		if s.MaxProperties != nil && len(v) > *s.MaxProperties {
+			return fmt.Errorf("%s: must have at most %d properties", path, *s.MaxProperties)
+		}
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				if err := prop.validate(v[name], path+"."+name); err != nil {
+					return err
+				}
+			} else if s.NoAdditional {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			} else if s.AdditionalProperties != nil {
+				if err := s.AdditionalProperties.validate(v[name], path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: must have at least %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: must have at most %d items", path, *s.MaxItems)
+		}
+		if s.UniqueItems {
+			for i := 1; i < len(v); i++ {
+				for j := 0; j < i; j++ {
+					if jsonEqual(v[i], v[j]) {
+						return fmt.Errorf("%s: items %d and %d are equal", path, j, i)
+					}
+				}
+			}
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			return fmt.Errorf("%s: must match %s", path, s.Pattern.String())
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s: must be >= %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s: must be <= %v", path, *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && n <= *s.ExclusiveMinimum {
+			return fmt.Errorf("%s: must be > %v", path, *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && n >= *s.ExclusiveMaximum {
+			return fmt.Errorf("%s: must be < %v", path, *s.ExclusiveMaximum)
+		}
+		if s.MultipleOf != nil {
+			if r, ok := new(big.Rat).SetString(v.String()); !ok || !r.Quo(r, s.MultipleOf).IsInt() {
+				multiple, _ := s.MultipleOf.Float64()
+				return fmt.Errorf("%s: must be a multiple of %v", path, multiple)
+			}
+		}
+	}
+	for _, sub := range s.AllOf {
+		if err := sub.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		for _, sub := range s.AnyOf {
+			err := sub.validate(value, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%s: does not match any schema of anyOf (%v)", path, firstErr)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(value, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: must match exactly one schema of oneOf, matched %d", path, matched)
+		}
+	}
+	if s.Not != nil && s.Not.validate(value, path) == nil {
+		return fmt.Errorf("%s: must not match the schema of not", path)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package funcs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		keyword string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{"type", `{"type":"string"}`, []string{`"a"`}, []string{`1`, `null`, `{}`}},
+		{"type list", `{"type":["string","null"]}`, []string{`"a"`, `null`}, []string{`1`, `false`}},
+		{"type integer", `{"type":"integer"}`, []string{`1`, `1.0`, `-3`, `1e2`}, []string{`1.5`, `"1"`}},
+		{"type number", `{"type":"number"}`, []string{`1`, `1.5`}, []string{`"1"`, `true`}},
+		{"type object", `{"type":"object"}`, []string{`{}`}, []string{`[]`, `"{}"`}},
+		{"type array", `{"type":"array"}`, []string{`[]`}, []string{`{}`}},
+		{"type boolean", `{"type":"boolean"}`, []string{`true`, `false`}, []string{`0`, `"true"`}},
+		{"enum", `{"enum":["a",1,null]}`, []string{`"a"`, `1`, `1.0`, `null`}, []string{`"b"`, `2`, `false`}},
+		{"enum nested", `{"enum":[[1,{"x":1}]]}`, []string{`[1.0,{"x":1.00}]`}, []string{`[1,{"x":2}]`, `[1]`}},
+		{"const", `{"const":{"a":[1,2]}}`, []string{`{"a":[1,2]}`, `{"a":[1.0,2e0]}`}, []string{`{"a":[2,1]}`, `{"a":[1,2],"b":1}`}},
+		{"properties", `{"properties":{"a":{"type":"string"}}}`, []string{`{"a":"x"}`, `{"b":1}`, `1`}, []string{`{"a":1}`}},
+		{"required", `{"required":["a","b"]}`, []string{`{"a":1,"b":2}`, `[]`}, []string{`{"a":1}`, `{}`}},
+		{"additionalProperties false", `{"properties":{"a":{}},"additionalProperties":false}`, []string{`{"a":1}`}, []string{`{"a":1,"b":2}`}},
+		{"additionalProperties schema", `{"properties":{"a":{}},"additionalProperties":{"type":"integer"}}`, []string{`{"a":"x","b":2}`}, []string{`{"b":"x"}`}},
+		{"minProperties", `{"minProperties":2}`, []string{`{"a":1,"b":2}`, `"x"`}, []string{`{"a":1}`}},
+		{"maxProperties", `{"maxProperties":1}`, []string{`{}`, `{"a":1}`}, []string{`{"a":1,"b":2}`}},
+		{"items", `{"items":{"type":"integer"}}`, []string{`[]`, `[1,2]`}, []string{`[1,"x"]`}},
+		{"minItems", `{"minItems":2}`, []string{`[1,2]`, `{}`}, []string{`[1]`}},
+		{"maxItems", `{"maxItems":1}`, []string{`[]`, `[1]`}, []string{`[1,2]`}},
+		{"uniqueItems", `{"uniqueItems":true}`, []string{`[1,2]`, `[{"a":1},{"a":2}]`}, []string{`[1,1.0]`, `[{"a":1},{"a":1}]`, `[[1],[1]]`}},
+		{"uniqueItems false", `{"uniqueItems":false}`, []string{`[1,1]`}, nil},
+		{"minLength", `{"minLength":2}`, []string{`"ab"`, `"中文"`, `1`}, []string{`"a"`, `"中"`}},
+		{"maxLength", `{"maxLength":2}`, []string{`"中文"`}, []string{`"abc"`}},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, []string{`"abc"`, `1`}, []string{`"ab1"`}},
+		{"minimum", `{"minimum":1}`, []string{`1`, `2`, `"0"`}, []string{`0.9`}},
+		{"maximum", `{"maximum":1}`, []string{`1`, `0`}, []string{`1.1`}},
+		{"exclusiveMinimum", `{"exclusiveMinimum":1}`, []string{`1.1`}, []string{`1`, `0`}},
+		{"exclusiveMaximum", `{"exclusiveMaximum":1}`, []string{`0.9`}, []string{`1`, `2`}},
+		// draft-04 的布尔写法
+		{"exclusiveMinimum draft-04", `{"minimum":1,"exclusiveMinimum":true}`, []string{`1.1`}, []string{`1`}},
+		{"exclusiveMaximum draft-04", `{"maximum":1,"exclusiveMaximum":true}`, []string{`0.9`}, []string{`1`}},
+		{"exclusiveMinimum draft-04 false", `{"minimum":1,"exclusiveMinimum":false}`, []string{`1`}, []string{`0.9`}},
+		{"multipleOf", `{"multipleOf":3}`, []string{`0`, `9`, `-6`, `"x"`}, []string{`10`, `4.5`}},
+		{"multipleOf decimal", `{"multipleOf":0.01}`, []string{`1.23`, `19.99`, `2`}, []string{`1.234`}},
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":2}]}`, []string{`2`}, []string{`1`, `2.5`}},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"minimum":2}]}`, []string{`"a"`, `3`}, []string{`1`}},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":2}]}`, []string{`1`, `2.5`}, []string{`3`, `0.5`}},
+		{"not", `{"not":{"type":"string"}}`, []string{`1`}, []string{`"a"`}},
+		{"true", `true`, []string{`1`, `"a"`, `null`}, nil},
+		{"false", `false`, nil, []string{`1`, `null`}},
+		{"annotations", `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"t","description":"d","default":1,"examples":[1]}`, []string{`1`}, nil},
+	}
+	for _, tt := range tests {
+		schema, err := CompileSchema([]byte(tt.schema))
+		if err != nil {
+			t.Errorf("%s: CompileSchema(%s) error: %v", tt.keyword, tt.schema, err)
+			continue
+		}
+		for _, value := range tt.valid {
+			if err := schema.ValidateJSON([]byte(value)); err != nil {
+				t.Errorf("%s: %s rejected by %s: %v", tt.keyword, value, tt.schema, err)
+			}
+		}
+		for _, value := range tt.invalid {
+			if err := schema.ValidateJSON([]byte(value)); err == nil {
+				t.Errorf("%s: %s accepted by %s", tt.keyword, value, tt.schema)
+			}
+		}
+	}
+}
+
+func TestCompileSchemaRejects(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		// 不支持的关键字在编译时报错，不会被忽略
+		{`{"format":"email"}`, "format is not supported"},
+		{`{"patternProperties":{"^a":{}}}`, "patternProperties is not supported"},
+		{`{"dependentRequired":{"a":["b"]}}`, "dependentRequired is not supported"},
+		{`{"prefixItems":[{}]}`, "prefixItems is not supported"},
+		{`{"$ref":"#/$defs/a"}`, "$ref is not supported"},
+		{`{"$defs":{"a":{}}}`, "$defs is not supported"},
+		{`{"contains":{}}`, "contains is not supported"},
+		{`{"propertyNames":{}}`, "propertyNames is not supported"},
+		{`{"if":{},"then":{}}`, "if is not supported"},
+		{`{"unevaluatedProperties":false}`, "unevaluatedProperties is not supported"},
+		{`{"properties":{"a":{"format":"date"}}}`, "#/properties/a: format is not supported"},
+		{`{"items":[{"type":"string"}]}`, "#/items: schema must be an object or a boolean"},
+		{`{"typo":1}`, "typo is not supported"},
+		// 关键字的值不合法
+		{`{"type":"text"}`, "unknown type"},
+		{`{"enum":"a"}`, "must be an array"},
+		{`{"required":[1]}`, "must be an array of strings"},
+		{`{"minItems":-1}`, "must be a non-negative integer"},
+		{`{"maxProperties":1.5}`, "must be a non-negative integer"},
+		{`{"minimum":"1"}`, "must be a number"},
+		{`{"exclusiveMinimum":true}`, "minimum is required"},
+		{`{"exclusiveMaximum":"1"}`, "must be a number"},
+		{`{"multipleOf":0}`, "must be a number greater than 0"},
+		{`{"multipleOf":-2}`, "must be a number greater than 0"},
+		{`{"uniqueItems":1}`, "must be a boolean"},
+		{`{"pattern":"("}`, "pattern"},
+		{`{"anyOf":[]}`, "must be a non-empty array"},
+		{`1`, "schema must be an object or a boolean"},
+		{`{`, "invalid schema json"},
+	}
+	for _, tt := range tests {
+		_, err := CompileSchema([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("CompileSchema(%s) = %v, want error containing %q", tt.schema, err, tt.want)
+		}
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	schema, err := CompileSchema([]byte(`{"const":[1,{"a":1.5,"b":[true,null,"x"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{`[1,{"a":1.5,"b":[true,null,"x"]}]`, true},
+		{`[1.0,{"b":[true,null,"x"],"a":15e-1}]`, true},
+		{`[1,{"a":1.5,"b":[true,null]}]`, false},
+		{`[1,{"a":1.5,"b":[true,null,"x"],"c":1}]`, false},
+		{`[1,{"a":"1.5","b":[true,null,"x"]}]`, false},
+		{`[2,{"a":1.5,"b":[true,null,"x"]}]`, false},
+	}
+	for _, tt := range tests {
+		if got := schema.ValidateJSON([]byte(tt.value)) == nil; got != tt.want {
+			t.Errorf("%s equal = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
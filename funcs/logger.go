@@ -0,0 +1,200 @@
+package funcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogOptions 日志配置
+type LogOptions struct {
+	Level  string            // 默认级别：debug/info/warn/error
+	Format string            // 输出格式：text/json
+	Levels map[string]string // 各子系统的级别，覆盖默认级别
+	// 调试日志采样：同一条消息每秒先输出SampleInitial条，之后每SampleThereafter条输出1条；0为不采样
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// ParseLogLevel 解析日志级别
+func ParseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("invalid log level: %s", level)
+}
+
+// Validate 校验日志配置
+func (o *LogOptions) Validate() error {
+	if _, err := ParseLogLevel(o.Level); err != nil {
+		return err
+	}
+	for subsystem, level := range o.Levels {
+		if _, err := ParseLogLevel(level); err != nil {
+			return fmt.Errorf("%s: %w", subsystem, err)
+		}
+	}
+	switch o.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid log format: %s", o.Format)
+	}
+	if o.SampleInitial < 0 || o.SampleThereafter < 0 {
+		return fmt.Errorf("log sampling cannot be negative")
+	}
+	return nil
+}
+
+type loggerState struct {
+	generation uint64
+	base       slog.Handler
+	level      slog.Level
+	levels     map[string]slog.Level
+	sampler    *logSampler
+}
+
+var currentLogger atomic.Pointer[loggerState]
+
+func init() {
+	currentLogger.Store(&loggerState{
+		base:   slog.NewTextHandler(log.Writer(), &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:  slog.LevelInfo,
+		levels: map[string]slog.Level{},
+	})
+}
+
+// InitLogger 按配置初始化日志，标准库log的输出也转为结构化日志；可重复调用以更新配置
+func InitLogger(options LogOptions, w io.Writer) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	level, _ := ParseLogLevel(options.Level)
+	levels := make(map[string]slog.Level, len(options.Levels))
+	for subsystem, value := range options.Levels {
+		levels[subsystem], _ = ParseLogLevel(value)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var base slog.Handler
+	if options.Format == "json" {
+		base = slog.NewJSONHandler(w, handlerOptions)
+	} else {
+		base = slog.NewTextHandler(w, handlerOptions)
+	}
+	var sampler *logSampler
+	if options.SampleInitial > 0 || options.SampleThereafter > 0 {
+		sampler = &logSampler{initial: options.SampleInitial, thereafter: options.SampleThereafter}
+	}
+	previous := currentLogger.Load()
+	currentLogger.Store(&loggerState{
+		generation: previous.generation + 1,
+		base:       base,
+		level:      level,
+		levels:     levels,
+		sampler:    sampler,
+	})
+	slog.SetDefault(Logger("app"))
+	return nil
+}
+
+// Logger 返回子系统的日志记录器，输出中带有subsystem字段，级别可按子系统单独配置
+func Logger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+type cachedHandler struct {
+	generation uint64
+	handler    slog.Handler
+}
+
+type subsystemHandler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler // WithAttrs/WithGroup 的调用链
+	cache     atomic.Pointer[cachedHandler]
+}
+
+// 日志配置更新后按新的输出重建
+func (h *subsystemHandler) handler(state *loggerState) slog.Handler {
+	if cached := h.cache.Load(); cached != nil && cached.generation == state.generation {
+		return cached.handler
+	}
+	handler := state.base.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	h.cache.Store(&cachedHandler{generation: state.generation, handler: handler})
+	return handler
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	state := currentLogger.Load()
+	minLevel, ok := state.levels[h.subsystem]
+	if !ok {
+		minLevel = state.level
+	}
+	return level >= minLevel
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	state := currentLogger.Load()
+	if record.Level < slog.LevelInfo && state.sampler != nil && !state.sampler.allow(h.subsystem, record.Message, record.Time) {
+		return nil
+	}
+	return h.handler(state).Handle(ctx, record)
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) *subsystemHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &subsystemHandler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+// 按子系统和消息计数的采样器，每秒重新计数
+type logSampler struct {
+	initial    int
+	thereafter int
+	counters   sync.Map // subsystem + 消息 -> *sampleCounter
+}
+
+type sampleCounter struct {
+	second atomic.Int64
+	count  atomic.Int64
+}
+
+func (s *logSampler) allow(subsystem string, message string, at time.Time) bool {
+	value, _ := s.counters.LoadOrStore(subsystem+"\x00"+message, &sampleCounter{})
+	counter := value.(*sampleCounter)
+	second := at.Unix()
+	if old := counter.second.Load(); old != second && counter.second.CompareAndSwap(old, second) {
+		counter.count.Store(0)
+	}
+	n := counter.count.Add(1)
+	if n <= int64(s.initial) {
+		return true
+	}
+	return s.thereafter > 0 && (n-int64(s.initial))%int64(s.thereafter) == 0
+}
@@ -0,0 +1,177 @@
+package funcs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2 的签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// 受信任的代理发来的连接没有PROXY头
+var ErrMissingProxyHeader = errors.New("proxy protocol: missing header from trusted proxy")
+
+// ProxyListener 支持 PROXY protocol v1/v2 的监听器：受信任的代理发来的连接必须以PROXY头开始，
+// 连接的 RemoteAddr 为PROXY头中的源地址，没有PROXY头的连接被关闭；其他连接原样处理
+type ProxyListener struct {
+	net.Listener
+	Trusted func(addr netip.Addr) bool // 是否采信该地址发来的PROXY头
+	Timeout time.Duration              // 读取PROXY头的超时
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, listener: l, reader: bufio.NewReader(conn)}, nil
+}
+
+// 首次读取或取地址时才解析PROXY头，避免慢连接阻塞 Accept
+type proxyConn struct {
+	net.Conn
+	listener   *ProxyListener
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		addr, err := netip.ParseAddrPort(c.remoteAddr.String())
+		if err != nil || c.listener.Trusted == nil || !c.listener.Trusted(addr.Addr().Unmap()) {
+			return
+		}
+		if c.listener.Timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.listener.Timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		source, err := readProxyHeader(c.reader)
+		if err != nil {
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		if source != nil {
+			c.remoteAddr = source
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// 读取PROXY头，返回源地址；UNKNOWN或LOCAL时返回nil；没有PROXY头时返回 ErrMissingProxyHeader
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(peek) == "PROXY" {
+		return readProxyV1(r)
+	}
+	if peek[0] == proxyV2Signature[0] {
+		peek, err = r.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(peek, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, ErrMissingProxyHeader
+}
+
+// v1：PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n，最长107字节
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1: header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol v1: invalid header %q", line)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: invalid source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// v2：12字节签名，版本与命令，地址族与协议，2字节长度，随后为地址
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol v2: unsupported version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL 为代理自身的健康检查等连接，使用直连地址
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("proxy protocol v2: unsupported command %d", command)
+	}
+	switch family {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, errors.New("proxy protocol v2: short IPv4 address")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("proxy protocol v2: short IPv6 address")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	default:
+		// UNSPEC 或 UNIX 地址，使用直连地址
+		return nil, nil
+	}
+}
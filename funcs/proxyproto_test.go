@@ -0,0 +1,207 @@
+package funcs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 生成 PROXY protocol v2 头
+func proxyV2Header(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func proxyV2IPv4(src string, srcPort uint16) []byte {
+	body := netip.MustParseAddr(src).AsSlice()
+	body = append(body, 10, 0, 0, 1)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, 443)
+}
+
+func proxyV2IPv6(src string, srcPort uint16) []byte {
+	body := netip.MustParseAddr(src).AsSlice()
+	body = append(body, netip.MustParseAddr("fd00::1").AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, 443)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // 空串表示返回nil地址
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET / HTTP/1.1\r\n"), want: "203.0.113.7:51234"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::7 fd00::1 51234 443\r\n"), want: "[2001:db8::7]:51234"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{name: "v1 invalid protocol", input: []byte("PROXY UDP4 203.0.113.7 10.0.0.1 51234 443\r\n"), wantErr: true},
+		{name: "v1 missing fields", input: []byte("PROXY TCP4 203.0.113.7\r\n"), wantErr: true},
+		{name: "v1 invalid address", input: []byte("PROXY TCP4 203.0.113.999 10.0.0.1 51234 443\r\n"), wantErr: true},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n"), wantErr: true},
+		{name: "v1 without crlf", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n"), wantErr: true},
+		{name: "v1 too long", input: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), wantErr: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 203.0.113.7 10.0"), wantErr: true},
+		{name: "v2 ipv4", input: proxyV2Header(1, 1, proxyV2IPv4("198.51.100.9", 40000)), want: "198.51.100.9:40000"},
+		{name: "v2 ipv6", input: proxyV2Header(1, 2, proxyV2IPv6("2001:db8::9", 40000)), want: "[2001:db8::9]:40000"},
+		// 地址后可以带TLV扩展
+		{name: "v2 ipv4 with tlv", input: proxyV2Header(1, 1, append(proxyV2IPv4("198.51.100.9", 1), 0x04, 0, 1, 'x')), want: "198.51.100.9:1"},
+		{name: "v2 local", input: proxyV2Header(0, 0, nil)},
+		{name: "v2 local with address", input: proxyV2Header(0, 1, proxyV2IPv4("198.51.100.9", 40000))},
+		{name: "v2 unspec", input: proxyV2Header(1, 0, nil)},
+		{name: "v2 unix", input: proxyV2Header(1, 3, make([]byte, 216))},
+		{name: "v2 unsupported command", input: proxyV2Header(2, 1, proxyV2IPv4("198.51.100.9", 40000)), wantErr: true},
+		{name: "v2 unsupported version", input: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), wantErr: true},
+		{name: "v2 short ipv4", input: proxyV2Header(1, 1, make([]byte, 8)), wantErr: true},
+		{name: "v2 short ipv6", input: proxyV2Header(1, 2, make([]byte, 20)), wantErr: true},
+		{name: "v2 truncated header", input: proxyV2Header(1, 1, proxyV2IPv4("198.51.100.9", 40000))[:14], wantErr: true},
+		{name: "v2 truncated body", input: proxyV2Header(1, 1, proxyV2IPv4("198.51.100.9", 40000))[:20], wantErr: true},
+		// 受信任的代理必须发送PROXY头
+		{name: "missing header", input: []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), wantErr: true},
+		{name: "almost v2 signature", input: []byte("\r\n\r\n\x00\r\nQUIT\r"), wantErr: true},
+		{name: "empty", input: nil, wantErr: true},
+		{name: "short", input: []byte("PRO"), wantErr: true},
+	}
+	for _, tt := range tests {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	_, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")))
+	if !errors.Is(err, ErrMissingProxyHeader) {
+		t.Errorf("got %v, want ErrMissingProxyHeader", err)
+	}
+}
+
+// 启动一个 ProxyListener，返回其地址和接受的连接
+func startProxyListener(t *testing.T, trusted bool, timeout time.Duration) (string, <-chan net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &ProxyListener{
+		Listener: inner,
+		Trusted:  func(addr netip.Addr) bool { return trusted },
+		Timeout:  timeout,
+	}
+	t.Cleanup(func() { listener.Close() })
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+	return inner.Addr().String(), conns
+}
+
+func TestProxyListener(t *testing.T) {
+	address, conns := startProxyListener(t, true, time.Second)
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello"))
+	conn := <-conns
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("RemoteAddr = %s, want 203.0.113.7:51234", got)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "hello" {
+		t.Errorf("Read = %q, %v; want data after the header", data, err)
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	address, conns := startProxyListener(t, false, time.Second)
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"))
+	conn := <-conns
+	defer conn.Close()
+	// 不受信任的连接不解析PROXY头，内容原样读出
+	if got := conn.RemoteAddr().String(); got != client.LocalAddr().String() {
+		t.Errorf("RemoteAddr = %s, want %s", got, client.LocalAddr())
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "PROXY" {
+		t.Errorf("Read = %q, %v; want raw data", data, err)
+	}
+}
+
+func TestProxyListenerRejectsMissingHeader(t *testing.T) {
+	address, conns := startProxyListener(t, true, time.Second)
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn := <-conns
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, ErrMissingProxyHeader) {
+		t.Errorf("Read error = %v, want ErrMissingProxyHeader", err)
+	}
+	// 连接已被关闭
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection still open")
+	}
+}
+
+func TestProxyListenerTimeout(t *testing.T) {
+	address, conns := startProxyListener(t, true, 50*time.Millisecond)
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 只发送一部分PROXY头后停止
+	client.Write([]byte("PROXY TCP4"))
+	conn := <-conns
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read error = %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+}
@@ -2,76 +2,263 @@ package funcs
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var redisLogger = Logger("redis")
+
 type RedisClient struct {
 	client redis.UniversalClient
 }
 
+// RedisOptions Redis连接配置
+type RedisOptions struct {
+	Mode             string   // 连接模式：standalone/cluster/sentinel，为空时按地址数量判断
+	Addrs            []string // 服务器地址；sentinel模式下为哨兵地址
+	Username         string   // ACL用户名
+	Password         string
+	DB               int
+	PoolSize         int
+	MasterName       string // sentinel模式下的主节点名称
+	SentinelUsername string
+	SentinelPassword string
+	TLS              struct {
+		Enable             bool
+		CAFile             string
+		CertFile           string
+		KeyFile            string
+		ServerName         string
+		InsecureSkipVerify bool
+	}
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// 实际使用的连接模式
+func (o *RedisOptions) mode() string {
+	if o.Mode != "" {
+		return o.Mode
+	}
+	if len(o.Addrs) > 1 {
+		return REDIS_MODE_CLUSTER
+	}
+	return REDIS_MODE_STANDALONE
+}
+
+const REDIS_MODE_STANDALONE = "standalone"
+const REDIS_MODE_CLUSTER = "cluster"
+const REDIS_MODE_SENTINEL = "sentinel"
+
+// 连接超时为0时使用的默认值，与go-redis的默认值一致；自定义Dialer时go-redis不会再补上
+const REDIS_DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+
+// Validate 校验连接配置，返回全部错误
+func (o *RedisOptions) Validate() error {
+	var errs []error
+	if len(o.Addrs) == 0 {
+		errs = append(errs, errors.New("redis.addrs cannot be empty"))
+	}
+	for _, addr := range o.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("redis.addrs: invalid address %q: %v", addr, err))
+		}
+	}
+	switch o.Mode {
+	case "", REDIS_MODE_STANDALONE, REDIS_MODE_CLUSTER:
+		if o.MasterName != "" {
+			errs = append(errs, errors.New("redis.master_name is only used in sentinel mode"))
+		}
+	case REDIS_MODE_SENTINEL:
+		if o.MasterName == "" {
+			errs = append(errs, errors.New("redis.master_name is required in sentinel mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("redis.mode: unknown mode %q, expected standalone, cluster or sentinel", o.Mode))
+	}
+	if o.Mode == REDIS_MODE_STANDALONE && len(o.Addrs) > 1 {
+		errs = append(errs, errors.New("redis.addrs: standalone mode accepts only one address"))
+	}
+	if o.mode() == REDIS_MODE_CLUSTER && o.DB != 0 {
+		errs = append(errs, errors.New("redis.db must be 0 in cluster mode"))
+	}
+	if o.DB < 0 {
+		errs = append(errs, errors.New("redis.db cannot be negative"))
+	}
+	if o.DialTimeout < 0 || o.ReadTimeout < 0 || o.WriteTimeout < 0 {
+		errs = append(errs, errors.New("redis timeouts cannot be negative"))
+	}
+	if o.MinRetryBackoff < 0 || o.MaxRetryBackoff < 0 {
+		errs = append(errs, errors.New("redis retry backoff cannot be negative"))
+	} else if o.MaxRetryBackoff > 0 && o.MinRetryBackoff > o.MaxRetryBackoff {
+		errs = append(errs, errors.New("redis.min_retry_backoff cannot be greater than redis.max_retry_backoff"))
+	}
+	if o.TLS.Enable {
+		if (o.TLS.CertFile == "") != (o.TLS.KeyFile == "") {
+			errs = append(errs, errors.New("redis.tls.cert_file and redis.tls.key_file must be set together"))
+		}
+		for name, file := range map[string]string{"ca_file": o.TLS.CAFile, "cert_file": o.TLS.CertFile, "key_file": o.TLS.KeyFile} {
+			if file != "" && !IsPathExist(file) {
+				errs = append(errs, fmt.Errorf("redis.tls.%s: file %s not found", name, file))
+			}
+		}
+		if len(errs) == 0 {
+			if _, err := o.tlsConfig(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 根据配置生成TLS配置，未启用时返回nil
+func (o *RedisOptions) tlsConfig() (*tls.Config, error) {
+	if !o.TLS.Enable {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.TLS.ServerName,
+		InsecureSkipVerify: o.TLS.InsecureSkipVerify,
+	}
+	if o.TLS.CAFile != "" {
+		pem, err := os.ReadFile(o.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis.tls.ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis.tls.ca_file: no certificate found in %s", o.TLS.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLS.CertFile, o.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis.tls: failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 // NewRedisClient 创建一个新的 Redis 客户端实例。
 //
 // 参数：
-//   - addrs []string：Redis 服务器地址列表。
-//   - password string：Redis 访问密码。
-//   - db int：数据库索引。
-//   - poolSize int：连接池大小。
+//   - options *RedisOptions：连接配置，支持单例、集群、哨兵模式，以及ACL用户名和TLS。
 //
 // 返回值：
 //   - *RedisClient：Redis 客户端实例。
 //   - string：本地 IP 和端口。
 //   - error：错误信息，如果操作成功则为 nil。
-func NewRedisClient(addrs []string, password string, db int, poolSize int) (*RedisClient, string, int, error) {
+func NewRedisClient(options *RedisOptions) (*RedisClient, string, int, error) {
 	var client redis.UniversalClient
 	var localIP string = "127.0.0.1"
 	var localPort int = 0
-	isCluster := len(addrs) > 1
-	dialer := &net.Dialer{}
+	if err := options.Validate(); err != nil {
+		return nil, localIP, localPort, err
+	}
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, localIP, localPort, err
+	}
+	dialTimeout := options.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = REDIS_DEFAULT_DIAL_TIMEOUT
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	// 自定义Dialer时go-redis不再处理TLS，需在此完成握手
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		localAddr := conn.LocalAddr().(*net.TCPAddr)
+		localIP = localAddr.IP.String()
+		localPort = localAddr.Port
+		if tlsConfig == nil {
+			return conn, nil
+		}
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
 
-	if isCluster {
+	switch options.mode() {
+	case REDIS_MODE_CLUSTER:
 		// 集群模式
-		clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:    addrs,
-			Password: password,
-			PoolSize: poolSize, // 连接池大小
-			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				conn, err := dialer.DialContext(ctx, network, addr)
-				if err == nil {
-					localAddr := conn.LocalAddr().(*net.TCPAddr)
-					localIP = localAddr.IP.String()
-					localPort = localAddr.Port
-				}
-				return conn, err
-			},
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           options.Addrs,
+			Username:        options.Username,
+			Password:        options.Password,
+			PoolSize:        options.PoolSize, // 连接池大小
+			Dialer:          dial,
+			DialTimeout:     dialTimeout,
+			ReadTimeout:     options.ReadTimeout,
+			WriteTimeout:    options.WriteTimeout,
+			MaxRetries:      options.MaxRetries,
+			MinRetryBackoff: options.MinRetryBackoff,
+			MaxRetryBackoff: options.MaxRetryBackoff,
 		})
-		client = clusterClient
-	} else {
+	case REDIS_MODE_SENTINEL:
+		// 哨兵模式
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       options.MasterName,
+			SentinelAddrs:    options.Addrs,
+			SentinelUsername: options.SentinelUsername,
+			SentinelPassword: options.SentinelPassword,
+			Username:         options.Username,
+			Password:         options.Password,
+			DB:               options.DB,
+			PoolSize:         options.PoolSize, // 连接池大小
+			Dialer:           dial,
+			DialTimeout:      dialTimeout,
+			ReadTimeout:      options.ReadTimeout,
+			WriteTimeout:     options.WriteTimeout,
+			MaxRetries:       options.MaxRetries,
+			MinRetryBackoff:  options.MinRetryBackoff,
+			MaxRetryBackoff:  options.MaxRetryBackoff,
+		})
+	default:
 		// 单例模式
-		singleClient := redis.NewClient(&redis.Options{
-			Addr:     addrs[0],
-			Password: password,
-			DB:       db,
-			PoolSize: poolSize, // 连接池大小
-			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				conn, err := dialer.DialContext(ctx, network, addr)
-				if err == nil {
-					localAddr := conn.LocalAddr().(*net.TCPAddr)
-					localIP = localAddr.IP.String()
-					localPort = localAddr.Port
-				}
-				return conn, err
-			},
+		client = redis.NewClient(&redis.Options{
+			Addr:            options.Addrs[0],
+			Username:        options.Username,
+			Password:        options.Password,
+			DB:              options.DB,
+			PoolSize:        options.PoolSize, // 连接池大小
+			Dialer:          dial,
+			DialTimeout:     dialTimeout,
+			ReadTimeout:     options.ReadTimeout,
+			WriteTimeout:    options.WriteTimeout,
+			MaxRetries:      options.MaxRetries,
+			MinRetryBackoff: options.MinRetryBackoff,
+			MaxRetryBackoff: options.MaxRetryBackoff,
 		})
-		client = singleClient
 	}
 
 	// 测试连接是否成功
-	err := client.Ping(context.Background()).Err()
+	err = client.Ping(context.Background()).Err()
 	if err != nil {
+		client.Close()
 		return nil, localIP, localPort, err
 	}
 
@@ -831,7 +1018,7 @@ func (r *RedisClient) Publish(channel string, message interface{}) error {
 // 返回值：
 //   - error：错误信息，如果操作成功则为 nil。
 func (r *RedisClient) Subscribe(ctx context.Context, handler func(channel string, payload string), channels ...string) error {
-	log.Printf("Subscribe Redis Channels: %v", channels)
+	redisLogger.Info("Subscribe redis channels", "channels", channels)
 	pubsub := r.client.Subscribe(ctx, channels...)
 
 	// 等待订阅确认
@@ -845,20 +1032,88 @@ func (r *RedisClient) Subscribe(ctx context.Context, handler func(channel string
 		case <-ctx.Done():
 			// 取消订阅并关闭 pubsub
 			pubsub.Close()
-			log.Printf("Subscribe canceled: %v", channels)
+			redisLogger.Info("Subscribe canceled", "channels", channels)
 			return nil
 		case msg, ok := <-pubsub.Channel():
 			// 检查订阅通道是否关闭
 			if !ok {
-				log.Printf("Subscribe closed: %v", channels)
+				redisLogger.Info("Subscribe closed", "channels", channels)
 				return nil
 			}
-			log.Printf("Message: %v\n", msg)
+			redisLogger.Debug("Receive message", "channel", msg.Channel, "size", len(msg.Payload))
 			handler(msg.Channel, msg.Payload)
 		}
 	}
 }
 
+// SubscribeForever 订阅一个或多个频道，连接断开后按指数退避自动重新订阅，直到ctx取消，该方法会阻塞当前 goroutine。
+//
+// 参数：
+//   - ctx context.Context：带cancel的context。
+//   - handler func(channel string, payload string)：消息处理函数。
+//   - onState func(connected bool, err error)：每次订阅成功(connected为true)或订阅中断时回调。
+//   - channels ...string：频道列表。
+func (r *RedisClient) SubscribeForever(ctx context.Context, handler func(channel string, payload string), onState func(connected bool, err error), channels ...string) {
+	const minBackoff = 500 * time.Millisecond
+	const maxBackoff = 30 * time.Second
+	backoff := minBackoff
+	for {
+		redisLogger.Info("Subscribe redis channels", "channels", channels)
+		pubsub := r.client.Subscribe(ctx, channels...)
+		// 等待订阅确认
+		_, err := pubsub.Receive(ctx)
+		if err == nil {
+			backoff = minBackoff
+			onState(true, nil)
+			err = receiveMessages(ctx, pubsub, handler)
+		}
+		pubsub.Close()
+		if ctx.Err() != nil {
+			redisLogger.Info("Subscribe canceled", "channels", channels)
+			return
+		}
+		redisLogger.Warn("Subscribe interrupted", "channels", channels, "retry_in", backoff, "error", err)
+		onState(false, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// 持续接收订阅消息；空闲时发送PING检测连接，连续两个周期无响应视为连接断开
+func receiveMessages(ctx context.Context, pubsub *redis.PubSub, handler func(channel string, payload string)) error {
+	const healthCheckInterval = 15 * time.Second
+	waiting := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, healthCheckInterval)
+		if err != nil {
+			var netErr net.Error
+			if ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+				if waiting {
+					return fmt.Errorf("no response to ping in %v", healthCheckInterval)
+				}
+				if err := pubsub.Ping(ctx); err != nil {
+					return err
+				}
+				waiting = true
+				continue
+			}
+			return err
+		}
+		waiting = false
+		if message, ok := msg.(*redis.Message); ok {
+			redisLogger.Debug("Receive message", "channel", message.Channel, "size", len(message.Payload))
+			handler(message.Channel, message.Payload)
+		}
+	}
+}
+
 func (r *RedisClient) GetClient() redis.UniversalClient {
 	return r.client
 }
@@ -879,6 +1134,17 @@ func (r *RedisClient) Client() redis.UniversalClient {
 	return r.client
 }
 
+// Ping 检查Redis是否可用。
+//
+// 参数：
+//   - ctx context.Context：上下文，用于控制超时。
+//
+// 返回值：
+//   - error：错误信息，如果Redis可用则为 nil。
+func (r *RedisClient) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
 func (r *RedisClient) Close() error {
 	return r.client.Close()
 }
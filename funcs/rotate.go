@@ -0,0 +1,148 @@
+package funcs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions 日志轮转配置
+type RotateOptions struct {
+	MaxSize    int64         // 单个文件的最大字节数，0为不按大小轮转
+	Daily      bool          // 是否每天轮转
+	MaxAge     time.Duration // 轮转后文件的保留时长，0为不按时长清理
+	MaxBackups int           // 轮转后文件的保留个数，0为不按个数清理
+}
+
+// RotatingWriter 按大小或日期轮转的日志文件，轮转后的文件名为 原文件名.时间戳
+type RotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	options  RotateOptions
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// NewRotatingWriter 打开或创建日志文件
+func NewRotatingWriter(path string, options RotateOptions) (*RotatingWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	w := &RotatingWriter{path: path, options: options}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	w.file = file
+	w.size = info.Size()
+	w.openedAt = info.ModTime()
+	if w.size == 0 {
+		w.openedAt = time.Now()
+	}
+	return nil
+}
+
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if w.size > 0 && w.shouldRotate(now, int64(len(p))) {
+		if err := w.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", w.path, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) shouldRotate(now time.Time, incoming int64) bool {
+	if w.options.MaxSize > 0 && w.size+incoming > w.options.MaxSize {
+		return true
+	}
+	if w.options.Daily {
+		y1, m1, d1 := w.openedAt.Date()
+		y2, m2, d2 := now.Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+	return false
+}
+
+func (w *RotatingWriter) rotate(now time.Time) error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	backup := fmt.Sprintf("%s.%s", w.path, now.Format("20060102-150405.000"))
+	if err := os.Rename(w.path, backup); err != nil {
+		// 改名失败时继续写原文件
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go w.cleanup(now)
+	return nil
+}
+
+// 按保留个数和时长清理轮转后的文件
+func (w *RotatingWriter) cleanup(now time.Time) {
+	if w.options.MaxBackups <= 0 && w.options.MaxAge <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	// 时间戳格式保证按文件名排序即按时间排序，新的在前
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, backup := range backups {
+		if !strings.HasPrefix(backup, w.path+".") {
+			continue
+		}
+		remove := w.options.MaxBackups > 0 && i >= w.options.MaxBackups
+		if !remove && w.options.MaxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && now.Sub(info.ModTime()) > w.options.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(backup)
+		}
+	}
+}
+
+// Close 关闭日志文件
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,60 @@
+package funcs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// 倒序读取时每次读取的块大小
+const reverseChunkSize = 64 * 1024
+
+// ErrLineTooLong 单行超过 ReadLinesReverse 的长度上限
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadLinesReverse 从文件末尾向前逐行读取，fn 返回 false 时停止；空行被跳过。
+// 只读取到停止处，查询最新的记录时无需扫描整个文件。
+//
+// 参数：
+//   - r io.ReaderAt：文件，size 为读取的长度。
+//   - maxLine int：单行最大字节数，超过时返回 ErrLineTooLong。
+//   - fn func([]byte) bool：处理一行(不含换行符)，切片只在调用期间有效。
+func ReadLinesReverse(r io.ReaderAt, size int64, maxLine int, fn func(line []byte) bool) error {
+	var carry []byte // 上一块开头未结束的行
+	pos := size
+	for pos > 0 {
+		n := int64(reverseChunkSize)
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		chunk := make([]byte, n, int(n)+len(carry))
+		if _, err := r.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return err
+		}
+		buf := append(chunk, carry...)
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			if line := bytes.TrimSuffix(buf[i+1:], []byte("\r")); len(line) > 0 {
+				if len(line) > maxLine {
+					return ErrLineTooLong
+				}
+				if !fn(line) {
+					return nil
+				}
+			}
+			buf = buf[:i]
+		}
+		if len(buf) > maxLine {
+			return ErrLineTooLong
+		}
+		carry = buf
+	}
+	if line := bytes.TrimSuffix(carry, []byte("\r")); len(line) > 0 {
+		fn(line)
+	}
+	return nil
+}
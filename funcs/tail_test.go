@@ -0,0 +1,83 @@
+package funcs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadLinesReverse(t *testing.T) {
+	// 跨越多个读取块的长行
+	long := strings.Repeat("x", reverseChunkSize+10)
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", nil},
+		{"trailing newline", "a\nb\nc\n", []string{"c", "b", "a"}},
+		{"no trailing newline", "a\nb", []string{"b", "a"}},
+		{"blank lines and crlf", "a\r\n\n\nb\r\n", []string{"b", "a"}},
+		{"long lines", "a\n" + long + "\nb\n" + long, []string{long, "b", long, "a"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		reader := strings.NewReader(tt.content)
+		err := ReadLinesReverse(reader, int64(len(tt.content)), 2*reverseChunkSize, func(line []byte) bool {
+			got = append(got, string(line))
+			return true
+		})
+		if err != nil {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %d lines %.40q, want %d lines %.40q", tt.name, len(got), got, len(tt.want), tt.want)
+		}
+	}
+}
+
+func TestReadLinesReverseStop(t *testing.T) {
+	var builder strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&builder, "line %d\n", i)
+	}
+	content := builder.String()
+	var got []string
+	reader := &countingReaderAt{Reader: strings.NewReader(content)}
+	err := ReadLinesReverse(reader, int64(len(content)), 1024, func(line []byte) bool {
+		got = append(got, string(line))
+		return len(got) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"line 99999", "line 99998", "line 99997"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// 停止后不再读取前面的内容
+	if reader.read > reverseChunkSize {
+		t.Errorf("read %d bytes, want at most %d", reader.read, reverseChunkSize)
+	}
+}
+
+func TestReadLinesReverseTooLong(t *testing.T) {
+	content := "a\n" + strings.Repeat("x", 100) + "\nb\n"
+	err := ReadLinesReverse(strings.NewReader(content), int64(len(content)), 50, func(line []byte) bool { return true })
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("got %v, want ErrLineTooLong", err)
+	}
+}
+
+type countingReaderAt struct {
+	*strings.Reader
+	read int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	r.read += n
+	return n, err
+}
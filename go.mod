@@ -3,6 +3,7 @@ module sse-broker
 go 1.22.6
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/gin-gonic/gin v1.10.0
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/pelletier/go-toml/v2 v2.2.2
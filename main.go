@@ -2,9 +2,11 @@ package main
 
 import (
 	"embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,10 +19,15 @@ import (
 )
 
 var (
-	config        *Config
-	accessLogFile *os.File
-	errorLogFile  *os.File
-	appLogFile    *os.File
+	config *Config
+	// 配置文件路径及覆盖项，重新加载配置时使用
+	baseDir         string
+	configPath      string
+	configRequired  bool
+	configOverrides overrideFlags
+	accessLogFile   *funcs.RotatingWriter
+	errorLogFile    *funcs.RotatingWriter
+	appLogFile      *funcs.RotatingWriter
 )
 
 //go:embed static/**
@@ -28,17 +35,31 @@ var staticFiles embed.FS
 
 const version = "1.0.5"
 
-// 监测服务关闭信号
+// 监测服务关闭和重新加载配置的信号
 func handleShutdown() {
 	// 创建一个 channel 来接收操作系统信号
 	signalChan := make(chan os.Signal, 1)
 
-	// 捕获 SIGINT (Ctrl+C) 和 SIGTERM (systemctl stop) 信号
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	// 捕获 SIGINT (Ctrl+C)、SIGTERM (systemctl stop) 和 SIGHUP (systemctl reload) 信号
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// 等待信号
+	// 等待信号，SIGHUP 只重新加载配置
 	sig := <-signalChan
-	log.Printf("Received signal: %s. Shutting down...", sig)
+	for sig == syscall.SIGHUP {
+		slog.Info("Received signal, reloading config", "signal", sig.String())
+		if _, err := reloadConfig(); err != nil {
+			slog.Error("Failed to reload config, keep the current config", "error", err)
+		}
+		sig = <-signalChan
+	}
+	slog.Info("Received signal, shutting down", "signal", sig.String())
+
+	// 先排空：就绪检查返回503，等待负载均衡摘除本实例后再关闭连接
+	sse.Drain()
+	if drainDelay := currentConfig().Server.DrainDelay; drainDelay > 0 {
+		slog.Info("Waiting for load balancers to stop routing", "drain_delay", drainDelay)
+		time.Sleep(time.Duration(drainDelay) * time.Second)
+	}
 
 	sse.Stop()
 
@@ -58,7 +79,8 @@ func handleShutdown() {
 	os.Exit(0)
 }
 
-func init() {
+// 解析命令行、加载配置并启动sse模块；在 main 开始时调用，测试时不执行
+func setup() {
 	// 设置Windows控制台为UTF-8编码
 	// if os.Getenv("OS") == "Windows_NT" {
 	// 	handle := windows.Handle(os.Stdout.Fd())
@@ -69,11 +91,12 @@ func init() {
 	// }
 
 	var shortConfig string
-	var configPath string
 	shortVersion := flag.Bool("v", false, "show version")
 	versionFlag := flag.Bool("version", false, "show version")
+	printConfigFlag := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
 	flag.StringVar(&shortConfig, "c", "", "config file path")
 	flag.StringVar(&configPath, "config", "", "config file path")
+	flag.Var(&configOverrides, "set", "override a config item, e.g. -set redis.addrs=127.0.0.1:6379 (repeatable)")
 	flag.Parse()
 
 	if *versionFlag || *shortVersion {
@@ -84,6 +107,11 @@ func init() {
 	if configPath == "" {
 		configPath = shortConfig
 	}
+	if configPath == "" {
+		configPath = os.Getenv(ENV_CONFIG_PATH)
+	}
+	// 未指定配置文件且默认路径不存在时，只用默认值和环境变量、命令行覆盖
+	configRequired = configPath != ""
 	if configPath == "" {
 		if os.Getenv("OS") == "Windows_NT" {
 			configPath = "config.toml"
@@ -91,48 +119,86 @@ func init() {
 			configPath = "/etc/sse-broker/config.toml"
 		}
 	}
-	baseDir := funcs.GetExecutionPath()
-	cfg, err := loadConfig(baseDir, configPath)
+	baseDir = funcs.GetExecutionPath()
+	cfg, err := loadConfig(baseDir, configPath, configRequired, configOverrides)
 	if err != nil {
 		fmt.Printf("Failed to load config: %v\n", err)
 		panic(fmt.Sprintf("Failed to load config: %v\n", err))
 	}
+	if *printConfigFlag {
+		if err := printConfig(cfg); err != nil {
+			fmt.Printf("Failed to print config: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	config = cfg
-	a, e, p := initLogger(baseDir, config)
+	a, e, p, err := initLogger(baseDir, config)
+	if err != nil {
+		fmt.Printf("Failed to initialize logger: %v\n", err)
+		panic(fmt.Sprintf("Failed to initialize logger: %v\n", err))
+	}
 	accessLogFile = a
 	errorLogFile = e
 	appLogFile = p
 
-	sse.Start(sse.Config{
-		Server: struct {
-			Version string
-			Port    int
-		}{Version: version, Port: config.Server.Port},
-		JWT: struct {
-			Secret string
-			Expire int
-		}{Secret: config.JWT.Secret, Expire: config.JWT.Expire},
-		Redis: struct {
-			Addrs    []string
-			Password string
-			DB       int
-			PoolSize int
-		}{Addrs: config.Redis.Addrs, Password: config.Redis.Password, DB: config.Redis.DB, PoolSize: config.Redis.PoolSize},
-		SSE: struct {
-			HeartbeatDuration         time.Duration
-			DeviceUserExistDuration   time.Duration
-			DeviceFrameExpireDuration time.Duration
-			DeviceFrameCacheSize      int
-		}{
-			HeartbeatDuration:         time.Duration(config.SSE.HeartbeatInterval) * time.Second,
-			DeviceUserExistDuration:   time.Duration(config.SSE.HeartbeatInterval+5) * time.Second,
-			DeviceFrameExpireDuration: time.Duration(config.SSE.DeviceFrameExpire) * time.Second,
-			DeviceFrameCacheSize:      config.SSE.DeviceFrameCacheSize,
-		},
-	})
+	sse.Start(newSSEConfig(baseDir, config))
+	sse.SetReloadHandler(reloadConfig)
+}
+
+// 将配置文件转换为sse模块的配置
+func newSSEConfig(baseDir string, config *Config) sse.Config {
+	var c sse.Config
+	c.Server.Version = version
+	c.Server.Port = config.Server.Port
+	c.JWT.Secret = config.JWT.Secret
+	c.JWT.Expire = config.JWT.Expire
+	c.JWT.SecretOverlap = time.Duration(config.JWT.SecretOverlap) * time.Second
+	c.Redis.RedisOptions = config.redisOptions(baseDir)
+	c.Redis.KeyPrefix = config.Redis.KeyPrefix
+	c.Redis.HashTag = config.Redis.HashTag
+	c.SSE.HeartbeatDuration = time.Duration(config.SSE.HeartbeatInterval) * time.Second
+	c.SSE.DeviceUserExistDuration = time.Duration(config.SSE.HeartbeatInterval+5) * time.Second
+	c.SSE.DeviceFrameExpireDuration = time.Duration(config.SSE.DeviceFrameExpire) * time.Second
+	c.SSE.DeviceFrameCacheSize = config.SSE.DeviceFrameCacheSize
+	c.SSE.DeviceQueueSize = config.SSE.DeviceQueueSize
+	c.SSE.DeviceQueueOverflow = config.SSE.DeviceQueueOverflow
+	c.SSE.FrameIDScope = config.SSE.FrameIDScope
+	c.SSE.MaxPayloadSize = config.SSE.MaxPayloadSize
+	for _, apiKey := range config.API.Keys {
+		c.API.Keys = append(c.API.Keys, sse.ApiKey{Name: apiKey.Name, Key: apiKey.Key, Role: apiKey.Role})
+	}
+	c.Proxy.TrustedProxies, _ = config.trustedProxies()
+	c.CORS.AllowedOrigins = config.CORS.AllowedOrigins
+	c.CORS.AllowCredentials = config.CORS.AllowCredentials
+	c.CORS.MaxAge = time.Duration(config.CORS.MaxAge) * time.Second
+	c.CORS.RestrictEvents = config.CORS.RestrictEvents
+	c.Compression.Enable = config.Compression.Enable
+	c.Compression.Encodings = config.Compression.Encodings
+	c.Compression.GzipLevel = config.Compression.GzipLevel
+	c.Compression.BrotliQuality = config.Compression.BrotliQuality
+	c.Compression.FlushSize = config.Compression.FlushSize
+	c.Events.Mode = config.Events.Mode
+	c.Events.Unknown = config.Events.Unknown
+	c.Events.QuarantineMaxLen = config.Events.QuarantineMaxLen
+	for _, eventType := range config.Events.Types {
+		c.Events.Types = append(c.Events.Types, sse.EventType{
+			Name:       eventType.Name,
+			Schema:     json.RawMessage(eventType.Schema),
+			Publishers: eventType.Publishers,
+			Mode:       eventType.Mode,
+		})
+	}
+	c.Audit.Enable = config.Audit.Enable
+	c.Audit.Path = config.Audit.Path
+	c.Audit.RedisStream = config.Audit.RedisStream
+	c.Audit.RedisStreamMaxLen = config.Audit.RedisStreamMaxLen
+	return c
 }
 
 func main() {
+	setup()
+
 	// 设置 Gin 运行模式为 release
 	gin.SetMode(gin.ReleaseMode)
 
@@ -141,6 +207,9 @@ func main() {
 	// 创建Gin引擎
 	engine := gin.Default()
 
+	// 跨域：允许的来源返回CORS响应头，并响应预检请求
+	engine.Use(sse.Cors())
+
 	// 设置静态文件路由
 	engine.GET("/static/*filepath", func(ctx *gin.Context) {
 		staticServer := http.FileServer(http.FS(staticFiles))
@@ -149,6 +218,9 @@ func main() {
 	engine.GET("/", func(ctx *gin.Context) {
 		ctx.Redirect(http.StatusMovedPermanently, "/static/index.html")
 	})
+	engine.GET("/admin", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusMovedPermanently, "/static/admin.html")
+	})
 	engine.GET("/favicon.ico", func(ctx *gin.Context) {
 		favicon, err := staticFiles.ReadFile("static/favicon.ico")
 		if err != nil {
@@ -159,22 +231,64 @@ func main() {
 	})
 
 	// 设置API路由
-	engine.GET("/events", sse.TokenCheck(), sse.HandleEvents)
-	engine.Any("/token", sse.HandleToken)
-	engine.Any("/send", sse.HandleSend)
-	engine.Any("/info", sse.HandleInfo)
-	engine.Any("/kick", sse.HandleKick)
+	// Redis不可用时，依赖Redis的接口直接返回503
+	engine.GET("/events", sse.RejectWhenDraining(), sse.RequireRedis(), sse.TokenCheck(), sse.HandleEvents)
+	// 接口：配置了API密钥时校验调用方，写操作记入审计日志；/admin 下的接口只接受管理密钥
+	engine.Any("/token", sse.Audit("token"), sse.ApiAuth(), sse.HandleToken)
+	engine.Any("/send", sse.Audit("send"), sse.ApiAuth(), sse.RequireRedis(), sse.HandleSend)
+	engine.Any("/send/batch", sse.Audit("send_batch"), sse.ApiAuth(), sse.RequireRedis(), sse.HandleSendBatch)
+	engine.Any("/info", sse.ApiAuth(), sse.RequireRedis(), sse.HandleInfo)
+	engine.Any("/users", sse.ApiAuth(), sse.RequireRedis(), sse.HandleUsers)
+	engine.Any("/devices", sse.ApiAuth(), sse.RequireRedis(), sse.HandleDevices)
+	engine.Any("/kick", sse.Audit("kick"), sse.ApiAuth(), sse.RequireRedis(), sse.HandleKick)
+	engine.Any("/audit", sse.AdminAuth(), sse.HandleAudit)
+	engine.Any("/admin/reload", sse.Audit("reload"), sse.AdminAuth(), sse.HandleReload)
+	// 管理后台：页面在 /static/admin.html，数据均来自以下接口
+	engine.Any("/admin/cluster", sse.AdminAuth(), sse.RequireRedis(), sse.HandleAdminCluster)
+	engine.Any("/admin/users", sse.AdminAuth(), sse.RequireRedis(), sse.HandleAdminUsers)
+	engine.Any("/admin/device", sse.AdminAuth(), sse.RequireRedis(), sse.HandleAdminDevice)
+	engine.Any("/admin/drain", sse.Audit("drain"), sse.AdminAuth(), sse.HandleAdminDrain)
+	engine.GET("/admin/presence", sse.AdminAuth(), sse.RequireRedis(), sse.HandleAdminPresence)
+	engine.Any("/admin/frames", sse.AdminAuth(), sse.RequireRedis(), sse.HandleFrames)
+	engine.Any("/admin/frames/replay", sse.Audit("frames_replay"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleFramesReplay)
+	engine.Any("/admin/frames/delete", sse.Audit("frames_delete"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleFramesDelete)
+	engine.Any("/admin/frames/purge", sse.Audit("frames_purge"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleFramesPurge)
+	engine.GET("/admin/frames/export", sse.Audit("frames_export"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleFramesExport)
+	engine.GET("/admin/event-types", sse.AdminAuth(), sse.RequireRedis(), sse.HandleEventTypes)
+	engine.Any("/admin/event-types/register", sse.Audit("event_type_register"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleEventTypeRegister)
+	engine.Any("/admin/event-types/delete", sse.Audit("event_type_delete"), sse.AdminAuth(), sse.RequireRedis(), sse.HandleEventTypeDelete)
+	engine.GET("/admin/quarantine", sse.AdminAuth(), sse.RequireRedis(), sse.HandleQuarantine)
+	engine.GET("/errors", sse.AdminAuth(), sse.HandleErrors)
+	engine.GET("/metrics", sse.HandleMetrics)
+	engine.GET("/healthz", sse.HandleHealth)
+	engine.GET("/readyz", sse.HandleReady)
+	engine.GET("/status", sse.AdminAuth(), sse.HandleStatus)
+
+	server, err := newHTTPServer(engine)
+	if err != nil {
+		slog.Error("Failed to create server", "error", err)
+		os.Exit(1)
+	}
 
 	instanceIP := sse.GetIP()
 	instancePort := config.Server.Port
-	log.Println("-----------------------------------------------")
-	log.Printf("SSE-Broker Started, Listening Port: %d\n", instancePort)
-	log.Printf("Instance IP: %s, Instance Version: %s\n", instanceIP, version)
-	log.Printf("API  Page: http://%s:%d/\n", instanceIP, instancePort)
-	log.Printf("Demo Page: http://%s:%d/static/demo.html\n", instanceIP, instancePort)
-	log.Println("-----------------------------------------------")
+	scheme := "http"
+	if config.Server.TLS.Enable {
+		scheme = "https"
+	}
+	slog.Info("SSE-Broker started",
+		"port", instancePort,
+		"ip", instanceIP,
+		"version", version,
+		"tls", config.Server.TLS.Enable,
+		"h2c", config.Server.H2C,
+		"api_page", fmt.Sprintf("%s://%s:%d/", scheme, instanceIP, instancePort),
+		"demo_page", fmt.Sprintf("%s://%s:%d/static/demo.html", scheme, instanceIP, instancePort))
 
 	// 启动服务
-	engine.Run(fmt.Sprintf(":%d", instancePort))
+	if err := serve(server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
 
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sse-broker/funcs"
+	"sse-broker/sse"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 读取PROXY头的超时
+const PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+// 启用TLS时的证书，文件变化后自动重新加载
+var certReloader *funcs.CertReloader
+
+// 创建HTTP服务：启用TLS时同时支持HTTP/2，未启用TLS时可选h2c(明文HTTP/2，用于反向代理之后)
+// WriteTimeout 不影响SSE长连接，/events 会清除写超时
+func newHTTPServer(engine *gin.Engine) (*http.Server, error) {
+	engine.UseH2C = config.Server.H2C
+	// 访问日志中的客户端IP同样只采信受信任代理的转发头
+	if err := engine.SetTrustedProxies(config.Proxy.TrustedProxies); err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.Server.Port),
+		Handler:           engine.Handler(),
+		ReadHeaderTimeout: time.Duration(config.Server.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(config.Server.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.Server.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.Server.IdleTimeout) * time.Second,
+	}
+	if !config.Server.TLS.Enable {
+		return server, nil
+	}
+	reloader, err := funcs.NewCertReloader(resolvePath(baseDir, config.Server.TLS.CertFile), resolvePath(baseDir, config.Server.TLS.KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	certReloader = reloader
+	go certReloader.Watch(time.Duration(config.Server.TLS.ReloadInterval) * time.Second)
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certReloader.GetCertificate,
+	}
+	return server, nil
+}
+
+// 启动HTTP服务，启用TLS时证书由 TLSConfig.GetCertificate 提供
+// 启用 PROXY protocol 时，受信任代理的连接以PROXY头中的源地址作为直连地址
+func serve(server *http.Server) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	if config.Proxy.ProxyProtocol {
+		listener = &funcs.ProxyListener{
+			Listener: listener,
+			Trusted:  sse.IsTrustedProxy,
+			Timeout:  PROXY_HEADER_TIMEOUT,
+		}
+	}
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// 重新加载配置时同时检查证书文件
+func reloadCertificate() {
+	if certReloader == nil {
+		return
+	}
+	reloaded, err := certReloader.Reload()
+	if err != nil {
+		slog.Error("Failed to reload certificate, keep the current one", "error", err)
+	} else if reloaded {
+		slog.Info("Certificate reloaded")
+	}
+}
@@ -0,0 +1,200 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sse-broker/funcs"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminUsersParams struct {
+	Query  string `json:"q" form:"q"`           // 用户ID包含的字符串，为空时返回全部在线用户
+	Cursor uint64 `json:"cursor" form:"cursor"` // 上一页返回的游标，0为第一页
+	Limit  int    `json:"limit" form:"limit"`
+}
+
+type AdminDeviceParams struct {
+	Device   string `json:"device" form:"device"`
+	DeviceID string `json:"device_id" form:"device_id"`
+}
+
+type AdminDrainParams struct {
+	Instance string `json:"instance" form:"instance"` // 实例地址，为空时为本实例
+	Resume   bool   `json:"resume" form:"resume"`     // 为true时撤销排空，重新接受新连接
+}
+
+// 在线状态变化事件，供管理后台实时展示
+type PresenceEvent struct {
+	Type string `json:"type"`
+	StateChange
+}
+
+// HandleAdminCluster 集群概况：各实例及其在线设备数
+func HandleAdminCluster(c *gin.Context) {
+	startRequest(c)
+	cluster, err := getClusterInfo()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, gin.H{
+		"self":     globalInstance.Address,
+		"draining": draining.Load(),
+		"cluster":  cluster,
+	})
+}
+
+// HandleAdminUsers 按用户ID搜索在线用户，返回用户及其设备，按游标翻页
+func HandleAdminUsers(c *gin.Context) {
+	startRequest(c)
+	var params AdminUsersParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.Limit <= 0 {
+		params.Limit = ADMIN_USERS_DEFAULT_LIMIT
+	}
+	if params.Limit > ADMIN_USERS_MAX_LIMIT {
+		params.Limit = ADMIN_USERS_MAX_LIMIT
+	}
+	// 与 /users 共用扫描逻辑，按用户ID包含的字符串匹配
+	users, _, cursor, err := scanUsers(&listFilter{uidContains: params.Query}, params.Cursor, params.Limit, true)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, gin.H{
+		"cursor": cursor,
+		"users":  users,
+	})
+}
+
+// HandleAdminDevice 设备详情及其帧缓存
+func HandleAdminDevice(c *gin.Context) {
+	startRequest(c)
+	var params AdminDeviceParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.Device == "" && params.DeviceID == "" {
+		respondError(c, ErrInvalidParams.with("device or device_id is required"))
+		return
+	}
+	deviceId := params.DeviceID
+	if deviceId == "" {
+		deviceId = funcs.MD5(params.Device)
+	}
+	info := getDeviceInfo(deviceId, params.Device)
+	// 只读查看，已过期但尚未清理的帧同样列出(带 expires_at)
+	frames, err := (&Device{DeviceID: deviceId}).getFrameRange(0, 0)
+	if err != nil {
+		respondError(c, ErrRedisUnavailable.with("Failed to get frame cache: %s", err.Error()))
+		return
+	}
+	respondSuccess(c, gin.H{
+		"device": info,
+		"frames": frames,
+	})
+}
+
+// HandleAdminDrain 排空或恢复指定实例：排空后不再接受新连接，已有连接保持
+func HandleAdminDrain(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params AdminDrainParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.Instance == "" {
+		params.Instance = globalInstance.Address
+	}
+	setAuditTarget(c, "instance:"+params.Instance, map[string]string{
+		"resume": fmt.Sprintf("%t", params.Resume),
+	})
+	if params.Instance == globalInstance.Address {
+		setDraining(!params.Resume)
+	} else {
+		if !redisHealth.isAvailable() {
+			respondError(c, ErrRedisUnavailable)
+			return
+		}
+		DispatchInstruction(params.Instance, Instruction{
+			Command: CMD_DRAIN,
+			Data:    fmt.Sprintf("%t", !params.Resume),
+		})
+	}
+	setAuditCount(c, 1)
+	respondSuccess(c, params.Instance)
+}
+
+// HandleAdminPresence 以SSE推送集群内用户和设备的上下线事件
+func HandleAdminPresence(c *gin.Context) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		respondError(c, ErrStreamingUnsupported)
+		return
+	}
+	topics := map[string]string{
+		redisTopic(TOPIC_USER_ONLINE, ""):    "user_online",
+		redisTopic(TOPIC_USER_OFFLINE, ""):   "user_offline",
+		redisTopic(TOPIC_DEVICE_ONLINE, ""):  "device_online",
+		redisTopic(TOPIC_DEVICE_OFFLINE, ""): "device_offline",
+	}
+	channels := make([]string, 0, len(topics))
+	for channel := range topics {
+		channels = append(channels, channel)
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	events := make(chan PresenceEvent, ADMIN_PRESENCE_BUFFER)
+	go func() {
+		err := globalRedis.Subscribe(ctx, func(channel string, payload string) {
+			event := PresenceEvent{Type: topics[channel]}
+			if err := json.Unmarshal([]byte(payload), &event.StateChange); err != nil {
+				return
+			}
+			// 浏览器跟不上时丢弃，不阻塞订阅
+			select {
+			case events <- event:
+			default:
+			}
+		}, channels...)
+		if err != nil {
+			apiLogger.Warn("Presence subscription failed", "error", err)
+		}
+		cancel()
+	}()
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(ADMIN_PRESENCE_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprintf(c.Writer, "%s\n\n", PAYLOAD_HEARTBEAT)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sse-broker/funcs"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditQueryParams struct {
+	From   int64  `json:"from" form:"from"` // unix秒，包含
+	To     int64  `json:"to" form:"to"`     // unix秒，包含
+	Actor  string `json:"actor" form:"actor"`
+	Action string `json:"action" form:"action"`
+	Target string `json:"target" form:"target"` // 目标中包含该字符串即匹配
+	Limit  int    `json:"limit" form:"limit"`
+}
+
+func (p *AuditQueryParams) match(record *AuditRecord) bool {
+	if p.From > 0 && record.Time < p.From*1000 {
+		return false
+	}
+	if p.To > 0 && record.Time >= (p.To+1)*1000 {
+		return false
+	}
+	if p.Actor != "" && record.Actor != p.Actor {
+		return false
+	}
+	if p.Action != "" && record.Action != p.Action {
+		return false
+	}
+	if p.Target != "" && !strings.Contains(record.Target, p.Target) {
+		return false
+	}
+	return true
+}
+
+// 从Redis Stream按时间倒序查询
+func queryAuditStream(params *AuditQueryParams) ([]AuditRecord, error) {
+	ctx := context.Background()
+	stream := redisKey(KEY_AUDIT_STREAM, "")
+	end := "+"
+	if params.To > 0 {
+		end = strconv.FormatInt((params.To+1)*1000-1, 10)
+	}
+	start := "-"
+	if params.From > 0 {
+		start = strconv.FormatInt(params.From*1000, 10)
+	}
+	records := make([]AuditRecord, 0, params.Limit)
+	for len(records) < params.Limit {
+		messages, err := globalRedis.Client().XRevRangeN(ctx, stream, end, start, 500).Result()
+		if err != nil {
+			return nil, ErrRedisUnavailable.with("Failed to query audit stream: %s", err.Error())
+		}
+		for _, message := range messages {
+			var record AuditRecord
+			value, _ := message.Values["record"].(string)
+			if json.Unmarshal([]byte(value), &record) != nil || !params.match(&record) {
+				continue
+			}
+			records = append(records, record)
+			if len(records) >= params.Limit {
+				break
+			}
+		}
+		if len(messages) < 500 {
+			break
+		}
+		// 下一页从最后一条之前开始
+		end = "(" + messages[len(messages)-1].ID
+	}
+	return records, nil
+}
+
+// 从本地文件末尾向前读取，按时间倒序返回最新的匹配记录，找到 limit 条后停止
+func queryAuditFile(params *AuditQueryParams) ([]AuditRecord, error) {
+	file, err := os.Open(currentConfig().Audit.Path)
+	if os.IsNotExist(err) {
+		return []AuditRecord{}, nil
+	} else if err != nil {
+		return nil, ErrInternal.with("Failed to open audit log: %s", err.Error())
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, ErrInternal.with("Failed to open audit log: %s", err.Error())
+	}
+	records := make([]AuditRecord, 0, params.Limit)
+	err = funcs.ReadLinesReverse(file, info.Size(), AUDIT_MAX_LINE_SIZE, func(line []byte) bool {
+		var record AuditRecord
+		if json.Unmarshal(line, &record) != nil || !params.match(&record) {
+			return true
+		}
+		records = append(records, record)
+		return len(records) < params.Limit
+	})
+	if err != nil {
+		return nil, ErrInternal.with("Failed to read audit log: %s", err.Error())
+	}
+	return records, nil
+}
+
+// HandleAudit 查询审计记录，按时间倒序
+func HandleAudit(c *gin.Context) {
+	startRequest(c)
+	var params AuditQueryParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.Limit <= 0 {
+		params.Limit = AUDIT_QUERY_DEFAULT_LIMIT
+	}
+	if params.Limit > AUDIT_QUERY_MAX_LIMIT {
+		params.Limit = AUDIT_QUERY_MAX_LIMIT
+	}
+	var records []AuditRecord
+	var err error
+	if currentConfig().Audit.RedisStream {
+		// Redis Stream 包含集群内全部实例的记录
+		records, err = queryAuditStream(&params)
+	} else {
+		records, err = queryAuditFile(&params)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, records)
+}
@@ -0,0 +1,103 @@
+package sse
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 从请求头中取API密钥：X-SSE-Api-Key 或 Authorization: Bearer
+func getApiKey(c *gin.Context) string {
+	if key := c.GetHeader("X-SSE-Api-Key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// 按密钥查找调用方
+func findApiKey(key string) *ApiKey {
+	if key == "" {
+		return nil
+	}
+	for i := range currentConfig().API.Keys {
+		apiKey := &currentConfig().API.Keys[i]
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			return apiKey
+		}
+	}
+	return nil
+}
+
+// 是否为已配置的API密钥名称
+func apiKeyNameExists(name string) bool {
+	for _, apiKey := range currentConfig().API.Keys {
+		if apiKey.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ApiAuth 中间件：配置了API密钥时校验调用方，并将调用方名称记入上下文；未配置时调用方为anonymous
+func ApiAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(currentConfig().API.Keys) == 0 {
+			c.Set("_actor", ACTOR_ANONYMOUS)
+			c.Next()
+			return
+		}
+		apiKey := findApiKey(getApiKey(c))
+		if apiKey == nil {
+			c.Set("_actor", ACTOR_ANONYMOUS)
+			respondError(c, ErrInvalidApiKey)
+			return
+		}
+		c.Set("_actor", apiKey.Name)
+		c.Next()
+	}
+}
+
+// AdminAuth 中间件：/admin 下的管理接口只接受 role 为 admin 的API密钥；未配置管理密钥时全部拒绝，不允许匿名访问
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("_actor", ACTOR_ANONYMOUS)
+		if !hasAdminKey() {
+			respondError(c, ErrAdminDisabled)
+			return
+		}
+		apiKey := findApiKey(getApiKey(c))
+		if apiKey == nil {
+			respondError(c, ErrInvalidApiKey)
+			return
+		}
+		c.Set("_actor", apiKey.Name)
+		if apiKey.Role != ROLE_ADMIN {
+			respondError(c, ErrAdminRequired.with("API key %s is not an admin key", apiKey.Name))
+			return
+		}
+		c.Next()
+	}
+}
+
+// 是否配置了管理密钥
+func hasAdminKey() bool {
+	for _, apiKey := range currentConfig().API.Keys {
+		if apiKey.Role == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前请求的调用方
+func getActor(c *gin.Context) string {
+	if actor := c.GetString("_actor"); actor != "" {
+		return actor
+	}
+	return ACTOR_ANONYMOUS
+}
@@ -1,75 +1,94 @@
 package sse
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
+	"sse-broker/funcs"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+var apiLogger = funcs.Logger("api")
+
 func startRequest(c *gin.Context) {
 	c.Set("_start", time.Now().UnixMicro())
 }
 
 func endRequest(c *gin.Context) int64 {
-	start, _ := c.Get("_start")
+	start, ok := c.Get("_start")
+	if !ok {
+		return 0
+	}
 	return time.Now().UnixMicro() - start.(int64)
 }
 
+// 返回成功结果
+func respondSuccess(c *gin.Context, result interface{}) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":   1,
+		"msg":    "success",
+		"result": result,
+		"micro":  endRequest(c),
+	})
+}
+
+// 返回错误：HTTP状态码与code一致，error为机器可读的错误码；非BrokerError按内部错误处理
+func respondError(c *gin.Context, err error) {
+	var brokerErr *BrokerError
+	if !errors.As(err, &brokerErr) {
+		brokerErr = ErrInternal.with("%s", err.Error())
+	}
+	if brokerErr.Status >= http.StatusInternalServerError {
+		apiLogger.Warn("Request failed", "path", c.Request.URL.Path, "error", brokerErr.Code, "msg", brokerErr.Msg)
+	}
+	c.Set("_error", brokerErr.Code)
+	c.AbortWithStatusJSON(brokerErr.Status, gin.H{
+		"code":   brokerErr.Status,
+		"error":  brokerErr.Code,
+		"msg":    brokerErr.Msg,
+		"result": "",
+		"micro":  endRequest(c),
+	})
+}
+
+// 按请求方法和内容类型绑定参数，失败时返回BrokerError
 func fillParams[T any](c *gin.Context, params *T) error {
 	if c.Request.Method == "GET" {
-		if err := c.BindQuery(params); err != nil {
-			c.JSON(http.StatusOK, gin.H{
-				"code":   http.StatusBadRequest,
-				"msg":    fmt.Sprintf("Failed to bind query: %s", err.Error()),
-				"result": "",
-				"micro":  endRequest(c),
-			})
-			return err
+		if err := c.ShouldBindQuery(params); err != nil {
+			return ErrInvalidParams.with("Failed to bind query: %s", err.Error())
 		}
 	} else if c.Request.Method == "POST" {
-		contentType := c.GetHeader("Content-Type")
+		contentType := c.ContentType()
 		if contentType == "application/json" {
 			if err := c.ShouldBindJSON(params); err != nil {
-				c.JSON(http.StatusOK, gin.H{
-					"code":   http.StatusBadRequest,
-					"msg":    fmt.Sprintf("Failed to bind json: %s", err.Error()),
-					"result": "",
-					"micro":  endRequest(c),
-				})
-				return err
+				return bodyReadError(err, "Failed to bind json: %s")
 			}
 		} else if contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data" {
 			if err := c.ShouldBind(params); err != nil {
-				c.JSON(http.StatusOK, gin.H{
-					"code":   http.StatusBadRequest,
-					"msg":    fmt.Sprintf("Failed to bind form: %s", err.Error()),
-					"result": "",
-					"micro":  endRequest(c),
-				})
-				return err
+				return bodyReadError(err, "Failed to bind form: %s")
 			}
 		} else {
-			// 返回 415 不支持的媒体类型
-			c.JSON(http.StatusOK, gin.H{
-				"code":   http.StatusUnsupportedMediaType,
-				"msg":    fmt.Sprintf("Unsupported media type: %s", contentType),
-				"result": "",
-				"micro":  endRequest(c),
-			})
-			return fmt.Errorf("unsupported media type")
+			return ErrUnsupportedMediaType.with("Unsupported media type: %s", contentType)
 		}
 	} else {
-		// 返回 405 不支持的请求方法
-		c.JSON(http.StatusMethodNotAllowed, gin.H{
-			"code":   http.StatusMethodNotAllowed,
-			"msg":    fmt.Sprintf("Method not allowed: %s", c.Request.Method),
-			"result": "",
-			"micro":  endRequest(c),
-		})
-		return fmt.Errorf("method not allowed")
+		return ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method)
 	}
 
 	return nil
 }
+
+// 读取请求体出错：超过大小上限时返回 payload_too_large
+func bodyReadError(err error, format string, args ...interface{}) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrPayloadTooLarge.with("request body is larger than the limit of %d bytes", maxBytesErr.Limit)
+	}
+	return ErrInvalidParams.with(format, append(args, err.Error())...)
+}
+
+// HandleErrors 输出全部错误码
+func HandleErrors(c *gin.Context) {
+	startRequest(c)
+	respondSuccess(c, errorCatalog)
+}
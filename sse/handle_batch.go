@@ -0,0 +1,253 @@
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sse-broker/funcs"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BatchSendResult struct {
+	Index int    `json:"index"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"` // 失败时的错误码
+	Msg   string `json:"msg"`
+	Count int    `json:"count"`
+}
+
+// 记录单条的失败原因
+func (r *BatchSendResult) fail(err error) {
+	var brokerErr *BrokerError
+	if !errors.As(err, &brokerErr) {
+		brokerErr = ErrInternal.with("%s", err.Error())
+	}
+	r.Code = brokerErr.Status
+	r.Error = brokerErr.Code
+	r.Msg = brokerErr.Msg
+}
+
+// 解析批量发送的请求体：JSON数组，或每行一个JSON对象的NDJSON；逐条解码，超过条数上限时立即停止
+func readBatchEntries(c *gin.Context) ([]SendFrameParams, error) {
+	var entries []SendFrameParams
+	tooMany := ErrInvalidParams.with("too many entries, at most %d per batch", BATCH_SEND_MAX_ENTRIES)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, BATCH_SEND_MAX_BODY_SIZE)
+	contentType := c.ContentType()
+	if contentType == "application/json" {
+		decoder := json.NewDecoder(c.Request.Body)
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, bodyReadError(err, "failed to decode json array: %s")
+		}
+		if token != json.Delim('[') {
+			return nil, ErrInvalidParams.with("request body must be a json array")
+		}
+		for decoder.More() {
+			if len(entries) >= BATCH_SEND_MAX_ENTRIES {
+				return nil, tooMany
+			}
+			var entry SendFrameParams
+			if err := decoder.Decode(&entry); err != nil {
+				return nil, bodyReadError(err, "failed to decode entry %d: %s", len(entries))
+			}
+			entries = append(entries, entry)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, bodyReadError(err, "failed to decode json array: %s")
+		}
+	} else if contentType == "application/x-ndjson" || contentType == "application/jsonl" {
+		scanner := bufio.NewScanner(c.Request.Body)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			if len(entries) >= BATCH_SEND_MAX_ENTRIES {
+				return nil, tooMany
+			}
+			var entry SendFrameParams
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return nil, ErrInvalidParams.with("failed to decode line %d: %s", line, err.Error())
+			}
+			entries = append(entries, entry)
+		}
+		if err := scanner.Err(); err != nil && err != io.EOF {
+			return nil, bodyReadError(err, "failed to read ndjson: %s")
+		}
+	} else {
+		return nil, ErrUnsupportedMediaType.with("Unsupported media type: %s", contentType)
+	}
+	return entries, nil
+}
+
+// HandleSendBatch 批量发送，每条可指定不同的接收者和内容
+func HandleSendBatch(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	entries, err := readBatchEntries(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	broadcasts := 0
+	for i := range entries {
+		if entries[i].UID == "" && entries[i].Device == "" {
+			broadcasts++
+		}
+	}
+	target := "batch"
+	if broadcasts > 0 {
+		target = "batch *"
+	}
+	setAuditTarget(c, target, map[string]string{
+		"entries":    strconv.Itoa(len(entries)),
+		"broadcasts": strconv.Itoa(broadcasts),
+	})
+
+	// 校验每一条，并汇总全部需要查询的用户
+	results := make([]BatchSendResult, len(entries))
+	templates := make([]Instruction, len(entries))
+	filters := make([]deviceFilter, len(entries))
+	uidSet := make(map[string]bool)
+	for i := range entries {
+		results[i] = BatchSendResult{Index: i, Code: 1, Msg: "success"}
+		template, err := entries[i].newInstruction()
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+		if err := checkEventType(getActor(c), &entries[i], &template); err != nil {
+			results[i].fail(err)
+			continue
+		}
+		filter, err := parseDeviceFilter(entries[i].Filter)
+		if err != nil {
+			results[i].fail(ErrInvalidFilter.with("%s", err.Error()))
+			continue
+		}
+		templates[i] = template
+		filters[i] = filter
+		for _, uid := range splitParam(entries[i].UID) {
+			uidSet[uid] = true
+		}
+	}
+	uids := make([]string, 0, len(uidSet))
+	for uid := range uidSet {
+		uids = append(uids, uid)
+	}
+	// 汇总查询失败时整批都无法投递，直接返回错误
+	userDevices, err := collectUserDeviceIds(uids)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	// 展开每条的目标设备：广播按筛选表达式去重，同一表达式只查询和筛选一次
+	targets := make([][]string, len(entries))
+	broadcastTargets := make(map[string][]string)
+	attrs := make(map[string]*deviceAttrs)
+	var filteredIds []string
+	for i, entry := range entries {
+		if results[i].Code != 1 {
+			continue
+		}
+		if entry.UID == "" && entry.Device == "" {
+			deviceIds, ok := broadcastTargets[entry.Filter]
+			if !ok {
+				if filters[i] == nil {
+					deviceIds, err = getAllDeviceIds()
+				} else if deviceIds, err = getFilterCandidateIds(filters[i]); err == nil {
+					if err = loadDeviceAttrs(deviceIds, attrs); err == nil {
+						deviceIds = matchDeviceIds(deviceIds, filters[i], attrs)
+					}
+				}
+				if err != nil {
+					respondError(c, err)
+					return
+				}
+				broadcastTargets[entry.Filter] = deviceIds
+			}
+			targets[i] = deviceIds
+			continue
+		}
+		targetDeviceSet := make(map[string]bool)
+		for _, deviceName := range splitParam(entry.Device) {
+			targetDeviceSet[funcs.MD5(deviceName)] = true
+		}
+		for _, uid := range splitParam(entry.UID) {
+			for _, deviceId := range userDevices[uid] {
+				targetDeviceSet[deviceId] = true
+			}
+		}
+		for deviceId := range targetDeviceSet {
+			targets[i] = append(targets[i], deviceId)
+		}
+		if filters[i] != nil {
+			filteredIds = append(filteredIds, targets[i]...)
+		}
+	}
+	// 带筛选的定向条目，一次读取全部目标设备的属性后逐条筛选
+	if err := loadDeviceAttrs(filteredIds, attrs); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// 展开为逐设备的指令，整批一次分配消息帧ID，一次性按实例分组分发
+	entryInstructions := make([][]Instruction, len(entries))
+	for i, entry := range entries {
+		if results[i].Code != 1 {
+			continue
+		}
+		deviceIds := targets[i]
+		if filters[i] != nil && (entry.UID != "" || entry.Device != "") {
+			deviceIds = matchDeviceIds(deviceIds, filters[i], attrs)
+		}
+		entryInstructions[i] = make([]Instruction, 0, len(deviceIds))
+		for _, deviceId := range deviceIds {
+			instruction := templates[i]
+			instruction.DeviceID = deviceId
+			entryInstructions[i] = append(entryInstructions[i], instruction)
+		}
+	}
+	// 分配失败时整批都无法投递，直接返回错误
+	if err := assignUserFrameIds(entryInstructions...); err != nil {
+		respondError(c, err)
+		return
+	}
+	var instructions []Instruction
+	total := 0
+	for i := range entries {
+		if results[i].Code != 1 {
+			continue
+		}
+		instructions = append(instructions, entryInstructions[i]...)
+		results[i].Count = len(entryInstructions[i])
+		total += len(entryInstructions[i])
+	}
+	deliverInstructions(instructions)
+
+	failed := 0
+	for _, result := range results {
+		if result.Code != 1 {
+			failed++
+		}
+	}
+	setAuditCount(c, total)
+	respondSuccess(c, gin.H{
+		"entries":   len(entries),
+		"succeeded": len(entries) - failed,
+		"failed":    failed,
+		"devices":   total,
+		"results":   results,
+	})
+}
@@ -0,0 +1,105 @@
+package sse
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IsTrustedProxy 地址是否属于受信任的代理
+func IsTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range currentConfig().Proxy.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 去掉端口号和IPv6的方括号，解析失败时返回无效地址
+func parseHostIP(host string) netip.Addr {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// 解析标准 Forwarded 头(RFC 7239)中的 for 参数，按出现顺序返回
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(strings.TrimSpace(val), `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// 解析逗号分隔的 X-Forwarded-For 头，按出现顺序返回
+func parseForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// 解析客户端地址：返回客户端IP，以及从客户端到本实例的完整地址链(最后一个为直连地址)
+// 只有直连地址是受信任代理时才采信转发头，优先 Forwarded，其次 X-Forwarded-For、X-Real-IP；
+// 从右向左跳过受信任的代理，第一个不受信任的地址即为客户端IP
+func resolveClientAddress(c *gin.Context) (string, []string) {
+	remote := c.Request.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	var hops []string
+	if values := c.Request.Header.Values("Forwarded"); len(values) > 0 {
+		hops = parseForwarded(values)
+	} else if values := c.Request.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops = parseForwardedFor(values)
+	} else if realIP := strings.TrimSpace(c.GetHeader("X-Real-IP")); realIP != "" {
+		hops = []string{realIP}
+	}
+	chain := append(hops, remote)
+
+	remoteIP := parseHostIP(remote)
+	if !remoteIP.IsValid() || !IsTrustedProxy(remoteIP) {
+		return remote, chain
+	}
+	clientIP := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostIP(hops[i])
+		// 无法解析的地址(如 unknown 或混淆标识)不可信，止于上一个受信任的代理
+		if !hop.IsValid() {
+			break
+		}
+		clientIP = hop
+		if !IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return clientIP.String(), chain
+}
+
+// 客户端IP
+func getRealIP(c *gin.Context) string {
+	ip, _ := resolveClientAddress(c)
+	return ip
+}
@@ -0,0 +1,67 @@
+package sse
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolveClientAddress(t *testing.T) {
+	previous := globalConfig.Load()
+	defer globalConfig.Store(previous)
+	config := &Config{}
+	config.Proxy.TrustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	globalConfig.Store(config)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"no headers", "203.0.113.9:5000", nil, "203.0.113.9"},
+		// 直连地址不受信任时忽略转发头
+		{"untrusted peer", "203.0.113.9:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"untrusted peer forwarded", "203.0.113.9:5000", map[string]string{"Forwarded": "for=198.51.100.1"}, "203.0.113.9"},
+		{"untrusted peer real ip", "203.0.113.9:5000", map[string]string{"X-Real-IP": "198.51.100.1"}, "203.0.113.9"},
+		{"one trusted hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		// 客户端伪造的最左侧地址不被采信
+		{"spoofed left-most", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"spoofed trusted left-most", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.9.9.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"several trusted hops", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.3, 10.0.0.2"}, "198.51.100.1"},
+		// 全部是受信任的代理时取最左侧的地址
+		{"all hops trusted", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		// 无法解析的地址止于上一个受信任的代理
+		{"malformed hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"malformed right-most", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, not-an-ip"}, "10.0.0.1"},
+		{"empty entries", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": " , 198.51.100.1,, "}, "198.51.100.1"},
+		{"ipv4 with port", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1:4711"}, "198.51.100.1"},
+		{"ipv6 with port", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "[2001:db8::1]:4711, 10.0.0.2"}, "2001:db8::1"},
+		{"ipv6 without port", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "2001:db8::1"}, "2001:db8::1"},
+		{"ipv6 trusted peer", "[fd00::1]:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, fd00::2"}, "198.51.100.1"},
+		{"ipv4-mapped peer", "[::ffff:10.0.0.1]:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		// Forwarded 优先于 X-Forwarded-For
+		{"forwarded", "10.0.0.1:5000", map[string]string{
+			"Forwarded":       `for=1.2.3.4, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+			"X-Forwarded-For": "198.51.100.1",
+		}, "2001:db8::1"},
+		{"forwarded obfuscated", "10.0.0.1:5000", map[string]string{"Forwarded": "for=198.51.100.1, for=_hidden"}, "10.0.0.1"},
+		{"real ip", "10.0.0.1:5000", map[string]string{"X-Real-IP": " 198.51.100.1 "}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/events", nil)
+		c.Request.RemoteAddr = tt.remote
+		for name, value := range tt.headers {
+			c.Request.Header.Set(name, value)
+		}
+		if got, _ := resolveClientAddress(c); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package sse
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 来源是否匹配：* 匹配全部；https://*.example.com 匹配 example.com 的任意子域名，不含 example.com 本身
+func matchOrigin(pattern string, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	prefix := strings.ToLower(scheme + "://")
+	origin = strings.ToLower(origin)
+	if !strings.HasPrefix(origin, prefix) {
+		return false
+	}
+	sub := strings.TrimPrefix(origin, prefix)
+	return strings.HasSuffix(sub, "."+strings.ToLower(host)) && len(sub) > len(host)+1
+}
+
+// 来源是否在允许列表中
+func originAllowed(origin string) bool {
+	for _, pattern := range currentConfig().CORS.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cors 中间件：允许的来源返回CORS响应头，并直接响应预检请求；不带Origin的请求(同源或非浏览器)不处理
+func Cors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		cors := currentConfig().CORS
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		c.Writer.Header().Add("Vary", "Origin")
+		if !originAllowed(origin) {
+			if preflight {
+				respondError(c, ErrOriginNotAllowed.with("Origin not allowed: %s", origin))
+				return
+			}
+			c.Next()
+			return
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		if cors.AllowCredentials {
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			c.Writer.Header().Set("Access-Control-Allow-Methods", CORS_ALLOW_METHODS)
+			c.Writer.Header().Set("Access-Control-Allow-Headers", CORS_ALLOW_HEADERS)
+			if cors.MaxAge > 0 {
+				c.Writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// 校验 /events 的来源：token中绑定了来源时须带上一致的Origin；开启限制时须在允许列表中
+// 浏览器的跨域请求总会带Origin，不带Origin的请求为同源页面或非浏览器客户端，只有未绑定来源的token可以这样连接
+func checkEventsOrigin(c *gin.Context, claims *Claims) *BrokerError {
+	origin := c.GetHeader("Origin")
+	if claims.Origin != "" {
+		if origin == "" {
+			return ErrOriginNotAllowed.with("Token is bound to origin %s, but the request has no Origin header", claims.Origin)
+		}
+		if !strings.EqualFold(claims.Origin, origin) {
+			return ErrOriginNotAllowed.with("Token is bound to another origin: %s", origin)
+		}
+	}
+	if origin == "" {
+		return nil
+	}
+	if currentConfig().CORS.RestrictEvents && !originAllowed(origin) {
+		return ErrOriginNotAllowed.with("Origin not allowed: %s", origin)
+	}
+	return nil
+}
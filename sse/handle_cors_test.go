@@ -0,0 +1,45 @@
+package sse
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckEventsOrigin(t *testing.T) {
+	previous := globalConfig.Load()
+	defer globalConfig.Store(previous)
+	tests := []struct {
+		name     string
+		restrict bool
+		bound    string
+		origin   string
+		allowed  bool
+	}{
+		{"unbound without origin", false, "", "", true},
+		{"unbound any origin", false, "", "https://evil.example.org", true},
+		{"bound matching origin", false, "https://app.example.com", "https://APP.example.com", true},
+		{"bound other origin", false, "https://app.example.com", "https://evil.example.org", false},
+		// 绑定了来源的token不能去掉Origin头绕过检查
+		{"bound without origin", false, "https://app.example.com", "", false},
+		{"restricted listed origin", true, "", "https://app.example.com", true},
+		{"restricted unlisted origin", true, "", "https://evil.example.org", false},
+		{"restricted without origin", true, "", "", true},
+	}
+	for _, tt := range tests {
+		config := &Config{}
+		config.CORS.AllowedOrigins = []string{"https://app.example.com"}
+		config.CORS.RestrictEvents = tt.restrict
+		globalConfig.Store(config)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/events", nil)
+		if tt.origin != "" {
+			c.Request.Header.Set("Origin", tt.origin)
+		}
+		err := checkEventsOrigin(c, &Claims{Origin: tt.bound})
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v (%v)", tt.name, allowed, tt.allowed, err)
+		}
+	}
+}
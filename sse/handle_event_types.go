@@ -0,0 +1,163 @@
+package sse
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EventTypeParams struct {
+	Name       string  `json:"name" form:"name"`
+	Schema     Payload `json:"schema" form:"schema"`         // JSON Schema，JSON请求体中可直接写对象
+	Publishers string  `json:"publishers" form:"publishers"` // 可发布的API密钥名称，多个用逗号分隔，为空时不限
+	Mode       string  `json:"mode" form:"mode"`             // reject 或 quarantine，为空时使用 events.mode
+}
+
+type QuarantineParams struct {
+	Event string `json:"event" form:"event"`
+	Limit int    `json:"limit" form:"limit"`
+}
+
+// HandleEventTypes 列出全部事件类型
+func HandleEventTypes(c *gin.Context) {
+	startRequest(c)
+	if err := eventTypes.refresh(true); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, eventTypes.list())
+}
+
+// HandleEventTypeRegister 登记或更新事件类型，保存在Redis中对整个集群生效；配置文件中的类型不能通过接口修改
+func HandleEventTypeRegister(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params EventTypeParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, "event:"+params.Name, map[string]string{
+		"publishers": params.Publishers,
+		"mode":       params.Mode,
+	})
+	if params.Name == "" {
+		respondError(c, ErrInvalidParams.with("name cannot be empty"))
+		return
+	}
+	if eventTypes.isConfigType(params.Name) {
+		respondError(c, ErrInvalidParams.with("event %q is defined in the config file", params.Name))
+		return
+	}
+	if params.Mode != "" && params.Mode != EVENT_MODE_REJECT && params.Mode != EVENT_MODE_QUARANTINE {
+		respondError(c, ErrInvalidParams.with("invalid mode: %s", params.Mode))
+		return
+	}
+	eventType := EventType{
+		Name:       params.Name,
+		Schema:     json.RawMessage(params.Schema.Text),
+		Publishers: splitParam(params.Publishers),
+		Mode:       params.Mode,
+		UpdatedBy:  getActor(c),
+		UpdatedAt:  time.Now().Format("2006-01-02 15:04:05"),
+	}
+	for _, publisher := range eventType.Publishers {
+		if !apiKeyNameExists(publisher) {
+			respondError(c, ErrInvalidParams.with("unknown api key name in publishers: %s", publisher))
+			return
+		}
+	}
+	if err := eventType.compile(); err != nil {
+		respondError(c, ErrInvalidParams.with("invalid schema: %s", err.Error()))
+		return
+	}
+	if err := checkPublisherChange(eventType.UpdatedBy, eventType.Name, &eventType); err != nil {
+		respondError(c, err)
+		return
+	}
+	value, _ := json.Marshal(eventType)
+	if err := globalRedis.HSet(redisKey(KEY_EVENT_TYPES, ""), eventType.Name, string(value)); err != nil {
+		respondError(c, ErrRedisUnavailable.with("Failed to save event type: %s", err.Error()))
+		return
+	}
+	eventTypes.refresh(true)
+	setAuditCount(c, 1)
+	eventType.Source = EVENT_SOURCE_API
+	respondSuccess(c, eventType)
+}
+
+// 登记或删除事件类型时，调用方不能借此取得原本没有的发布权限；next 为nil表示删除
+func checkPublisherChange(actor string, name string, next *EventType) error {
+	if err := eventTypes.refresh(true); err != nil {
+		return err
+	}
+	current := eventTypes.lookup(name)
+	if current == nil || current.allowPublisher(actor) {
+		return nil
+	}
+	if next == nil || next.allowPublisher(actor) {
+		return ErrEventNotAllowed.with("api key %s is not a publisher of event %q and cannot grant itself publisher rights", actor, name)
+	}
+	return nil
+}
+
+// HandleEventTypeDelete 删除通过接口登记的事件类型
+func HandleEventTypeDelete(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params EventTypeParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, "event:"+params.Name, nil)
+	if params.Name == "" {
+		respondError(c, ErrInvalidParams.with("name cannot be empty"))
+		return
+	}
+	if eventTypes.isConfigType(params.Name) {
+		respondError(c, ErrInvalidParams.with("event %q is defined in the config file", params.Name))
+		return
+	}
+	if err := checkPublisherChange(getActor(c), params.Name, nil); err != nil {
+		respondError(c, err)
+		return
+	}
+	removed, err := globalRedis.Client().HDel(c.Request.Context(), redisKey(KEY_EVENT_TYPES, ""), params.Name).Result()
+	if err != nil {
+		respondError(c, ErrRedisUnavailable.with("Failed to delete event type: %s", err.Error()))
+		return
+	}
+	eventTypes.refresh(true)
+	setAuditCount(c, int(removed))
+	respondSuccess(c, removed)
+}
+
+// HandleQuarantine 查看隔离区中校验失败的消息，最新的在前
+func HandleQuarantine(c *gin.Context) {
+	startRequest(c)
+	var params QuarantineParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.Limit <= 0 {
+		params.Limit = QUARANTINE_DEFAULT_LIMIT
+	}
+	if params.Limit > QUARANTINE_MAX_LIMIT {
+		params.Limit = QUARANTINE_MAX_LIMIT
+	}
+	records, err := queryQuarantine(params.Event, params.Limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, records)
+}
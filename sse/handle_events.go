@@ -1,57 +1,57 @@
 package sse
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
-	"net"
+	"io"
 	"net/http"
+	"sse-broker/funcs"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func getRealIP(c *gin.Context) string {
-	// 首先尝试从 X-Forwarded-For 获取 IP
-	xff := c.Request.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		// X-Forwarded-For 可能包含多个逗号分隔的 IP，取第一个
-		ips := strings.Split(xff, ",")
-		// 去除可能存在的空格并返回第一个非空 IP
-		for _, ip := range ips {
-			trimmedIP := strings.TrimSpace(ip)
-			if trimmedIP != "" {
-				return trimmedIP
-			}
-		}
-	}
+var eventsLogger = funcs.Logger("events")
 
-	// 如果 X-Forwarded-For 为空，尝试从 X-Real-IP 获取 IP
-	xRealIP := c.Request.Header.Get("X-Real-IP")
-	if xRealIP != "" {
-		return xRealIP
-	}
+// SSE中 \r\n、\r、\n 都是换行
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
 
-	// 如果都没有，则返回 RemoteAddr，去掉端口号
-	remoteIP, _, err := net.SplitHostPort(c.Request.RemoteAddr)
-	if err != nil {
-		// 如果解析失败，返回原始 RemoteAddr
-		return c.Request.RemoteAddr
+// 按SSE格式写出一个消息帧；类型提示作为扩展字段写出，EventSource 会忽略，自行解析的客户端可读取
+// 多行内容逐行写作 data 字段，客户端收到的内容以 \n 连接
+func writeFrame(w io.Writer, frame *Frame) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\n", frame.ID)
+	if frame.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", frame.Event)
+	}
+	if frame.ContentType != "" {
+		fmt.Fprintf(&b, "content-type: %s\n", frame.ContentType)
+	}
+	if frame.Encoding != "" {
+		fmt.Fprintf(&b, "encoding: %s\n", frame.Encoding)
 	}
-	return remoteIP
+	for _, line := range strings.Split(lineBreaks.Replace(frame.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
 func HandleEvents(c *gin.Context) {
-	// 设置SSE响应头
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
+	// 获取Flusher
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		respondError(c, ErrStreamingUnsupported)
+		return
+	}
 
 	uid := c.GetString("_uid")
 	deviceId := c.GetString("_device_id")
 	deviceName := c.GetString("_device_name")
 	lastEventId := c.GetInt64("_last_event_id")
-	address := getRealIP(c)
+	address, addressChain := resolveClientAddress(c)
 
 	// 将本设备登录的其他连接挤下线
 	existDevice := globalInstance.getDevice(deviceId)
@@ -61,9 +61,11 @@ func HandleEvents(c *gin.Context) {
 	if existDevice != nil {
 		// 同一设备上新老用户ID不一致时，删除老用户的帧缓存
 		if existDevice.UID != uid {
-			existDevice.delFrameCache()
+			if _, err := existDevice.delFrameCache(); err != nil {
+				eventsLogger.Warn("Failed to delete frame cache of the previous user", "uid", existDevice.UID, "device_id", deviceId, "error", err)
+			}
 		}
-		log.Printf("current instance is %s, device is %v\n", globalInstance.Address, existDevice)
+		eventsLogger.Info("Device already online, extrude the old connection", "uid", uid, "device_id", deviceId, "instance", existDevice.InstanceAddress)
 		if existDevice.isRemote() {
 			DispatchInstruction(existDevice.InstanceAddress, Instruction{
 				DeviceID: deviceId,
@@ -81,98 +83,160 @@ func HandleEvents(c *gin.Context) {
 		}
 	}
 
-	device := NewDevice(deviceId, deviceName, uid, globalInstance.Address, address)
-	device.online()
+	device := NewDevice(deviceId, deviceName, uid, globalInstance.Address, address, addressChain, c.GetStringMapString("_attrs"), c.GetStringSlice("_tags"))
+	if device == nil {
+		respondError(c, ErrRedisUnavailable.with("Failed to create device"))
+		return
+	}
+	// 先登记指令队列再上线，避免上线后到达的指令丢失
+	queue := newDeviceQueue(currentConfig().SSE.DeviceQueueSize, currentConfig().SSE.DeviceQueueOverflow)
+	device.queue = queue
+	deviceChannels.Store(deviceId, queue)
+	deviceChannelWG.Add(1)
+	defer deviceChannelWG.Done()
+
+	if err := device.online(); err != nil {
+		deviceChannels.CompareAndDelete(deviceId, queue)
+		queue.close()
+		respondError(c, err)
+		return
+	}
 	user := NewUser(uid)
 	user.handleDeviceOnline(device)
 
-	// 获取Flusher
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming unsupported!"})
-		return
+	// 按 Accept-Encoding 协商压缩，结束时写出压缩流的结尾
+	stream := newEventStream(c.Writer, c.Request, flusher)
+	defer stream.Close()
+
+	// 设备下线，并向客户端发送下线原因
+	closeDevice := func(reason string, event string, data string) {
+		if device.offline(reason, data) {
+			user.handleDeviceOffline(device)
+		}
+		if event != "" {
+			fmt.Fprintf(stream, "event: %s\ndata: %s\n\n", event, data)
+			stream.Flush()
+		}
 	}
 
+	// 设置SSE响应头
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	// HTTP/2 禁止连接级别的响应头
+	if c.Request.ProtoMajor == 1 {
+		c.Writer.Header().Set("Connection", "keep-alive")
+	}
+	// 长连接不受服务端写超时限制
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
 	// 发送连接成功事件
-	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", EVT_SYS_CONNECTED, address)
-	flusher.Flush()
+	fmt.Fprintf(stream, "event: %s\ndata: %s\n\n", EVT_SYS_CONNECTED, address)
+	stream.Flush()
+
+	// 请求续传的消息帧已不在缓存中时，先通知客户端缺失的范围，以便通过接口重新同步
+	if gap, ok := device.getFrameGap(lastEventId); ok {
+		data, _ := json.Marshal(gap)
+		fmt.Fprintf(stream, "event: %s\ndata: %s\n\n", EVT_SYS_GAP, data)
+		stream.Flush()
+		metrics.frameGaps.Add(1)
+		metrics.framesLost.Add(gap.Lost)
+		eventsLogger.Info("Cached frames missing", "uid", uid, "device_id", deviceId, "last_event_id", lastEventId, "lost", gap.Lost)
+	}
 
 	// 发送缓存的消息帧
 	if lastEventId > 0 {
 		frames := device.getCachedFrames(lastEventId)
 		for _, frame := range frames {
-			if frame.Event == "" {
-				fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", frame.ID, frame.Data)
-			} else {
-				fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", frame.ID, frame.Event, frame.Data)
-			}
+			writeFrame(stream, &frame)
 		}
 		if len(frames) > 0 {
-			log.Printf("Send %d cached frames to device %s\n", len(frames), deviceId)
-			flusher.Flush()
+			eventsLogger.Debug("Send cached frames", "uid", uid, "device_id", deviceId, "count", len(frames))
+			stream.Flush()
 		}
 	}
 
 	// 创建一个 ticker，每一个心跳周期触发一次
-	ticker := time.NewTicker(globalConfig.SSE.HeartbeatDuration)
+	ticker := time.NewTicker(currentConfig().SSE.HeartbeatDuration)
 	defer ticker.Stop()
-
-	channel := make(chan *Instruction)
-
-	deviceChannels.Store(deviceId, channel)
-	deviceChannelWG.Add(1)
+	heartbeat := heartbeatChanged()
 
 	for {
 		select {
-		case instraction := <-channel:
-			// log.Printf("Receive instruction: %v\n", instraction)
-			if instraction.Command == CMD_SEND_FRAME {
-				frame := device.addFrame(instraction.Event, instraction.Data)
-				if frame.Event == "" {
-					fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", frame.ID, frame.Data)
-				} else {
-					fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", frame.ID, frame.Event, frame.Data)
+		case <-queue.notify:
+			written := false
+			for instruction := queue.pop(); instruction != nil; instruction = queue.pop() {
+				switch instruction.Command {
+				case CMD_SEND_FRAME:
+					// 排队期间已过期的消息直接丢弃，不再迟到投递
+					if instruction.expired() {
+						continue
+					}
+					frame := device.addFrame(instruction)
+					writeFrame(stream, &frame)
+					stream.endMessage(len(frame.Data))
+					written = true
+				case CMD_KICK_OFFLINE:
+					closeDevice(DCR_KICK_OFFLINE, EVT_SYS_KICK_OFFLINE, instruction.Data)
+					return
+				case CMD_EXTRUDE_OFFLINE:
+					closeDevice(DCR_EXTRUDE_OFFLINE, EVT_SYS_EXTRUDE_OFFLINE, instruction.Data)
+					return
+				case CMD_INSTANCE_CLOSE:
+					closeDevice(DCR_INSTANCE_CLOSE, EVT_SYS_INSTANCE_CLOSE, instruction.Data)
+					return
+				case CMD_RESYNC:
+					// 实例曾与Redis断开，通知客户端按最后的消息帧ID重新同步
+					fmt.Fprintf(stream, "event: %s\ndata: %d\n\n", EVT_SYS_RESYNC, device.LastFrameId)
+					written = true
+				case CMD_REPLAY:
+					// 按原ID重发帧缓存中的消息帧，已过期的跳过
+					var fromId, toId int64
+					fmt.Sscanf(instruction.Data, "%d-%d", &fromId, &toId)
+					frames, err := device.getFrameRange(fromId, toId)
+					if err != nil {
+						eventsLogger.Warn("Failed to replay frames", "device_id", deviceId, "error", err)
+						continue
+					}
+					for _, frame := range frames {
+						if frame.expired() {
+							continue
+						}
+						writeFrame(stream, &frame)
+						written = true
+					}
+					eventsLogger.Debug("Replay frames", "uid", uid, "device_id", deviceId, "count", len(frames))
+				case CMD_SLOW_CONSUMER:
+					eventsLogger.Warn("Device is too slow, queue overflowed", "uid", uid, "device_id", deviceId)
+					closeDevice(DCR_SLOW_CONSUMER, EVT_SYS_SLOW_CONSUMER, globalInstance.Address)
+					return
+				default:
+					eventsLogger.Warn("Unknown instruction", "device_id", deviceId, "command", instruction.Command)
 				}
-				flusher.Flush()
-			} else if instraction.Command == CMD_KICK_OFFLINE {
-				device.offline(DCR_KICK_OFFLINE, instraction.Data)
-				user.handleDeviceOffline(device)
-				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", EVT_SYS_KICK_OFFLINE, instraction.Data)
-				deviceChannelWG.Done()
-				return
-			} else if instraction.Command == CMD_EXTRUDE_OFFLINE {
-				device.offline(DCR_EXTRUDE_OFFLINE, instraction.Data)
-				user.handleDeviceOffline(device)
-				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", EVT_SYS_EXTRUDE_OFFLINE, instraction.Data)
-				deviceChannelWG.Done()
-				return
-			} else if instraction.Command == CMD_INSTANCE_CLOSE {
-				device.offline(DCR_INSTANCE_CLOSE, instraction.Data)
-				user.handleDeviceOffline(device)
-				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", EVT_SYS_INSTANCE_CLOSE, instraction.Data)
-				deviceChannelWG.Done()
-				return
-			} else {
-				log.Printf("Unknown instruction: %v\n", instraction)
+			}
+			if written {
+				stream.Flush()
 			}
 		case <-ticker.C:
 			// 发送心跳
-			// log.Printf("Send heartbeat to device %s\n", deviceId)
-			_, err := fmt.Fprintf(c.Writer, "%s\n\n", PAYLOAD_HEARTBEAT)
-			flusher.Flush()
+			_, err := fmt.Fprintf(stream, "%s\n\n", PAYLOAD_HEARTBEAT)
+			if flushErr := stream.Flush(); err == nil {
+				err = flushErr
+			}
 			if err != nil {
-				device.offline(DCR_HEARTBEAT_FAIL, "")
-				user.handleDeviceOffline(device)
-				deviceChannelWG.Done()
+				closeDevice(DCR_HEARTBEAT_FAIL, "", "")
 				return
 			}
 			device.touch()
-			user.touch()
+			user.touch(deviceId)
+		case <-heartbeat:
+			// 热加载改变了心跳周期：立即按新周期续期设备和用户记录，之后按新周期发送心跳
+			heartbeat = heartbeatChanged()
+			ticker.Reset(currentConfig().SSE.HeartbeatDuration)
+			device.touch()
+			user.touch(deviceId)
 		case <-c.Writer.CloseNotify():
-			log.Printf("Client %s on Device %s is offline\n", address, deviceName)
-			device.offline(DCR_DEVICE_DISCONNECT, "")
-			user.handleDeviceOffline(device)
-			deviceChannelWG.Done()
+			eventsLogger.Info("Client disconnected", "uid", uid, "device_id", deviceId, "device", deviceName, "address", address)
+			closeDevice(DCR_DEVICE_DISCONNECT, "", "")
 			return
 		}
 	}
@@ -0,0 +1,304 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sse-broker/funcs"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type FramesParams struct {
+	UID    string `json:"uid" form:"uid"`         // 多个用逗号分隔
+	Device string `json:"device" form:"device"`   // 多个用逗号分隔
+	FromID int64  `json:"from_id" form:"from_id"` // 帧ID范围，0为不限
+	ToID   int64  `json:"to_id" form:"to_id"`
+	IDs    string `json:"ids" form:"ids"` // 要删除的帧ID，多个用逗号分隔
+}
+
+// 一台设备的帧缓存
+type DeviceFrames struct {
+	DeviceID   string  `json:"device_id"`
+	DeviceName string  `json:"device_name"`
+	UID        string  `json:"uid"`
+	Online     bool    `json:"online"`
+	Frames     []Frame `json:"frames"`
+}
+
+// 帧缓存的导出文件
+type FramesExport struct {
+	UID        string         `json:"uid,omitempty"`
+	Device     string         `json:"device,omitempty"`
+	ExportedAt string         `json:"exported_at"`
+	Devices    []DeviceFrames `json:"devices"`
+}
+
+// 读取用户名下有帧缓存的设备，返回设备ID到用户ID的映射
+func collectFrameDeviceIds(uids []string) (map[string]string, error) {
+	owners := make(map[string]string)
+	if len(uids) == 0 {
+		return owners, nil
+	}
+	ctx := context.Background()
+	pipe := globalRedis.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(uids))
+	for i, uid := range uids {
+		cmds[i] = pipe.SMembers(ctx, redisKey(KEY_USER_FRAME_DEVICE_SET_PREFIX, uid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, ErrRedisUnavailable.with("Failed to get frame caches of users: %s", err.Error())
+	}
+	for i, cmd := range cmds {
+		for _, deviceId := range cmd.Val() {
+			owners[deviceId] = uids[i]
+		}
+	}
+	return owners, nil
+}
+
+// 按用户和设备确定要操作的设备；设备下线后帧缓存仍会保留，按用户名下的帧缓存索引或设备名称查找
+func frameTargets(params *FramesParams) ([]DeviceFrames, error) {
+	if params.UID == "" && params.Device == "" {
+		return nil, ErrInvalidParams.with("uid and device cannot be empty at the same time")
+	}
+	names := make(map[string]string)
+	for _, deviceName := range splitParam(params.Device) {
+		names[funcs.MD5(deviceName)] = deviceName
+	}
+	deviceIds, err := collectDeviceIds(params.UID, params.Device)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := collectFrameDeviceIds(splitParam(params.UID))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		seen[deviceId] = true
+	}
+	for deviceId := range owners {
+		if !seen[deviceId] {
+			deviceIds = append(deviceIds, deviceId)
+		}
+	}
+	sort.Strings(deviceIds)
+	devices, err := loadDevices(deviceIds)
+	if err != nil {
+		return nil, err
+	}
+	online := make(map[string]Device, len(devices))
+	for _, device := range devices {
+		online[device.DeviceID] = device
+	}
+	targets := make([]DeviceFrames, 0, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		target := DeviceFrames{DeviceID: deviceId, DeviceName: names[deviceId], UID: owners[deviceId], Frames: []Frame{}}
+		if device, ok := online[deviceId]; ok {
+			target.DeviceName = device.DeviceName
+			target.UID = device.UID
+			target.Online = true
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// 读取各设备在范围内的帧缓存
+func loadFrameTargets(params *FramesParams) ([]DeviceFrames, error) {
+	targets, err := frameTargets(params)
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		frames, err := (&Device{DeviceID: targets[i].DeviceID}).getFrameRange(params.FromID, params.ToID)
+		if err != nil {
+			return nil, ErrRedisUnavailable.with("Failed to read frame cache: %s", err.Error())
+		}
+		targets[i].Frames = frames
+	}
+	return targets, nil
+}
+
+// HandleFrames 列出设备(或用户全部设备)的帧缓存
+func HandleFrames(c *gin.Context) {
+	startRequest(c)
+	var params FramesParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	targets, err := loadFrameTargets(&params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, targets)
+}
+
+// HandleFramesReplay 将帧缓存中范围内的消息帧按原ID重新投递给在线设备
+func HandleFramesReplay(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params FramesParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, auditTarget(params.UID, params.Device, ""), map[string]string{
+		"from_id": strconv.FormatInt(params.FromID, 10),
+		"to_id":   strconv.FormatInt(params.ToID, 10),
+	})
+	targets, err := frameTargets(&params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	count := 0
+	for _, target := range targets {
+		if !target.Online {
+			continue
+		}
+		device := globalInstance.getDevice(target.DeviceID)
+		if device == nil {
+			device = getRedisDevice(target.DeviceID)
+		}
+		if device == nil {
+			continue
+		}
+		instruction := Instruction{
+			DeviceID: target.DeviceID,
+			Command:  CMD_REPLAY,
+			Data:     fmt.Sprintf("%d-%d", params.FromID, params.ToID),
+		}
+		if device.isRemote() {
+			DispatchInstruction(device.InstanceAddress, instruction)
+		} else {
+			globalInstance.handleInstruction(&instruction)
+		}
+		count++
+	}
+	setAuditCount(c, count)
+	respondSuccess(c, count)
+}
+
+// HandleFramesDelete 删除帧缓存中指定ID的消息帧
+func HandleFramesDelete(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params FramesParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, auditTarget(params.UID, params.Device, ""), map[string]string{
+		"ids": params.IDs,
+	})
+	var ids []int64
+	for _, value := range splitParam(params.IDs) {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			respondError(c, ErrInvalidParams.with("invalid frame id: %s", value))
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		respondError(c, ErrInvalidParams.with("ids cannot be empty"))
+		return
+	}
+	targets, err := frameTargets(&params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var removed int64
+	for _, target := range targets {
+		n, err := (&Device{DeviceID: target.DeviceID}).delFrames(ids)
+		if err != nil {
+			respondError(c, ErrRedisUnavailable.with("Failed to delete frames: %s", err.Error()))
+			return
+		}
+		removed += n
+	}
+	setAuditCount(c, int(removed))
+	respondSuccess(c, removed)
+}
+
+// HandleFramesPurge 清空设备的帧缓存
+func HandleFramesPurge(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	var params FramesParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, auditTarget(params.UID, params.Device, ""), nil)
+	targets, err := frameTargets(&params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	count := 0
+	for _, target := range targets {
+		deleted, err := (&Device{DeviceID: target.DeviceID, UID: target.UID}).delFrameCache()
+		if err != nil {
+			setAuditCount(c, count)
+			respondError(c, ErrRedisUnavailable.with("Failed to purge frame cache: %s", err.Error()))
+			return
+		}
+		if deleted {
+			count++
+		}
+	}
+	setAuditCount(c, count)
+	respondSuccess(c, count)
+}
+
+// HandleFramesExport 导出用户或设备的全部帧缓存，作为附件下载
+func HandleFramesExport(c *gin.Context) {
+	startRequest(c)
+	var params FramesParams
+	if err := fillParams(c, &params); err != nil {
+		respondError(c, err)
+		return
+	}
+	setAuditTarget(c, auditTarget(params.UID, params.Device, ""), nil)
+	params.FromID, params.ToID = 0, 0
+	targets, err := loadFrameTargets(&params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	count := 0
+	for _, target := range targets {
+		count += len(target.Frames)
+	}
+	setAuditCount(c, count)
+	name := params.UID
+	if name == "" {
+		name = params.Device
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"frames-%s.json\"", funcs.MD5(name)))
+	c.JSON(http.StatusOK, FramesExport{
+		UID:        params.UID,
+		Device:     params.Device,
+		ExportedAt: time.Now().Format("2006-01-02 15:04:05"),
+		Devices:    targets,
+	})
+}
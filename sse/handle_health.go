@@ -0,0 +1,70 @@
+package sse
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var processStartTime = time.Now()
+
+// HandleHealth 存活检查：进程能处理请求即返回200
+func HandleHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"alive": true,
+	})
+}
+
+// HandleReady 就绪检查：Redis可用、实例已登记、实例Topic订阅正常且未在排空时返回200，否则返回503
+func HandleReady(c *gin.Context) {
+	redisAvailable := redisHealth.isAvailable()
+	registered := isRegistered()
+	subscribed := subscription.isConnected()
+	isDraining := draining.Load()
+	ready := redisAvailable && registered && subscribed && !isDraining
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"ready":        ready,
+		"redis":        redisAvailable,
+		"registered":   registered,
+		"subscription": subscribed,
+		"draining":     isDraining,
+	})
+}
+
+// HandleStatus 本实例的详细状态，供人工排查
+func HandleStatus(c *gin.Context) {
+	devices := 0
+	deviceChannels.Range(func(key, value interface{}) bool {
+		devices++
+		return true
+	})
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	registered := isRegistered()
+	ready := redisHealth.isAvailable() && registered && subscription.isConnected() && !draining.Load()
+	c.JSON(http.StatusOK, gin.H{
+		"version":        globalInstance.Version,
+		"address":        globalInstance.Address,
+		"start_time":     globalInstance.StartTime,
+		"uptime_seconds": int64(time.Since(processStartTime).Seconds()),
+		"ready":          ready,
+		"draining":       draining.Load(),
+		"registered":     registered,
+		"redis":          redisHealth.snapshot(),
+		"subscription":   subscription.snapshot(),
+		"devices":        devices,
+		"queue_depth":    metrics.queueDepth.Load(),
+		"goroutines":     runtime.NumGoroutine(),
+		"memory": gin.H{
+			"alloc_bytes": mem.Alloc,
+			"sys_bytes":   mem.Sys,
+			"num_gc":      mem.NumGC,
+		},
+	})
+}
@@ -1,8 +1,6 @@
 package sse
 
 import (
-	"log"
-	"net/http"
 	"sse-broker/funcs"
 	"time"
 
@@ -67,8 +65,6 @@ func getUserInfo(uid string) UserInfo {
 		}
 	}
 	devices := make([]Device, 0, len(deviceIds))
-	var firstLoginTime time.Time
-	var lastTouchTime time.Time
 	for _, deviceId := range deviceIds {
 		device := globalInstance.getDevice(deviceId)
 		if device == nil {
@@ -76,17 +72,26 @@ func getUserInfo(uid string) UserInfo {
 		}
 		if device != nil {
 			devices = append(devices, *device)
-			if device.LoginTime != "" {
-				loginTime, _ := time.Parse("2006-01-02 15:04:05", device.LoginTime)
-				if firstLoginTime.IsZero() || loginTime.Before(firstLoginTime) {
-					firstLoginTime = loginTime
-				}
+		}
+	}
+	return newUserInfo(uid, devices)
+}
+
+// 由用户的在线设备生成用户信息：最早的登录时间和最近的活跃时间
+func newUserInfo(uid string, devices []Device) UserInfo {
+	var firstLoginTime time.Time
+	var lastTouchTime time.Time
+	for _, device := range devices {
+		if device.LoginTime != "" {
+			loginTime, _ := time.Parse("2006-01-02 15:04:05", device.LoginTime)
+			if firstLoginTime.IsZero() || loginTime.Before(firstLoginTime) {
+				firstLoginTime = loginTime
 			}
-			if device.LastTouchTime != "" {
-				touchTime, _ := time.Parse("2006-01-02 15:04:05", device.LastTouchTime)
-				if lastTouchTime.IsZero() || touchTime.After(lastTouchTime) {
-					lastTouchTime = touchTime
-				}
+		}
+		if device.LastTouchTime != "" {
+			touchTime, _ := time.Parse("2006-01-02 15:04:05", device.LastTouchTime)
+			if lastTouchTime.IsZero() || touchTime.After(lastTouchTime) {
+				lastTouchTime = touchTime
 			}
 		}
 	}
@@ -99,8 +104,11 @@ func getUserInfo(uid string) UserInfo {
 	}
 }
 
-func getInstanceInfo(address string) InstanceInfo {
-	instance := getRedisInstance(address)
+func getInstanceInfo(address string) (InstanceInfo, error) {
+	instance, err := getRedisInstance(address)
+	if err != nil {
+		return InstanceInfo{}, err
+	}
 	if instance == nil {
 		return InstanceInfo{
 			Online: false,
@@ -110,18 +118,18 @@ func getInstanceInfo(address string) InstanceInfo {
 				StartTime:   "",
 				DeviceCount: 0,
 			},
-		}
+		}, nil
 	}
 	return InstanceInfo{
 		Online:           instance.exist(),
 		AbstractInstance: *instance,
-	}
+	}, nil
 }
 
-func getClusterInfo() ClusterInfo {
-	instanceAddresses, err := globalRedis.SMembers(KEY_CLUSTER_INSTANCE_SET)
+func getClusterInfo() (ClusterInfo, error) {
+	instanceAddresses, err := globalRedis.SMembers(redisKey(KEY_CLUSTER_INSTANCE_SET, ""))
 	if err != nil {
-		log.Println("Failed to get instance addresses:", err)
+		return ClusterInfo{}, ErrRedisUnavailable.with("Failed to get instance addresses: %s", err.Error())
 	}
 	if len(instanceAddresses) == 0 {
 		return ClusterInfo{
@@ -129,21 +137,24 @@ func getClusterInfo() ClusterInfo {
 			UserCount:     0,
 			DeviceCount:   0,
 			Instances:     []InstanceInfo{},
-		}
+		}, nil
 	}
 	deviceCount := 0
 	instances := make([]InstanceInfo, 0, len(instanceAddresses))
 	for _, address := range instanceAddresses {
-		instance := getInstanceInfo(address)
+		instance, err := getInstanceInfo(address)
+		if err != nil {
+			return ClusterInfo{}, err
+		}
 		if instance.Online {
 			deviceCount += instance.DeviceCount
 		}
 		instances = append(instances, instance)
 	}
 	userCount := 0
-	cnt, err := globalRedis.SCard(KEY_ONLINE_USER_SET)
+	cnt, err := globalRedis.SCard(redisKey(KEY_ONLINE_USER_SET, ""))
 	if err != nil {
-		log.Println("Failed to get online user count:", err)
+		apiLogger.Warn("Failed to get online user count", "error", err)
 		userCount = 0
 	} else {
 		userCount = int(cnt)
@@ -153,7 +164,7 @@ func getClusterInfo() ClusterInfo {
 		UserCount:     userCount,
 		DeviceCount:   deviceCount,
 		Instances:     instances,
-	}
+	}, nil
 }
 
 func HandleInfo(c *gin.Context) {
@@ -161,7 +172,7 @@ func HandleInfo(c *gin.Context) {
 	var params InfoParams
 	err := fillParams(c, &params)
 	if err != nil {
-		log.Fatalln(err)
+		respondError(c, err)
 		return
 	}
 	var info interface{}
@@ -171,16 +182,15 @@ func HandleInfo(c *gin.Context) {
 	case "user":
 		info = getUserInfo(id)
 	case "instance":
-		info = getInstanceInfo(id)
+		info, err = getInstanceInfo(id)
 	case "cluster":
-		info = getClusterInfo()
+		info, err = getClusterInfo()
 	default:
 		info = gin.H{}
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"code":   1,
-		"msg":    "success",
-		"result": info,
-		"micro":  endRequest(c),
-	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, info)
 }
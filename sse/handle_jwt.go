@@ -1,27 +1,67 @@
 package sse
 
 import (
-	"net/http"
+	"errors"
 	"sse-broker/funcs"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 )
 
 type Claims struct {
-	UID        string `json:"uid"`
-	DeviceName string `json:"device_name"`
+	UID        string      `json:"uid"`
+	DeviceName string      `json:"device_name"`
+	Attrs      DeviceAttrs `json:"attrs,omitempty"`
+	Tags       DeviceTags  `json:"tags,omitempty"`
+	Origin     string      `json:"origin,omitempty"`
 	jwt.StandardClaims
 }
 
-var jwtSecret []byte
-var jwtExpire int
+// JWT密钥：签发只用当前密钥；轮换后的重叠期内，旧密钥签发的token仍可通过校验
+type jwtKeys struct {
+	current       []byte
+	previous      []byte
+	previousUntil time.Time
+}
+
+var jwtKeySet atomic.Pointer[jwtKeys]
 
 // Init 初始化JWT
-func jwtInit(secret string, expire int) {
-	jwtSecret = []byte(secret)
-	jwtExpire = expire
+func jwtInit(secret string) {
+	jwtKeySet.Store(&jwtKeys{current: []byte(secret)})
+}
+
+// 轮换JWT密钥，旧密钥在overlap时长内仍可用于校验
+func rotateJwtSecret(secret string, overlap time.Duration) {
+	old := jwtKeySet.Load()
+	if string(old.current) == secret {
+		return
+	}
+	jwtKeySet.Store(&jwtKeys{
+		current:       []byte(secret),
+		previous:      old.current,
+		previousUntil: time.Now().Add(overlap),
+	})
+}
+
+// 用当前密钥校验token，失败且处于重叠期时再用旧密钥校验
+func parseToken(tokenString string, claims *Claims) (*jwt.Token, error) {
+	keys := jwtKeySet.Load()
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return keys.current, nil
+	})
+	var validationErr *jwt.ValidationError
+	if err != nil && keys.previous != nil && time.Now().Before(keys.previousUntil) &&
+		errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+		*claims = Claims{}
+		return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return keys.previous, nil
+		})
+	}
+	return token, err
 }
 
 // Middleware 处理JWT鉴权
@@ -35,38 +75,65 @@ func TokenCheck() gin.HandlerFunc {
 		if deviceName == "" {
 			deviceName = c.GetHeader("X-SSE-Device")
 		}
-		lastEventID := c.DefaultQuery("id", "")
+		// 浏览器 EventSource 自动重连时带 Last-Event-ID，且沿用首次连接的URL，因此优先于 id 参数
+		lastEventID := c.GetHeader("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.DefaultQuery("id", "")
+		}
 		if lastEventID == "" {
 			lastEventID = c.GetHeader("X-SSE-ID")
 		}
-		lastId, err := strconv.Atoi(lastEventID)
-		if err != nil {
+		lastId, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastId < 0 {
 			lastId = 0
 		}
 		if tokenString == "" || deviceName == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "token and device is required"})
-			c.Abort()
+			respondError(c, ErrUnauthorized)
 			return
 		}
 
 		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		token, err := parseToken(tokenString, claims)
 
 		if deviceName != "" && claims.DeviceName != "" && claims.DeviceName != deviceName {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"code":   401,
-				"msg":    "Invalid device",
-				"result": "",
-			})
-			c.Abort()
+			respondError(c, ErrInvalidDevice)
 			return
 		}
 
 		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			respondError(c, ErrInvalidToken)
+			return
+		}
+		if err := checkEventsOrigin(c, claims); err != nil {
+			respondError(c, err)
+			return
+		}
+
+		// 设备属性与标签：客户端通过查询参数或请求头声明，token中的声明优先
+		var attrs DeviceAttrs
+		var tags DeviceTags
+		attrParam := c.DefaultQuery("attrs", "")
+		if attrParam == "" {
+			attrParam = c.GetHeader("X-SSE-Attrs")
+		}
+		tagParam := c.DefaultQuery("tags", "")
+		if tagParam == "" {
+			tagParam = c.GetHeader("X-SSE-Tags")
+		}
+		err = attrs.UnmarshalParam(attrParam)
+		if err == nil {
+			for key, value := range claims.Attrs {
+				attrs[key] = value
+			}
+			err = attrs.validate()
+		}
+		if err == nil {
+			tags.UnmarshalParam(tagParam)
+			tags = mergeTags(tags, claims.Tags)
+			err = tags.validate()
+		}
+		if err != nil {
+			respondError(c, ErrInvalidParams.with("%s", err.Error()))
 			return
 		}
 
@@ -77,6 +144,8 @@ func TokenCheck() gin.HandlerFunc {
 		c.Set("_device_id", funcs.MD5(deviceName))
 		// 将lastEventID保存到上下文中
 		c.Set("_last_event_id", lastId)
+		c.Set("_attrs", map[string]string(attrs))
+		c.Set("_tags", []string(tags))
 		c.Next()
 	}
 }
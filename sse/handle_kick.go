@@ -1,9 +1,6 @@
 package sse
 
 import (
-	"log"
-	"net/http"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -11,6 +8,7 @@ type KickParams struct {
 	UID    string `json:"uid" form:"uid"`
 	Device string `json:"device" form:"device"`
 	Data   string `json:"data" form:"data"`
+	Filter string `json:"filter" form:"filter"` // 设备筛选表达式，可单独使用以踢下线全部匹配的设备
 }
 
 func HandleKick(c *gin.Context) {
@@ -18,20 +16,33 @@ func HandleKick(c *gin.Context) {
 	var params KickParams
 	err := fillParams(c, &params)
 	if err != nil {
-		log.Fatalln(err)
+		respondError(c, err)
 		return
 	}
-	if params.UID == "" && params.Device == "" {
-		c.JSON(http.StatusOK, gin.H{
-			"code":   http.StatusBadRequest,
-			"msg":    "uid and device cannot be empty at the same time",
-			"result": "",
-			"micro":  endRequest(c),
-		})
+	setAuditTarget(c, auditTarget(params.UID, params.Device, params.Filter), nil)
+	if params.UID == "" && params.Device == "" && params.Filter == "" {
+		respondError(c, ErrInvalidParams.with("uid, device and filter cannot be empty at the same time"))
+		return
+	}
+	filter, err := parseDeviceFilter(params.Filter)
+	if err != nil {
+		respondError(c, ErrInvalidFilter.with("%s", err.Error()))
 		return
 	}
 	count := 0
-	deviceIds := collectDeviceIds(params.UID, params.Device)
+	var deviceIds []string
+	if params.UID == "" && params.Device == "" {
+		deviceIds, err = getFilterCandidateIds(filter)
+	} else {
+		deviceIds, err = collectDeviceIds(params.UID, params.Device)
+	}
+	if err == nil {
+		deviceIds, err = filterDeviceIds(deviceIds, filter)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	for _, deviceId := range deviceIds {
 		if deviceId == "" {
 			continue
@@ -56,10 +67,6 @@ func HandleKick(c *gin.Context) {
 			}
 		}
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"code":   1,
-		"msg":    "success",
-		"result": count,
-		"micro":  endRequest(c),
-	})
+	setAuditCount(c, count)
+	respondSuccess(c, count)
 }
@@ -0,0 +1,405 @@
+package sse
+
+import (
+	"context"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type ListParams struct {
+	Cursor    string `json:"cursor" form:"cursor"`         // 上一页返回的游标，为空时从头开始
+	Limit     int    `json:"limit" form:"limit"`           // 每页数量，扫描按批进行，一页可能略多于limit
+	Instance  string `json:"instance" form:"instance"`     // 只列出连接在该实例上的设备(或有设备连接在该实例上的用户)
+	UIDPrefix string `json:"uid_prefix" form:"uid_prefix"` // 用户ID前缀
+	Device    string `json:"device" form:"device"`         // 设备名称的通配模式，如 web-*
+	LoginFrom int64  `json:"login_from" form:"login_from"` // 登录时间范围，unix秒
+	LoginTo   int64  `json:"login_to" form:"login_to"`
+	IP        string `json:"ip" form:"ip"`                 // 客户端IP或CIDR
+	CountOnly bool   `json:"count_only" form:"count_only"` // 只返回数量
+}
+
+// 列表的筛选条件
+type listFilter struct {
+	instance  string
+	uidPrefix string
+	// 用户ID包含的字符串，仅管理后台使用
+	uidContains string
+	device      string
+	loginFrom   int64
+	loginTo     int64
+	ip          netip.Prefix
+}
+
+func newListFilter(params *ListParams) (*listFilter, error) {
+	filter := &listFilter{
+		instance:  params.Instance,
+		uidPrefix: params.UIDPrefix,
+		device:    params.Device,
+		loginFrom: params.LoginFrom,
+		loginTo:   params.LoginTo,
+	}
+	if filter.device != "" {
+		if _, err := path.Match(filter.device, ""); err != nil {
+			return nil, ErrInvalidParams.with("invalid device pattern: %s", filter.device)
+		}
+	}
+	if params.IP != "" {
+		var err error
+		if strings.Contains(params.IP, "/") {
+			filter.ip, err = netip.ParsePrefix(params.IP)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(params.IP)
+			filter.ip = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		if err != nil {
+			return nil, ErrInvalidParams.with("invalid ip: %s", params.IP)
+		}
+		filter.ip = filter.ip.Masked()
+	}
+	return filter, nil
+}
+
+// 是否有需要读取设备记录才能判断的条件
+func (f *listFilter) needDevices() bool {
+	return f.instance != "" || f.device != "" || f.loginFrom > 0 || f.loginTo > 0 || f.ip.IsValid()
+}
+
+func (f *listFilter) matchDevice(device *Device) bool {
+	if f.instance != "" && device.InstanceAddress != f.instance {
+		return false
+	}
+	if f.uidPrefix != "" && !strings.HasPrefix(device.UID, f.uidPrefix) {
+		return false
+	}
+	if f.uidContains != "" && !strings.Contains(device.UID, f.uidContains) {
+		return false
+	}
+	if f.device != "" {
+		if ok, _ := path.Match(f.device, device.DeviceName); !ok {
+			return false
+		}
+	}
+	if f.loginFrom > 0 || f.loginTo > 0 {
+		loginTime, err := time.ParseInLocation("2006-01-02 15:04:05", device.LoginTime, time.Local)
+		if err != nil {
+			return false
+		}
+		if f.loginFrom > 0 && loginTime.Unix() < f.loginFrom {
+			return false
+		}
+		if f.loginTo > 0 && loginTime.Unix() > f.loginTo {
+			return false
+		}
+	}
+	if f.ip.IsValid() && !f.ip.Contains(parseHostIP(device.DeviceAddress)) {
+		return false
+	}
+	return true
+}
+
+// 批量读取设备记录，已下线的设备忽略
+func loadDevices(deviceIds []string) ([]Device, error) {
+	if len(deviceIds) == 0 {
+		return []Device{}, nil
+	}
+	ctx := context.Background()
+	pipe := globalRedis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(deviceIds))
+	for i, deviceId := range deviceIds {
+		cmds[i] = pipe.HGetAll(ctx, redisKey(KEY_DEVICE_PREFIX, deviceId))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, ErrRedisUnavailable.with("Failed to load devices: %s", err.Error())
+	}
+	devices := make([]Device, 0, len(deviceIds))
+	for i, cmd := range cmds {
+		info, err := cmd.Result()
+		if err != nil || len(info) == 0 {
+			continue
+		}
+		devices = append(devices, *deviceFromInfo(deviceIds[i], info))
+	}
+	return devices, nil
+}
+
+// 批量读取用户的在线设备
+func loadUserDevices(uids []string) (map[string][]Device, error) {
+	ctx := context.Background()
+	pipe := globalRedis.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(uids))
+	for i, uid := range uids {
+		cmds[i] = pipe.SMembers(ctx, redisKey(KEY_USER_DEVICE_SET_PREFIX, uid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, ErrRedisUnavailable.with("Failed to load user devices: %s", err.Error())
+	}
+	owners := make(map[string]string)
+	var deviceIds []string
+	for i, cmd := range cmds {
+		members, _ := cmd.Result()
+		for _, deviceId := range members {
+			owners[deviceId] = uids[i]
+			deviceIds = append(deviceIds, deviceId)
+		}
+	}
+	devices, err := loadDevices(deviceIds)
+	if err != nil {
+		return nil, err
+	}
+	userDevices := make(map[string][]Device, len(uids))
+	for _, device := range devices {
+		uid := owners[device.DeviceID]
+		userDevices[uid] = append(userDevices[uid], device)
+	}
+	return userDevices, nil
+}
+
+// 转义SCAN匹配模式中的通配符
+func escapeScanPattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(s)
+}
+
+// 扫描在线用户：按 uid_prefix 和 uidContains 在Redis端匹配，其余条件须有一台设备满足
+// collect为false时只计数；返回的游标为0表示已扫描完
+func scanUsers(filter *listFilter, cursor uint64, limit int, collect bool) ([]UserInfo, int, uint64, error) {
+	ctx := context.Background()
+	match := escapeScanPattern(filter.uidPrefix) + "*"
+	if filter.uidContains != "" {
+		match += escapeScanPattern(filter.uidContains) + "*"
+	}
+	users := []UserInfo{}
+	count := 0
+	for batches := 0; ; batches++ {
+		uids, next, err := globalRedis.Client().SScan(ctx, redisKey(KEY_ONLINE_USER_SET, ""), cursor, match, int64(limit)).Result()
+		if err != nil {
+			return nil, 0, 0, ErrRedisUnavailable.with("Failed to scan online users: %s", err.Error())
+		}
+		cursor = next
+		if collect || filter.needDevices() {
+			userDevices, err := loadUserDevices(uids)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			for _, uid := range uids {
+				devices := userDevices[uid]
+				if filter.needDevices() {
+					matched := false
+					for i := range devices {
+						matched = matched || filter.matchDevice(&devices[i])
+					}
+					if !matched {
+						continue
+					}
+				}
+				count++
+				if collect {
+					if devices == nil {
+						devices = []Device{}
+					}
+					users = append(users, newUserInfo(uid, devices))
+				}
+			}
+		} else {
+			count += len(uids)
+		}
+		if cursor == 0 || (collect && (len(users) >= limit || batches >= LIST_SCAN_MAX_BATCHES)) {
+			return users, count, cursor, nil
+		}
+	}
+}
+
+// 设备列表的游标：实例地址#该实例设备集合的SSCAN游标
+func parseDeviceCursor(cursor string) (string, uint64, error) {
+	if cursor == "" {
+		return "", 0, nil
+	}
+	index := strings.LastIndex(cursor, "#")
+	if index < 0 {
+		return "", 0, ErrInvalidParams.with("invalid cursor: %s", cursor)
+	}
+	n, err := strconv.ParseUint(cursor[index+1:], 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidParams.with("invalid cursor: %s", cursor)
+	}
+	return cursor[:index], n, nil
+}
+
+// 扫描在线设备：依次扫描各实例的设备集合，指定实例时只扫描该实例
+// collect为false时只计数；返回的游标为空表示已扫描完
+func scanDevices(filter *listFilter, cursor string, limit int, collect bool) ([]Device, int, string, error) {
+	var addresses []string
+	if filter.instance != "" {
+		addresses = []string{filter.instance}
+	} else {
+		members, err := globalRedis.SMembers(redisKey(KEY_CLUSTER_INSTANCE_SET, ""))
+		if err != nil {
+			return nil, 0, "", ErrRedisUnavailable.with("Failed to get instances: %s", err.Error())
+		}
+		addresses = members
+		sort.Strings(addresses)
+	}
+	address, setCursor, err := parseDeviceCursor(cursor)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	// 从游标所在的实例继续；该实例已下线时从其后的实例开始
+	start := 0
+	if address != "" {
+		start = sort.SearchStrings(addresses, address)
+		if start >= len(addresses) || addresses[start] != address {
+			setCursor = 0
+		}
+	}
+
+	ctx := context.Background()
+	devices := []Device{}
+	count := 0
+	batches := 0
+	for i := start; i < len(addresses); i++ {
+		setKey := redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, addresses[i])
+		// 只计数且无筛选条件时直接取集合大小
+		if !collect && !filter.needDevices() && filter.uidPrefix == "" {
+			n, err := globalRedis.SCard(setKey)
+			if err != nil {
+				return nil, 0, "", ErrRedisUnavailable.with("Failed to count devices: %s", err.Error())
+			}
+			count += int(n)
+			continue
+		}
+		for {
+			deviceIds, next, err := globalRedis.Client().SScan(ctx, setKey, setCursor, "", int64(limit)).Result()
+			if err != nil {
+				return nil, 0, "", ErrRedisUnavailable.with("Failed to scan devices: %s", err.Error())
+			}
+			setCursor = next
+			batches++
+			loaded, err := loadDevices(deviceIds)
+			if err != nil {
+				return nil, 0, "", err
+			}
+			for j := range loaded {
+				if filter.matchDevice(&loaded[j]) {
+					count++
+					if collect {
+						devices = append(devices, loaded[j])
+					}
+				}
+			}
+			if setCursor == 0 {
+				break
+			}
+			if collect && (len(devices) >= limit || batches >= LIST_SCAN_MAX_BATCHES) {
+				return devices, count, addresses[i] + "#" + strconv.FormatUint(setCursor, 10), nil
+			}
+		}
+		if collect && (len(devices) >= limit || batches >= LIST_SCAN_MAX_BATCHES) && i+1 < len(addresses) {
+			return devices, count, addresses[i+1] + "#0", nil
+		}
+	}
+	return devices, count, "", nil
+}
+
+// 绑定列表参数并生成筛选条件
+func bindListParams(c *gin.Context) (*ListParams, *listFilter, error) {
+	var params ListParams
+	if err := fillParams(c, &params); err != nil {
+		return nil, nil, err
+	}
+	if params.Limit <= 0 {
+		params.Limit = LIST_DEFAULT_LIMIT
+	}
+	if params.Limit > LIST_MAX_LIMIT {
+		params.Limit = LIST_MAX_LIMIT
+	}
+	filter, err := newListFilter(&params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &params, filter, nil
+}
+
+// HandleUsers 分页列出在线用户
+func HandleUsers(c *gin.Context) {
+	startRequest(c)
+	params, filter, err := bindListParams(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.CountOnly {
+		// 无筛选条件时直接取集合大小
+		if filter.uidPrefix == "" && !filter.needDevices() {
+			count, err := globalRedis.SCard(redisKey(KEY_ONLINE_USER_SET, ""))
+			if err != nil {
+				respondError(c, ErrRedisUnavailable.with("Failed to count online users: %s", err.Error()))
+				return
+			}
+			respondSuccess(c, gin.H{"count": count})
+			return
+		}
+		_, count, _, err := scanUsers(filter, 0, LIST_COUNT_BATCH, false)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		respondSuccess(c, gin.H{"count": count})
+		return
+	}
+	cursor := uint64(0)
+	if params.Cursor != "" {
+		if cursor, err = strconv.ParseUint(params.Cursor, 10, 64); err != nil {
+			respondError(c, ErrInvalidParams.with("invalid cursor: %s", params.Cursor))
+			return
+		}
+	}
+	users, _, next, err := scanUsers(filter, cursor, params.Limit, true)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	nextCursor := ""
+	if next != 0 {
+		nextCursor = strconv.FormatUint(next, 10)
+	}
+	respondSuccess(c, gin.H{
+		"cursor": nextCursor,
+		"users":  users,
+	})
+}
+
+// HandleDevices 分页列出在线设备
+func HandleDevices(c *gin.Context) {
+	startRequest(c)
+	params, filter, err := bindListParams(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if params.CountOnly {
+		_, count, _, err := scanDevices(filter, "", LIST_COUNT_BATCH, false)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		respondSuccess(c, gin.H{"count": count})
+		return
+	}
+	devices, _, next, err := scanDevices(filter, params.Cursor, params.Limit, true)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondSuccess(c, gin.H{
+		"cursor":  next,
+		"devices": devices,
+	})
+}
@@ -0,0 +1,107 @@
+package sse
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReloadReport 热加载结果：已生效的配置项，以及有变化但需重启才能生效的配置项
+type ReloadReport struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+	ClusterPending  []string `json:"cluster_pending,omitempty"` // 集群配置有变化时，尚未重新加载的其他实例
+}
+
+// 心跳周期变化的通知：热加载时关闭当前通道，各连接随即按新周期重置心跳
+var heartbeatSignal struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+func heartbeatChanged() <-chan struct{} {
+	heartbeatSignal.Lock()
+	defer heartbeatSignal.Unlock()
+	if heartbeatSignal.ch == nil {
+		heartbeatSignal.ch = make(chan struct{})
+	}
+	return heartbeatSignal.ch
+}
+
+func notifyHeartbeatChanged() {
+	heartbeatSignal.Lock()
+	defer heartbeatSignal.Unlock()
+	if heartbeatSignal.ch != nil {
+		close(heartbeatSignal.ch)
+	}
+	heartbeatSignal.ch = make(chan struct{})
+}
+
+var reloadHandler func() (*ReloadReport, error)
+
+// SetReloadHandler 设置重新加载配置的方法，供 /admin/reload 调用
+func SetReloadHandler(handler func() (*ReloadReport, error)) {
+	reloadHandler = handler
+}
+
+// Reload 热加载配置：SSE参数、JWT、API密钥和审计开关立即生效；
+// 已建立的连接改用新的心跳周期，保持原队列；Server、Redis 和审计文件路径保持原值
+// 集群配置有变化时返回尚未使用新配置的其他实例
+func Reload(config Config) []string {
+	old := currentConfig()
+	config.Server = old.Server
+	config.Redis = old.Redis
+	config.Audit.Path = old.Audit.Path
+	oldSettings := clusterSettings()
+	globalConfig.Store(&config)
+	eventTypes.setConfigTypes(config.Events.Types)
+	if config.SSE.HeartbeatDuration != old.SSE.HeartbeatDuration {
+		notifyHeartbeatChanged()
+	}
+
+	if config.JWT.Secret != old.JWT.Secret {
+		rotateJwtSecret(config.JWT.Secret, config.JWT.SecretOverlap)
+		instanceLogger.Info("JWT secret rotated", "overlap", config.JWT.SecretOverlap.String())
+	}
+	if config.Audit.Enable {
+		if err := audit.open(config.Audit.Path); err != nil {
+			instanceLogger.Error("Failed to open audit log", "path", config.Audit.Path, "error", err)
+		}
+	}
+	// 集群内须一致的配置有变化时，其他实例也须重新加载；最后一个完成的实例更新集群记录
+	settings := clusterSettings()
+	if reflect.DeepEqual(settings, oldSettings) {
+		return nil
+	}
+	pending, err := updateClusterSettings(settings)
+	if err != nil {
+		instanceLogger.Error("Failed to update cluster settings", "error", err)
+	} else if len(pending) > 0 {
+		instanceLogger.Warn("Cluster-wide settings changed, reload the other instances of the cluster", "pending", pending)
+	} else {
+		instanceLogger.Info("Cluster-wide settings updated, all instances reloaded")
+	}
+	return pending
+}
+
+// HandleReload 重新加载配置文件
+func HandleReload(c *gin.Context) {
+	startRequest(c)
+	if c.Request.Method != "POST" {
+		respondError(c, ErrMethodNotAllowed.with("Method not allowed: %s", c.Request.Method))
+		return
+	}
+	setAuditTarget(c, "config", nil)
+	if reloadHandler == nil {
+		respondError(c, ErrInternal.with("Reload is not supported"))
+		return
+	}
+	report, err := reloadHandler()
+	if err != nil {
+		respondError(c, ErrInvalidConfig.with("%s", err.Error()))
+		return
+	}
+	setAuditCount(c, len(report.Applied))
+	respondSuccess(c, report)
+}
@@ -2,67 +2,178 @@ package sse
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"encoding/json"
 	"net/http"
 	"sse-broker/funcs"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
 type SendFrameParams struct {
-	UID    string `json:"uid" form:"uid"`
-	Device string `json:"device" form:"device"`
-	Event  string `json:"event" form:"event"`
-	Data   string `json:"data" form:"data"`
+	UID         string  `json:"uid" form:"uid"`
+	Device      string  `json:"device" form:"device"`
+	Event       string  `json:"event" form:"event"`
+	Data        Payload `json:"data" form:"data"`                 // 字符串或任意JSON值，JSON值压缩后发送
+	ContentType string  `json:"content_type" form:"content_type"` // 内容类型提示，JSON值默认为 application/json
+	Encoding    string  `json:"encoding" form:"encoding"`         // 传输编码提示，二进制内容用 base64
+	TTL         int64   `json:"ttl" form:"ttl"`                   // 消息有效期，单位秒
+	ExpiresAt   int64   `json:"expires_at" form:"expires_at"`     // 消息过期时间，unix秒
+	Priority    string  `json:"priority" form:"priority"`         // 消息优先级：high/normal/low
+	CollapseKey string  `json:"collapse_key" form:"collapse_key"` // 合并键，同键的消息只投递和缓存最新一条
+	Filter      string  `json:"filter" form:"filter"`             // 设备筛选表达式，如 platform=ios AND app_version>=3.2
 }
 
-func collectDeviceIds(uid_str string, device_name_str string) []string {
-	uids := strings.Split(uid_str, ",")
-	deviceNames := strings.Split(device_name_str, ",")
-	targetDeviceSet := make(map[string]bool)
-	for _, deviceName := range deviceNames {
-		if deviceName == "" {
-			continue
-		}
-		// 对设备ID进行MD5哈希
-		deviceId := funcs.MD5(deviceName)
-		targetDeviceSet[deviceId] = true
+// 解析消息优先级
+func (p *SendFrameParams) getPriority() (int, error) {
+	switch strings.ToLower(p.Priority) {
+	case "", "normal":
+		return PRIORITY_NORMAL, nil
+	case "high":
+		return PRIORITY_HIGH, nil
+	case "low":
+		return PRIORITY_LOW, nil
+	default:
+		return PRIORITY_NORMAL, ErrInvalidParams.with("invalid priority: %s", p.Priority)
 	}
-	var userDeviceSetKeys []string
-	for _, uid := range uids {
-		if uid == "" {
-			continue
-		}
-		userDeviceSetKeys = append(userDeviceSetKeys, fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, uid))
+}
+
+// 计算消息的过期时间，ttl与expires_at同时指定时取较早者；0表示永不过期
+func (p *SendFrameParams) getExpiresAt() (int64, error) {
+	if p.TTL < 0 {
+		return 0, ErrInvalidParams.with("ttl cannot be negative")
+	}
+	if p.ExpiresAt < 0 {
+		return 0, ErrInvalidParams.with("expires_at cannot be negative")
+	}
+	now := time.Now().Unix()
+	expiresAt := p.ExpiresAt
+	if p.TTL > 0 && (expiresAt == 0 || now+p.TTL < expiresAt) {
+		expiresAt = now + p.TTL
 	}
-	if len(userDeviceSetKeys) > 0 {
+	if expiresAt > 0 && expiresAt <= now {
+		return 0, ErrMessageExpired
+	}
+	return expiresAt, nil
+}
+
+// 生成发送消息帧的指令模板，DeviceID由调用方填充
+func (p *SendFrameParams) newInstruction() (Instruction, error) {
+	if strings.ContainsAny(p.Event, "\r\n") {
+		return Instruction{}, ErrInvalidParams.with("event cannot contain line breaks")
+	}
+	contentType, encoding, err := checkPayload(p.Data, p.ContentType, p.Encoding)
+	if err != nil {
+		return Instruction{}, err
+	}
+	expiresAt, err := p.getExpiresAt()
+	if err != nil {
+		return Instruction{}, err
+	}
+	priority, err := p.getPriority()
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{
+		Command:     CMD_SEND_FRAME,
+		Data:        p.Data.Text,
+		ContentType: contentType,
+		Encoding:    encoding,
+		Event:       p.Event,
+		ExpiresAt:   expiresAt,
+		Priority:    priority,
+		CollapseKey: p.CollapseKey,
+	}, nil
+}
+
+// 审计用的参数摘要，只记录消息大小不记录内容
+func (p *SendFrameParams) auditParams() map[string]string {
+	params := map[string]string{
+		"event":     p.Event,
+		"data_size": strconv.Itoa(len(p.Data.Text)),
+	}
+	if p.ContentType != "" {
+		params["content_type"] = p.ContentType
+	}
+	if p.Encoding != "" {
+		params["encoding"] = p.Encoding
+	}
+	if p.TTL > 0 {
+		params["ttl"] = strconv.FormatInt(p.TTL, 10)
+	}
+	if p.ExpiresAt > 0 {
+		params["expires_at"] = strconv.FormatInt(p.ExpiresAt, 10)
+	}
+	if p.Priority != "" {
+		params["priority"] = p.Priority
+	}
+	if p.CollapseKey != "" {
+		params["collapse_key"] = p.CollapseKey
+	}
+	return params
+}
+
+// 分批通过pipeline查询多个用户的在线设备ID
+func collectUserDeviceIds(uids []string) (map[string][]string, error) {
+	userDevices := make(map[string][]string)
+	batchSize := 250 // 每批查询 250 个用户
+	for i := 0; i < len(uids); i += batchSize {
+		end := i + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		batch := uids[i:end]
 		ctx := context.Background()
 		pipe := globalRedis.Pipeline()
-		cmds := make([]*redis.StringSliceCmd, len(userDeviceSetKeys))
-		for i, key := range userDeviceSetKeys {
-			cmds[i] = pipe.SMembers(ctx, key)
+		cmds := make([]*redis.StringSliceCmd, len(batch))
+		for j, uid := range batch {
+			cmds[j] = pipe.SMembers(ctx, redisKey(KEY_USER_DEVICE_SET_PREFIX, uid))
 		}
 		_, err := pipe.Exec(ctx)
 		if err != nil && err != redis.Nil {
-			log.Println("Pipeline error:", err)
-		} else {
-			for i, cmd := range cmds {
-				members, err := cmd.Result()
-				if err == redis.Nil {
-					log.Printf("User %s has no device\n", uids[i])
-					continue
-				} else if err != nil {
-					log.Printf("Error retrieving members from set %s: %v\n", userDeviceSetKeys[i], err)
-					continue
-				}
-				for _, deviceId := range members {
-					targetDeviceSet[deviceId] = true
-				}
+			return nil, ErrRedisUnavailable.with("Failed to get devices of users: %s", err.Error())
+		}
+		for j, cmd := range cmds {
+			members, err := cmd.Result()
+			if err != nil {
+				apiLogger.Warn("Failed to get device set of user", "uid", batch[j], "error", err)
+				continue
 			}
+			userDevices[batch[j]] = members
+		}
+	}
+	return userDevices, nil
+}
+
+// 拆分逗号分隔的参数，去掉空值
+func splitParam(param string) []string {
+	var values []string
+	for _, value := range strings.Split(param, ",") {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func collectDeviceIds(uid_str string, device_name_str string) ([]string, error) {
+	targetDeviceSet := make(map[string]bool)
+	for _, deviceName := range splitParam(device_name_str) {
+		// 对设备ID进行MD5哈希
+		deviceId := funcs.MD5(deviceName)
+		targetDeviceSet[deviceId] = true
+	}
+	userDevices, err := collectUserDeviceIds(splitParam(uid_str))
+	if err != nil {
+		return nil, err
+	}
+	for _, members := range userDevices {
+		for _, deviceId := range members {
+			targetDeviceSet[deviceId] = true
 		}
 	}
 	var keys []string
@@ -70,82 +181,165 @@ func collectDeviceIds(uid_str string, device_name_str string) []string {
 	for key := range targetDeviceSet {
 		keys = append(keys, key)
 	}
-	return keys
+	return keys, nil
 }
 
-func getAllDeviceIds() []string {
-	instance_addresses, err := globalRedis.SMembers(KEY_CLUSTER_INSTANCE_SET)
-	if err != nil || len(instance_addresses) == 0 {
-		return []string{}
+func getAllDeviceIds() ([]string, error) {
+	instance_addresses, err := globalRedis.SMembers(redisKey(KEY_CLUSTER_INSTANCE_SET, ""))
+	if err != nil {
+		return nil, ErrRedisUnavailable.with("Failed to get instances: %s", err.Error())
+	}
+	if len(instance_addresses) == 0 {
+		return []string{}, nil
 	}
 	ctx := context.Background()
 	pipe := globalRedis.Pipeline()
 
 	cmds := make([]*redis.StringSliceCmd, len(instance_addresses))
 	for i, address := range instance_addresses {
-		cmds[i] = pipe.SMembers(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_DEVICE_SET_PREFIX, address))
+		cmds[i] = pipe.SMembers(ctx, redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, address))
 	}
 	_, err = pipe.Exec(ctx)
 	if err != nil && err != redis.Nil {
-		log.Println("Pipeline error:", err)
-		return []string{}
+		return nil, ErrRedisUnavailable.with("Failed to get devices of instances: %s", err.Error())
 	}
 	var deviceIds []string
 	for i, cmd := range cmds {
 		members, err := cmd.Result()
 		if err == redis.Nil {
-			log.Printf("Instance %s has no device\n", instance_addresses[i])
+			apiLogger.Debug("Instance has no device", "instance", instance_addresses[i])
 			continue
 		} else if err != nil {
-			log.Printf("Error retrieving members from set: %v\n", err)
+			apiLogger.Warn("Failed to get devices of instance", "instance", instance_addresses[i], "error", err)
 			continue
 		}
 		deviceIds = append(deviceIds, members...)
 	}
-	return deviceIds
+	return deviceIds, nil
+}
+
+// 广播时的候选设备：表达式含可索引的条件时，只取该索引中的设备
+func getFilterCandidateIds(filter deviceFilter) ([]string, error) {
+	if key := filter.indexKey(); key != "" {
+		deviceIds, err := globalRedis.SMembers(key)
+		if err != nil {
+			return nil, ErrRedisUnavailable.with("Failed to get device index %s: %s", key, err.Error())
+		}
+		return deviceIds, nil
+	}
+	return getAllDeviceIds()
+}
+
+// 设备的属性和标签
+type deviceAttrs struct {
+	attrs map[string]string
+	tags  []string
+}
+
+// 分批通过pipeline读取设备的属性和标签，存入 loaded；已在 loaded 中的设备不再读取
+func loadDeviceAttrs(deviceIds []string, loaded map[string]*deviceAttrs) error {
+	var missing []string
+	for _, deviceId := range deviceIds {
+		if _, ok := loaded[deviceId]; !ok {
+			missing = append(missing, deviceId)
+		}
+	}
+	batchSize := 250 // 每批查询 250 个设备
+	for i := 0; i < len(missing); i += batchSize {
+		end := i + batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := missing[i:end]
+		ctx := context.Background()
+		pipe := globalRedis.Pipeline()
+		cmds := make([]*redis.SliceCmd, len(batch))
+		for j, deviceId := range batch {
+			cmds[j] = pipe.HMGet(ctx, redisKey(KEY_DEVICE_PREFIX, deviceId), "attrs", "tags")
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil && err != redis.Nil {
+			return ErrRedisUnavailable.with("Failed to get device attributes: %s", err.Error())
+		}
+		for j, cmd := range cmds {
+			device := &deviceAttrs{}
+			loaded[batch[j]] = device
+			values, err := cmd.Result()
+			if err != nil || len(values) != 2 {
+				continue
+			}
+			if value, ok := values[0].(string); ok {
+				json.Unmarshal([]byte(value), &device.attrs)
+			}
+			if value, ok := values[1].(string); ok {
+				json.Unmarshal([]byte(value), &device.tags)
+			}
+		}
+	}
+	return nil
 }
 
-// 分段处理设备ID，批量获取实例地址
-func splitDeviceWithInstanceAddressBatch(deviceIds []string, instanceDeviceMap *sync.Map, wg *sync.WaitGroup) {
-	defer wg.Done() // 标志当前 goroutine 结束
+// 按已读取的属性和标签筛选设备ID
+func matchDeviceIds(deviceIds []string, filter deviceFilter, loaded map[string]*deviceAttrs) []string {
+	var matched []string
+	for _, deviceId := range deviceIds {
+		if device, ok := loaded[deviceId]; ok && filter.match(device.attrs, device.tags) {
+			matched = append(matched, deviceId)
+		}
+	}
+	return matched
+}
+
+// 按设备属性和标签筛选设备ID
+func filterDeviceIds(deviceIds []string, filter deviceFilter) ([]string, error) {
+	if filter == nil {
+		return deviceIds, nil
+	}
+	loaded := make(map[string]*deviceAttrs, len(deviceIds))
+	if err := loadDeviceAttrs(deviceIds, loaded); err != nil {
+		return nil, err
+	}
+	return matchDeviceIds(deviceIds, filter, loaded), nil
+}
 
+// 分段处理设备ID，批量获取实例地址；每段返回自己的分组，避免并发追加同一实例的列表
+func splitDeviceWithInstanceAddressBatch(deviceIds []string) map[string][]string {
+	instanceDevices := make(map[string][]string)
 	ctx := context.Background()
 	pipe := globalRedis.Pipeline()
 
 	cmds := make([]*redis.StringCmd, len(deviceIds))
 	for i, deviceId := range deviceIds {
-		cmds[i] = pipe.HGet(ctx, fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, deviceId), "instance_address")
+		cmds[i] = pipe.HGet(ctx, redisKey(KEY_DEVICE_PREFIX, deviceId), "instance_address")
 	}
 
 	_, err := pipe.Exec(ctx)
 	if err != nil && err != redis.Nil {
-		log.Println("Pipeline error:", err)
-		return
+		apiLogger.Error("Failed to get instance address of devices", "count", len(deviceIds), "error", err)
+		return instanceDevices
 	}
 
 	for i, cmd := range cmds {
 		address, err := cmd.Result()
 		if err == redis.Nil {
-			log.Printf("Device %s not found\n", deviceIds[i])
+			apiLogger.Debug("Device not found", "device_id", deviceIds[i])
 			continue
 		} else if err != nil {
-			log.Printf("Error retrieving instance address for device %s: %v\n", deviceIds[i], err)
+			apiLogger.Warn("Failed to get instance address of device", "device_id", deviceIds[i], "error", err)
 			continue
 		}
 
 		if address != "" {
-			// 使用 sync.Map 保证并发写安全
-			val, _ := instanceDeviceMap.LoadOrStore(address, []string{})
-			// 这里的 val 是 interface{} 类型，强制转换为 []string
-			instanceDeviceMap.Store(address, append(val.([]string), deviceIds[i]))
+			instanceDevices[address] = append(instanceDevices[address], deviceIds[i])
 		}
 	}
+	return instanceDevices
 }
 
-// 分段并发处理设备ID
+// 分段并发处理设备ID，全部完成后合并各段的分组
 func splitDeviceWithInstanceAddress(deviceIds []string) map[string][]string {
-	instanceDeviceMap := &sync.Map{}
-	batchSize := 250      // 每批处理 250 个设备ID
+	batchSize := 250 // 每批处理 250 个设备ID
+	batches := make([]map[string][]string, (len(deviceIds)+batchSize-1)/batchSize)
 	var wg sync.WaitGroup // 用于等待所有 goroutines 完成
 
 	// 遍历并分批处理
@@ -156,89 +350,120 @@ func splitDeviceWithInstanceAddress(deviceIds []string) map[string][]string {
 		}
 
 		wg.Add(1) // 增加等待计数
-		go splitDeviceWithInstanceAddressBatch(deviceIds[i:end], instanceDeviceMap, &wg)
+		go func(index int, ids []string) {
+			defer wg.Done()
+			batches[index] = splitDeviceWithInstanceAddressBatch(ids)
+		}(i/batchSize, deviceIds[i:end])
 	}
 
 	wg.Wait() // 等待所有的 goroutines 完成
 
 	resultMap := make(map[string][]string)
-	instanceDeviceMap.Range(func(key, value interface{}) bool {
-		// 强制类型转换，假设 key 是 string，value 是 []string
-		strKey, ok1 := key.(string)
-		strValue, ok2 := value.([]string)
-		if ok1 && ok2 {
-			resultMap[strKey] = strValue
+	for _, batch := range batches {
+		for address, ids := range batch {
+			resultMap[address] = append(resultMap[address], ids...)
 		}
-		return true
-	})
-
+	}
 	return resultMap
 }
 
+// 投递指令：本实例的设备直接入队，其他设备按所在实例分组后批量分发
+func deliverInstructions(instructions []Instruction) {
+	var remoteInstructions []Instruction
+	remoteDeviceSet := make(map[string]bool)
+	for i := range instructions {
+		instruction := &instructions[i]
+		if instruction.DeviceID == "" {
+			continue
+		}
+		if globalInstance.getDevice(instruction.DeviceID) != nil {
+			globalInstance.handleInstruction(instruction)
+		} else {
+			remoteInstructions = append(remoteInstructions, *instruction)
+			remoteDeviceSet[instruction.DeviceID] = true
+		}
+	}
+	if len(remoteInstructions) == 0 {
+		return
+	}
+	remoteDeviceIds := make([]string, 0, len(remoteDeviceSet))
+	for deviceId := range remoteDeviceSet {
+		remoteDeviceIds = append(remoteDeviceIds, deviceId)
+	}
+	deviceInstance := make(map[string]string, len(remoteDeviceIds))
+	for address, ids := range splitDeviceWithInstanceAddress(remoteDeviceIds) {
+		for _, deviceId := range ids {
+			deviceInstance[deviceId] = address
+		}
+	}
+	instanceInstructions := make(map[string][]Instruction)
+	for _, instruction := range remoteInstructions {
+		if address, ok := deviceInstance[instruction.DeviceID]; ok {
+			instanceInstructions[address] = append(instanceInstructions[address], instruction)
+		}
+	}
+	for address, instractions := range instanceInstructions {
+		go DispatchInstructions(address, instractions)
+	}
+}
+
 func HandleSend(c *gin.Context) {
 	startRequest(c)
+	// 在解析参数前限制请求体大小，超大的请求不会被整个读入内存
+	if c.Request.Body != nil {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, sendBodyLimit())
+	}
 	var params SendFrameParams
 	if err := fillParams(c, &params); err != nil {
-		log.Fatalln(err)
+		respondError(c, err)
 		return
 	}
-	if params.Data == "" {
-		c.JSON(http.StatusOK, gin.H{
-			"code":   http.StatusBadRequest,
-			"msg":    "data cannot be empty",
-			"result": "",
-			"micro":  endRequest(c),
-		})
+	setAuditTarget(c, auditTarget(params.UID, params.Device, params.Filter), params.auditParams())
+	template, err := params.newInstruction()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkEventType(getActor(c), &params, &template); err != nil {
+		respondError(c, err)
+		return
+	}
+	filter, err := parseDeviceFilter(params.Filter)
+	if err != nil {
+		respondError(c, ErrInvalidFilter.with("%s", err.Error()))
 		return
 	}
 	sendAll := params.UID == "" && params.Device == ""
 	var deviceIds []string
-	if sendAll {
-		deviceIds = getAllDeviceIds()
+	if sendAll && filter != nil {
+		deviceIds, err = getFilterCandidateIds(filter)
+	} else if sendAll {
+		deviceIds, err = getAllDeviceIds()
 	} else {
-		deviceIds = collectDeviceIds(params.UID, params.Device)
+		deviceIds, err = collectDeviceIds(params.UID, params.Device)
+	}
+	if err == nil {
+		deviceIds, err = filterDeviceIds(deviceIds, filter)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
 	total := len(deviceIds)
 
-	var remoteDeviceIds []string
+	instructions := make([]Instruction, 0, total)
 	for _, deviceId := range deviceIds {
-		if deviceId == "" {
-			continue
-		}
-		device := globalInstance.getDevice(deviceId)
-		if device != nil {
-			globalInstance.handleInstruction(&Instruction{
-				DeviceID: deviceId,
-				Command:  CMD_SEND_FRAME,
-				Data:     params.Data,
-				Event:    params.Event,
-			})
-		} else {
-			remoteDeviceIds = append(remoteDeviceIds, deviceId)
-		}
-	}
-	if len(remoteDeviceIds) > 0 {
-		instanceDeviceMap := splitDeviceWithInstanceAddress(remoteDeviceIds)
-		for address, ids := range instanceDeviceMap {
-			go func() {
-				instractions := make([]Instruction, len(ids))
-				for _, deviceId := range ids {
-					instractions = append(instractions, Instruction{
-						DeviceID: deviceId,
-						Command:  CMD_SEND_FRAME,
-						Data:     params.Data,
-						Event:    params.Event,
-					})
-				}
-				DispatchInstructions(address, instractions)
-			}()
-		}
-	}
-	c.JSON(http.StatusOK, gin.H{
-		"code":   1,
-		"msg":    "success",
-		"result": total,
-		"micro":  endRequest(c),
-	})
+		instruction := template
+		instruction.DeviceID = deviceId
+		instructions = append(instructions, instruction)
+	}
+	if err := assignUserFrameIds(instructions); err != nil {
+		respondError(c, err)
+		return
+	}
+	deliverInstructions(instructions)
+
+	setAuditCount(c, total)
+	respondSuccess(c, total)
 }
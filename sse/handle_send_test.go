@@ -0,0 +1,47 @@
+package sse
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// 同一实例的设备分布在多个批次中时，合并后不能丢失设备
+func TestSplitDeviceWithInstanceAddress(t *testing.T) {
+	fake := startFakeRedis(t)
+	// 让各批次的结果同时到达，在多个线程上并发合并
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	fake.hold = 8
+	var deviceIds []string
+	want := map[string]int{}
+	for i := 0; i < 50000; i++ {
+		deviceId := fmt.Sprintf("d%05d", i)
+		address := "10.0.0.1:8080"
+		if i%4 == 3 {
+			address = "10.0.0.2:8080"
+		}
+		// 部分设备已下线，查不到实例地址
+		if i%10 != 9 {
+			fake.hset(redisKey(KEY_DEVICE_PREFIX, deviceId), "instance_address", address)
+			want[address]++
+		}
+		deviceIds = append(deviceIds, deviceId)
+	}
+	got := splitDeviceWithInstanceAddress(deviceIds)
+	if len(got) != len(want) {
+		t.Fatalf("got %d instances, want %d", len(got), len(want))
+	}
+	for address, ids := range got {
+		if len(ids) != want[address] {
+			t.Errorf("%s: got %d devices, want %d", address, len(ids), want[address])
+		}
+		sorted := append([]string{}, ids...)
+		sort.Strings(sorted)
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i] == sorted[i-1] {
+				t.Errorf("%s: device %s listed twice", address, sorted[i])
+			}
+		}
+	}
+}
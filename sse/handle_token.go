@@ -1,9 +1,7 @@
 package sse
 
 import (
-	"fmt"
-	"log"
-	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,9 +9,12 @@ import (
 )
 
 type TokenParams struct {
-	UID    string `json:"uid" form:"uid"`
-	Device string `json:"device" form:"device"`
-	TTL    int    `json:"ttl" form:"ttl"`
+	UID    string      `json:"uid" form:"uid"`
+	Device string      `json:"device" form:"device"`
+	TTL    int         `json:"ttl" form:"ttl"`
+	Attrs  DeviceAttrs `json:"attrs" form:"attrs"`
+	Tags   DeviceTags  `json:"tags" form:"tags"`
+	Origin string      `json:"origin" form:"origin"`
 }
 
 // CreateToken 生成JWT
@@ -21,38 +22,49 @@ func HandleToken(c *gin.Context) {
 	startRequest(c)
 	var params TokenParams
 	if err := fillParams(c, &params); err != nil {
-		log.Fatalln(err)
+		respondError(c, err)
 		return
 	}
 	if params.TTL <= 0 {
-		params.TTL = jwtExpire
+		params.TTL = currentConfig().JWT.Expire
+	}
+	setAuditTarget(c, auditTarget(params.UID, params.Device, ""), map[string]string{
+		"ttl": strconv.Itoa(params.TTL),
+	})
+
+	if err := params.Attrs.validate(); err != nil {
+		respondError(c, ErrInvalidParams.with("%s", err.Error()))
+		return
+	}
+	if err := params.Tags.validate(); err != nil {
+		respondError(c, ErrInvalidParams.with("%s", err.Error()))
+		return
+	}
+	// 绑定来源后，token只能在该来源的页面上使用
+	if params.Origin != "" && !originAllowed(params.Origin) {
+		respondError(c, ErrInvalidParams.with("origin is not in cors.allowed_origins: %s", params.Origin))
+		return
 	}
 
 	duration := time.Duration(params.TTL) * time.Second
 	claims := &Claims{
 		UID:        params.UID,
 		DeviceName: params.Device,
+		Attrs:      params.Attrs,
+		Tags:       params.Tags,
+		Origin:     params.Origin,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(duration).Unix(),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := token.SignedString(jwtKeySet.Load().current)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"code":   http.StatusInternalServerError,
-			"msg":    fmt.Sprintf("Failed to sign token: %s", err.Error()),
-			"result": "",
-			"micro":  endRequest(c),
-		})
+		respondError(c, ErrInternal.with("Failed to sign token: %s", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"code":   1,
-		"msg":    "success",
-		"result": tokenString,
-		"micro":  endRequest(c),
-	})
+	setAuditCount(c, 1)
+	respondSuccess(c, tokenString)
 }
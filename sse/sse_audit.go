@@ -0,0 +1,148 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sse-broker/funcs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var auditLogger = funcs.Logger("audit")
+
+// AuditRecord 一条审计记录
+type AuditRecord struct {
+	Time     int64             `json:"time"` // unix毫秒
+	Actor    string            `json:"actor"`
+	IP       string            `json:"ip"`
+	Instance string            `json:"instance"`
+	Action   string            `json:"action"`
+	Target   string            `json:"target"`           // 目标：uid/device列表，筛选表达式，或 * 表示全部
+	Params   map[string]string `json:"params,omitempty"` // 参数摘要，不含消息内容和密钥
+	Count    int               `json:"count"`            // 实际作用的设备数或条数
+	Status   int               `json:"status"`           // HTTP状态码
+	Error    string            `json:"error,omitempty"`  // 失败时的错误码
+}
+
+// 审计记录写入本地JSONL文件，可选同时写入Redis Stream
+type auditTrail struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var audit = &auditTrail{}
+
+func (a *auditTrail) open(path string) error {
+	a.mu.Lock()
+	opened := a.file != nil
+	a.mu.Unlock()
+	if opened {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.file = file
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *auditTrail) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func (a *auditTrail) write(record *AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		auditLogger.Error("Failed to marshal audit record", "action", record.Action, "error", err)
+		return
+	}
+	a.mu.Lock()
+	if a.file != nil {
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			auditLogger.Error("Failed to write audit record", "action", record.Action, "error", err)
+		}
+	}
+	a.mu.Unlock()
+	if currentConfig().Audit.RedisStream {
+		err := globalRedis.Client().XAdd(context.Background(), &redis.XAddArgs{
+			Stream: redisKey(KEY_AUDIT_STREAM, ""),
+			MaxLen: currentConfig().Audit.RedisStreamMaxLen,
+			Approx: true,
+			Values: map[string]interface{}{"record": string(line)},
+		}).Err()
+		if err != nil {
+			auditLogger.Error("Failed to add audit record to redis stream", "action", record.Action, "error", err)
+		}
+	}
+}
+
+// 记录本次请求的审计目标和参数摘要，由 Audit 中间件在请求结束后写出
+func setAuditTarget(c *gin.Context, target string, params map[string]string) {
+	c.Set("_audit_target", target)
+	c.Set("_audit_params", params)
+}
+
+// 记录本次请求实际作用的数量
+func setAuditCount(c *gin.Context, count int) {
+	c.Set("_audit_count", count)
+}
+
+// Audit 中间件：请求结束后写出审计记录，须放在 ApiAuth 之前，以便记录鉴权失败的请求
+func Audit(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if !currentConfig().Audit.Enable {
+			return
+		}
+		record := &AuditRecord{
+			Time:     time.Now().UnixMilli(),
+			Actor:    getActor(c),
+			IP:       getRealIP(c),
+			Instance: globalInstance.Address,
+			Action:   action,
+			Target:   c.GetString("_audit_target"),
+			Count:    c.GetInt("_audit_count"),
+			Status:   c.Writer.Status(),
+			Error:    c.GetString("_error"),
+		}
+		if params, ok := c.Get("_audit_params"); ok {
+			record.Params, _ = params.(map[string]string)
+		}
+		audit.write(record)
+	}
+}
+
+// 将逗号分隔的uid和device汇总为审计目标
+func auditTarget(uid string, device string, filter string) string {
+	var parts []string
+	if uid != "" {
+		parts = append(parts, "uid:"+uid)
+	}
+	if device != "" {
+		parts = append(parts, "device:"+device)
+	}
+	if filter != "" {
+		parts = append(parts, "filter:"+filter)
+	}
+	if uid == "" && device == "" {
+		parts = append([]string{"*"}, parts...)
+	}
+	return strings.Join(parts, " ")
+}
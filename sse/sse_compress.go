@@ -0,0 +1,185 @@
+package sse
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// 单一编码的压缩统计
+type compressionStats struct {
+	streams atomic.Int64 // 使用该编码的连接数
+	bytesIn atomic.Int64 // 压缩前的字节数
+	out     atomic.Int64 // 压缩后的字节数
+	nanos   atomic.Int64 // 压缩(含刷新)耗时
+	flushes atomic.Int64 // 刷新压缩器的次数
+}
+
+// 编码 -> *compressionStats
+var compressionMetrics sync.Map
+
+func getCompressionStats(encoding string) *compressionStats {
+	stats, _ := compressionMetrics.LoadOrStore(encoding, &compressionStats{})
+	return stats.(*compressionStats)
+}
+
+// 按 Accept-Encoding 从服务端支持的编码中选出一种，服务端的顺序优先；客户端不接受任何一种时返回空
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	accepted := make(map[string]bool)
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q > 0
+			continue
+		}
+		accepted[name] = q > 0
+	}
+	for _, encoding := range supported {
+		if ok, listed := accepted[encoding]; ok || (!listed && wildcard) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// 统计写入底层连接的字节数
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// 压缩器，gzip.Writer 与 brotli.Writer 都满足
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// SSE输出流：未协商压缩时直接写入响应；协商压缩时经压缩器写入，每条消息或心跳后刷新压缩器，不在压缩器中积压
+type eventStream struct {
+	w          io.Writer
+	flusher    http.Flusher
+	compressor compressor
+	stats      *compressionStats
+	flushSize  int
+}
+
+// 按请求协商压缩，并设置相应的响应头；须在写出响应头之前调用
+func newEventStream(c http.ResponseWriter, r *http.Request, flusher http.Flusher) *eventStream {
+	stream := &eventStream{w: c, flusher: flusher}
+	cfg := currentConfig().Compression
+	if !cfg.Enable {
+		return stream
+	}
+	c.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+	if encoding == "" {
+		return stream
+	}
+	stream.stats = getCompressionStats(encoding)
+	out := countingWriter{w: c, n: &stream.stats.out}
+	switch encoding {
+	case COMPRESSION_GZIP:
+		gz, err := gzip.NewWriterLevel(out, cfg.GzipLevel)
+		if err != nil {
+			gz = gzip.NewWriter(out)
+		}
+		stream.compressor = gz
+	case COMPRESSION_BROTLI:
+		stream.compressor = brotli.NewWriterLevel(out, cfg.BrotliQuality)
+	default:
+		stream.stats = nil
+		return stream
+	}
+	stream.flushSize = cfg.FlushSize
+	stream.stats.streams.Add(1)
+	c.Header().Set("Content-Encoding", encoding)
+	return stream
+}
+
+func (s *eventStream) Write(p []byte) (int, error) {
+	if s.compressor == nil {
+		return s.w.Write(p)
+	}
+	start := time.Now()
+	n, err := s.compressor.Write(p)
+	s.stats.bytesIn.Add(int64(n))
+	s.stats.nanos.Add(int64(time.Since(start)))
+	return n, err
+}
+
+// 刷新压缩器和连接，使已写入的内容立即发给客户端；压缩时写连接的错误在此返回
+func (s *eventStream) Flush() error {
+	var err error
+	if s.compressor != nil {
+		start := time.Now()
+		err = s.compressor.Flush()
+		s.stats.nanos.Add(int64(time.Since(start)))
+		s.stats.flushes.Add(1)
+	}
+	s.flusher.Flush()
+	return err
+}
+
+// 写完一条消息后调用：压缩时，不小于刷新阈值的消息立即刷新；小消息与同批的后续消息一起刷新，以减少刷新的开销
+func (s *eventStream) endMessage(size int) {
+	if s.compressor != nil && size >= s.flushSize {
+		s.Flush()
+	}
+}
+
+// 结束压缩流，写出压缩器的结尾
+func (s *eventStream) Close() {
+	if s.compressor == nil {
+		return
+	}
+	s.compressor.Close()
+	s.flusher.Flush()
+}
+
+// 压缩相关的指标
+func writeCompressionMetrics(b *strings.Builder) {
+	var streams, bytesIn, bytesOut, seconds, flushes []string
+	compressionMetrics.Range(func(key, value interface{}) bool {
+		stats := value.(*compressionStats)
+		label := fmt.Sprintf("{encoding=%q}", key)
+		streams = append(streams, fmt.Sprintf("%s %d", label, stats.streams.Load()))
+		bytesIn = append(bytesIn, fmt.Sprintf("%s %d", label, stats.bytesIn.Load()))
+		bytesOut = append(bytesOut, fmt.Sprintf("%s %d", label, stats.out.Load()))
+		seconds = append(seconds, fmt.Sprintf("%s %g", label, time.Duration(stats.nanos.Load()).Seconds()))
+		flushes = append(flushes, fmt.Sprintf("%s %d", label, stats.flushes.Load()))
+		return true
+	})
+	writeMetric(b, "sse_compression_streams_total", "counter", "SSE connections served with the encoding.", streams...)
+	writeMetric(b, "sse_compression_bytes_in_total", "counter", "Bytes written to the compressor before compression.", bytesIn...)
+	writeMetric(b, "sse_compression_bytes_out_total", "counter", "Compressed bytes written to the connections.", bytesOut...)
+	writeMetric(b, "sse_compression_seconds_total", "counter", "Time spent compressing and flushing the compressor.", seconds...)
+	writeMetric(b, "sse_compression_flushes_total", "counter", "Compressor flushes.", flushes...)
+}
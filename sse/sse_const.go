@@ -1,17 +1,37 @@
 package sse
 
-const KEY_CLUSTER_INSTANCE_SET = "sse_cluster_instance_set"
-const KEY_INSTANCE_PREFIX = "sse_instance_"
-const KEY_INSTANCE_DEVICE_SET_PREFIX = "sse_instance_device_set_"
-const KEY_DEVICE_PREFIX = "sse_device_"
-const KEY_USER_DEVICE_SET_PREFIX = "sse_user_device_set_"
-const KEY_FRAME_CACHE_PREFIX = "sse_frame_cache_"
-const KEY_ONLINE_USER_SET = "sse_online_user_set"
+import "time"
+
+const KEY_CLUSTER_INSTANCE_SET = "cluster_instance_set"
+const KEY_CLUSTER_SETTINGS = "cluster_settings"
+const KEY_INSTANCE_PREFIX = "instance_"
+const KEY_INSTANCE_DEVICE_SET_PREFIX = "instance_device_set_"
+const KEY_DEVICE_PREFIX = "device_"
+const KEY_USER_DEVICE_SET_PREFIX = "user_device_set_"
+const KEY_FRAME_CACHE_PREFIX = "frame_cache_"
+const KEY_USER_FRAME_SEQ_PREFIX = "user_frame_seq_" // frame_id_scope=user 时用户的消息帧ID序列
+const KEY_FRAME_COLLAPSE_PREFIX = "frame_collapse_"
+const KEY_FRAME_EVICTED_PREFIX = "frame_evicted_"                 // 因超出缓存大小被挤出帧缓存的消息帧ID，用于续传时判断缺失
+const KEY_USER_FRAME_DEVICE_SET_PREFIX = "user_frame_device_set_" // 用户在线过的设备，用于按用户查找帧缓存，设备下线后仍保留，与帧缓存同时过期
+const KEY_ONLINE_USER_SET = "online_user_set"
+const KEY_ATTR_INDEX_PREFIX = "attr_index_"
+const KEY_TAG_INDEX_PREFIX = "tag_index_"
+const KEY_AUDIT_STREAM = "audit_stream"
+const KEY_EVENT_TYPES = "event_types"             // 接口登记的事件类型
+const KEY_QUARANTINE_STREAM = "quarantine_stream" // 校验失败被隔离的消息
 
 const CMD_SEND_FRAME = "send_frame"
 const CMD_EXTRUDE_OFFLINE = "extrude_offline"
 const CMD_KICK_OFFLINE = "kick_offline"
 const CMD_INSTANCE_CLOSE = "instance_close"
+const CMD_SLOW_CONSUMER = "slow_consumer"
+const CMD_RESYNC = "resync"
+const CMD_REPLAY = "replay" // Data为帧ID范围 from-to，to为0表示不限
+const CMD_DRAIN = "drain"   // 实例级指令，Data为true时排空，false时恢复
+
+// 消息帧ID的分配范围
+const FRAME_ID_SCOPE_DEVICE = "device" // 每台设备各自递增
+const FRAME_ID_SCOPE_USER = "user"     // 同一用户的全部设备共用一个序列，同一消息在各设备上ID相同
 
 const DCR_EXTRUDE_OFFLINE = "extrude_offline"
 const DCR_KICK_OFFLINE = "kick_offline"
@@ -20,18 +40,83 @@ const DCR_INSTANCE_CLEAR = "instance_clear"
 const DCR_HEARTBEAT_FAIL = "heartbeat_fail"
 const DCR_DEVICE_CONNECTED = "device_connected"
 const DCR_DEVICE_DISCONNECT = "device_disconnect"
+const DCR_SLOW_CONSUMER = "slow_consumer"
+
+// 消息内容的传输编码提示
+const PAYLOAD_ENCODING_BASE64 = "base64"
+
+// /events 支持的压缩编码
+const COMPRESSION_GZIP = "gzip"
+const COMPRESSION_BROTLI = "br"
 
 const EVT_SYS_CONNECTED = "sys_connected"
 const EVT_SYS_KICK_OFFLINE = "sys_kick_offline"
 const EVT_SYS_EXTRUDE_OFFLINE = "sys_extrude_offline"
 const EVT_SYS_INSTANCE_CLOSE = "sys_instance_close"
+const EVT_SYS_SLOW_CONSUMER = "sys_slow_consumer"
+const EVT_SYS_RESYNC = "sys_resync"
+const EVT_SYS_GAP = "sys_gap"
+
+const PRIORITY_LOW = -1
+const PRIORITY_NORMAL = 0
+const PRIORITY_HIGH = 1
+
+const OVERFLOW_DROP_OLDEST = "drop_oldest"
+const OVERFLOW_DROP_NEWEST = "drop_newest"
+const OVERFLOW_DISCONNECT = "disconnect"
+
+const BATCH_SEND_MAX_ENTRIES = 50000
+const BATCH_SEND_MAX_BODY_SIZE = 64 << 20 // 批量发送请求体的大小上限
+const SEND_MAX_BODY_SIZE = 64 << 20       // max_payload_size 为0(不限)时 /send 请求体的大小上限
+const SEND_BODY_OVERHEAD = 64 << 10       // /send 请求体中消息内容以外的参数所占的余量
+
+const ACTOR_ANONYMOUS = "anonymous"
+
+const ROLE_ADMIN = "admin"
+
+// 允许跨域请求携带的请求头
+const CORS_ALLOW_HEADERS = "Content-Type, Authorization, X-SSE-Api-Key, X-SSE-Token, X-SSE-Device, X-SSE-ID, X-SSE-Attrs, X-SSE-Tags, Last-Event-ID"
+
+const CORS_ALLOW_METHODS = "GET, POST, OPTIONS"
+
+const ADMIN_USERS_DEFAULT_LIMIT = 50
+const ADMIN_USERS_MAX_LIMIT = 200
+const ADMIN_PRESENCE_BUFFER = 256
+const ADMIN_PRESENCE_HEARTBEAT = 15 * time.Second
+
+const LIST_DEFAULT_LIMIT = 100
+const LIST_MAX_LIMIT = 1000
+const LIST_COUNT_BATCH = 1000     // 计数时每批扫描的数量
+const LIST_SCAN_MAX_BATCHES = 100 // 每页最多扫描的批数，筛选条件很少命中时提前返回游标
+
+const AUDIT_QUERY_DEFAULT_LIMIT = 100
+const AUDIT_QUERY_MAX_LIMIT = 1000
+const AUDIT_MAX_LINE_SIZE = 1024 * 1024 // 审计文件单行的最大字节数
+
+const DEVICE_ATTR_MAX_COUNT = 32
+const DEVICE_ATTR_MAX_LENGTH = 128
+
+const REDIS_HEALTH_CHECK_INTERVAL = 2 * time.Second
+const REDIS_HEALTH_CHECK_TIMEOUT = 1 * time.Second
 
 const PAYLOAD_HEARTBEAT = ":heartbeat"
 
-const TOPIC_USER_ONLINE = "sse_topic_user_online"
-const TOPIC_USER_OFFLINE = "sse_topic_user_offline"
-const TOPIC_DEVICE_ONLINE = "sse_topic_device_online"
-const TOPIC_DEVICE_OFFLINE = "sse_topic_device_offline"
-const TOPIC_INSTANCE_CLOSE = "sse_topic_instance_close"
-const TOPIC_INSTANCE_START = "sse_topic_instance_start"
-const TOPIC_INSTANCE_PREFIX = "sse_topic_instance_"
+const TOPIC_USER_ONLINE = "topic_user_online"
+const TOPIC_USER_OFFLINE = "topic_user_offline"
+const TOPIC_DEVICE_ONLINE = "topic_device_online"
+const TOPIC_DEVICE_OFFLINE = "topic_device_offline"
+const TOPIC_INSTANCE_CLOSE = "topic_instance_close"
+const TOPIC_INSTANCE_START = "topic_instance_start"
+const TOPIC_INSTANCE_PREFIX = "topic_instance_"
+
+// 事件类型登记表
+const EVENT_TYPES_REFRESH = 10 * time.Second // 各实例刷新接口登记的事件类型的间隔
+const EVENT_DEFAULT_NAME = "message"         // 未指定 event 的消息按此名称查找事件类型
+const EVENT_MODE_REJECT = "reject"
+const EVENT_MODE_QUARANTINE = "quarantine"
+const EVENT_UNKNOWN_ALLOW = "allow"
+const EVENT_UNKNOWN_REJECT = "reject"
+const EVENT_SOURCE_CONFIG = "config"
+const EVENT_SOURCE_API = "api"
+const QUARANTINE_DEFAULT_LIMIT = 100
+const QUARANTINE_MAX_LIMIT = 1000
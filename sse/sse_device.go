@@ -4,29 +4,36 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"sse-broker/funcs"
 	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var deviceLogger = funcs.Logger("device")
+
 type Device struct {
-	DeviceID        string `json:"device_id"`
-	DeviceName      string `json:"device_name"`
-	UID             string `json:"uid"`
-	LoginTime       string `json:"login_time"`
-	InstanceAddress string `json:"instance_address"`
-	DeviceAddress   string `json:"device_address"`
-	LastTouchTime   string `json:"last_touch_time"`
-	LastFrameId     int64  `json:"last_frame_id"`
+	DeviceID        string            `json:"device_id"`
+	DeviceName      string            `json:"device_name"`
+	UID             string            `json:"uid"`
+	LoginTime       string            `json:"login_time"`
+	InstanceAddress string            `json:"instance_address"`
+	DeviceAddress   string            `json:"device_address"`
+	AddressChain    []string          `json:"address_chain,omitempty"` // 从客户端到本实例的地址链，含转发头中的地址
+	LastTouchTime   string            `json:"last_touch_time"`
+	LastFrameId     int64             `json:"last_frame_id"`
+	Attrs           map[string]string `json:"attrs,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+
+	queue *deviceQueue // 本实例上该连接的指令队列
 }
 
 func getRedisDevice(deviceID string) *Device {
 	if deviceID == "" {
 		return nil
 	}
-	deviceKey := fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, deviceID)
+	deviceKey := redisKey(KEY_DEVICE_PREFIX, deviceID)
 	info, err := globalRedis.HGetAll(deviceKey)
 	if err != nil {
 		return nil
@@ -34,6 +41,13 @@ func getRedisDevice(deviceID string) *Device {
 	if len(info) == 0 {
 		return nil
 	}
+	device := deviceFromInfo(deviceID, info)
+	deviceLogger.Debug("Get redis device", "uid", device.UID, "device_id", deviceID, "instance", device.InstanceAddress)
+	return device
+}
+
+// 由Redis中的设备记录生成设备
+func deviceFromInfo(deviceID string, info map[string]string) *Device {
 	device := &Device{
 		DeviceID:        deviceID,
 		DeviceName:      info["device"],
@@ -45,17 +59,25 @@ func getRedisDevice(deviceID string) *Device {
 		LastFrameId: func() int64 {
 			id, err := strconv.ParseInt(info["last_frame_id"], 10, 64)
 			if err != nil {
-				log.Printf("Failed to parse last frame id: %v\n", err)
+				deviceLogger.Warn("Failed to parse last frame id", "device_id", deviceID, "error", err)
 				return 0
 			}
 			return id
 		}(),
 	}
-	log.Printf("Get redis device: %v\n", device)
+	if info["attrs"] != "" {
+		json.Unmarshal([]byte(info["attrs"]), &device.Attrs)
+	}
+	if info["tags"] != "" {
+		json.Unmarshal([]byte(info["tags"]), &device.Tags)
+	}
+	if info["address_chain"] != "" {
+		json.Unmarshal([]byte(info["address_chain"]), &device.AddressChain)
+	}
 	return device
 }
 
-func NewDevice(deviceID, deviceName, uid, instanceAddress, deviceAddress string) *Device {
+func NewDevice(deviceID, deviceName, uid, instanceAddress, deviceAddress string, addressChain []string, attrs map[string]string, tags []string) *Device {
 	device := &Device{
 		DeviceID:        deviceID,
 		DeviceName:      deviceName,
@@ -63,16 +85,22 @@ func NewDevice(deviceID, deviceName, uid, instanceAddress, deviceAddress string)
 		LoginTime:       time.Now().Format("2006-01-02 15:04:05"),
 		InstanceAddress: instanceAddress,
 		DeviceAddress:   deviceAddress,
+		AddressChain:    addressChain,
 		LastTouchTime:   time.Now().Format("2006-01-02 15:04:05"),
+		Attrs:           attrs,
+		Tags:            tags,
 	}
+	attrsJson, _ := json.Marshal(attrs)
+	tagsJson, _ := json.Marshal(tags)
+	chainJson, _ := json.Marshal(addressChain)
 	ctx := context.Background()
-	maxOne, err := globalRedis.Client().ZRevRangeWithScores(ctx, fmt.Sprintf("%s%s", KEY_FRAME_CACHE_PREFIX, deviceID), 0, 0).Result()
+	maxOne, err := globalRedis.Client().ZRevRangeWithScores(ctx, redisKey(KEY_FRAME_CACHE_PREFIX, deviceID), 0, 0).Result()
 	if err != nil || len(maxOne) == 0 {
 		device.LastFrameId = 0
 	} else {
 		device.LastFrameId = int64(maxOne[0].Score)
 	}
-	deviceKey := fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, deviceID)
+	deviceKey := redisKey(KEY_DEVICE_PREFIX, deviceID)
 	_, err = globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		pipe.HSet(ctx, deviceKey,
 			"uid", device.UID,
@@ -82,12 +110,15 @@ func NewDevice(deviceID, deviceName, uid, instanceAddress, deviceAddress string)
 			"device_address", device.DeviceAddress,
 			"last_touch_time", device.LastTouchTime,
 			"last_frame_id", device.LastFrameId,
+			"attrs", string(attrsJson),
+			"tags", string(tagsJson),
+			"address_chain", string(chainJson),
 		)
-		pipe.Expire(ctx, deviceKey, globalConfig.SSE.DeviceUserExistDuration)
+		pipe.Expire(ctx, deviceKey, currentConfig().SSE.DeviceUserExistDuration)
 		return nil
 	})
 	if err != nil {
-		log.Printf("Failed to create device: %v\n", err)
+		deviceLogger.Error("Failed to create device", "uid", uid, "device_id", deviceID, "error", err)
 		return nil
 	}
 	return device
@@ -109,20 +140,44 @@ func (d *Device) exist() bool {
 func (d *Device) touch() {
 	d.LastTouchTime = time.Now().Format("2006-01-02 15:04:05")
 	ctx := context.Background()
-	deviceKey := fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, d.DeviceID)
+	deviceKey := redisKey(KEY_DEVICE_PREFIX, d.DeviceID)
 	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		pipe.HSet(ctx, deviceKey, "last_touch_time", d.LastTouchTime)
-		pipe.Expire(ctx, deviceKey, globalConfig.SSE.DeviceUserExistDuration)
+		pipe.Expire(ctx, deviceKey, currentConfig().SSE.DeviceUserExistDuration)
 		return nil
 	})
 	if err != nil {
-		log.Printf("Failed to touch device: %v\n", err)
+		deviceLogger.Warn("Failed to touch device", "device_id", d.DeviceID, "error", err)
+	}
+}
+
+// 设备属性和标签对应的索引键
+func (d *Device) indexKeys() []string {
+	var keys []string
+	for key, value := range d.Attrs {
+		keys = append(keys, attrIndexKey(key, value))
+	}
+	for _, tag := range d.Tags {
+		keys = append(keys, tagIndexKey(tag))
 	}
+	return keys
 }
 
 // 当前设备主动上线
-func (d *Device) online() {
-	globalInstance.addDevice(d)
+func (d *Device) online() error {
+	if err := globalInstance.addDevice(d); err != nil {
+		return err
+	}
+	if keys := d.indexKeys(); len(keys) > 0 {
+		ctx := context.Background()
+		pipe := globalRedis.Pipeline()
+		for _, key := range keys {
+			pipe.SAdd(ctx, key, d.DeviceID)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			deviceLogger.Error("Failed to index device attributes", "device_id", d.DeviceID, "error", err)
+		}
+	}
 	DispatchDeviceOnline(StateChange{
 		Device:      d.DeviceName,
 		UID:         d.UID,
@@ -130,19 +185,42 @@ func (d *Device) online() {
 		Reason:      DCR_DEVICE_CONNECTED,
 		Payload:     globalInstance.Address,
 	})
+	return nil
+}
+
+// 设备记录是否已被其他实例上的新连接改写
+func (d *Device) takenOver() bool {
+	instanceAddress, err := globalRedis.HGet(redisKey(KEY_DEVICE_PREFIX, d.DeviceID), "instance_address")
+	if err != nil {
+		return false
+	}
+	return instanceAddress != "" && instanceAddress != d.InstanceAddress
 }
 
-func (d *Device) offline(reason string, payload string) {
-	// 关闭设备的指令通道
-	if channel, ok := deviceChannels.LoadAndDelete(d.DeviceID); ok {
-		inschan, ok := channel.(chan Instruction)
-		if ok {
-			log.Printf("Close channel for device %s\n", d.DeviceID)
-			close(inschan)
+// 设备下线；同一设备已有新的连接(被挤下线)时，保留新连接的索引及用户设备集合，返回false，调用方不再处理用户下线
+func (d *Device) offline(reason string, payload string) bool {
+	// 关闭设备的指令队列；同一设备可能已在本实例重新连接，只删除属于本连接的队列
+	if d.queue != nil {
+		if deviceChannels.CompareAndDelete(d.DeviceID, d.queue) {
+			deviceLogger.Debug("Close device queue", "device_id", d.DeviceID)
 		}
+		d.queue.close()
 	}
 	// 删除本地实例中的设备
-	globalInstance.delDevice(d)
+	current := globalInstance.delDevice(d) && !d.takenOver()
+	if !current {
+		deviceLogger.Debug("Device taken over by a new connection", "device_id", d.DeviceID)
+	}
+	if keys := d.indexKeys(); current && len(keys) > 0 {
+		ctx := context.Background()
+		pipe := globalRedis.Pipeline()
+		for _, key := range keys {
+			pipe.SRem(ctx, key, d.DeviceID)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			deviceLogger.Error("Failed to remove device attribute index", "device_id", d.DeviceID, "error", err)
+		}
+	}
 
 	DispatchDeviceOffline(StateChange{
 		Device:      d.DeviceName,
@@ -151,58 +229,261 @@ func (d *Device) offline(reason string, payload string) {
 		Reason:      reason,
 		Payload:     payload,
 	})
+	return current
+}
+
+// 删除设备的帧缓存，返回是否确有帧缓存被删除
+func (d *Device) delFrameCache() (bool, error) {
+	ctx := context.Background()
+	var deleted *redis.IntCmd
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, redisKey(KEY_FRAME_CACHE_PREFIX, d.DeviceID))
+		pipe.Del(ctx, redisKey(KEY_FRAME_COLLAPSE_PREFIX, d.DeviceID))
+		pipe.Del(ctx, redisKey(KEY_FRAME_EVICTED_PREFIX, d.DeviceID))
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	// 用户名下的帧缓存索引以uid为hash tag，与设备的键不在同一个slot，单独更新
+	if d.UID != "" {
+		if _, err := globalRedis.SRem(redisKey(KEY_USER_FRAME_DEVICE_SET_PREFIX, d.UID), d.DeviceID); err != nil {
+			return false, err
+		}
+	}
+	return deleted.Val() > 0, nil
+}
+
+// 读取帧缓存中ID在[fromId, toId]内的消息帧，toId为0时不限上限；不过滤已过期的帧
+func (d *Device) getFrameRange(fromId int64, toId int64) ([]Frame, error) {
+	max := "+inf"
+	if toId > 0 {
+		max = strconv.FormatInt(toId, 10)
+	}
+	results, err := globalRedis.ZRangeByScore(redisKey(KEY_FRAME_CACHE_PREFIX, d.DeviceID), strconv.FormatInt(fromId, 10), max)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]Frame, 0, len(results))
+	for _, result := range results {
+		frame := Frame{}
+		if err := json.Unmarshal([]byte(result), &frame); err == nil {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+// 删除帧缓存中指定ID的消息帧，并清理指向这些帧的合并键，返回删除的数量
+func (d *Device) delFrames(ids []int64) (int64, error) {
+	ctx := context.Background()
+	cacheKey := redisKey(KEY_FRAME_CACHE_PREFIX, d.DeviceID)
+	collapseKey := redisKey(KEY_FRAME_COLLAPSE_PREFIX, d.DeviceID)
+	collapsed, err := globalRedis.HGetAll(collapseKey)
+	if err != nil {
+		return 0, err
+	}
+	targets := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		targets[strconv.FormatInt(id, 10)] = true
+	}
+	cmds, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for id := range targets {
+			pipe.ZRemRangeByScore(ctx, cacheKey, id, id)
+		}
+		for key, id := range collapsed {
+			if targets[id] {
+				pipe.HDel(ctx, collapseKey, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, cmd := range cmds {
+		if zrem, ok := cmd.(*redis.IntCmd); ok && cmd.Name() == "zremrangebyscore" {
+			removed += zrem.Val()
+		}
+	}
+	return removed, nil
+}
 
+// 检查续传的消息帧ID之后是否有发给本设备的消息帧已被挤出帧缓存，返回缺失的ID范围及数量
+// 只按本设备实际被挤出的帧判断，frame_id_scope=user 时ID不连续也不会误报；
+// 过期、合并键替换或手动删除的帧是有意丢弃的，不计入
+func (d *Device) getFrameGap(lastEventID int64) (FrameGap, bool) {
+	if lastEventID <= 0 {
+		return FrameGap{}, false
+	}
+	ctx := context.Background()
+	evictedKey := redisKey(KEY_FRAME_EVICTED_PREFIX, d.DeviceID)
+	var evicted *redis.ZSliceCmd
+	var total *redis.IntCmd
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		evicted = pipe.ZRangeByScoreWithScores(ctx, evictedKey, &redis.ZRangeBy{
+			Min: "(" + strconv.FormatInt(lastEventID, 10),
+			Max: "+inf",
+		})
+		total = pipe.ZCard(ctx, evictedKey)
+		return nil
+	})
+	if err != nil || len(evicted.Val()) == 0 {
+		return FrameGap{}, false
+	}
+	ids := evicted.Val()
+	gap := FrameGap{
+		LastEventID: lastEventID,
+		From:        int64(ids[0].Score),
+		To:          int64(ids[len(ids)-1].Score),
+		Lost:        int64(len(ids)),
+	}
+	// 记录已满且续传ID早于其中最早的一帧时，更早被挤出的帧已不在记录中
+	if total.Val() >= int64(frameEvictedLimit()) && len(ids) == int(total.Val()) {
+		gap.From = lastEventID + 1
+	}
+	return gap, true
 }
 
-func (d *Device) delFrameCache() {
-	globalRedis.Del(fmt.Sprintf("%s%s", KEY_FRAME_CACHE_PREFIX, d.DeviceID))
+// 被挤出帧ID的记录上限，与帧缓存大小相同
+func frameEvictedLimit() int {
+	return currentConfig().SSE.DeviceFrameCacheSize
+}
+
+// 记录被挤出帧缓存的消息帧ID
+func (d *Device) recordEvictedFrames(frames []redis.Z) {
+	ctx := context.Background()
+	evictedKey := redisKey(KEY_FRAME_EVICTED_PREFIX, d.DeviceID)
+	members := make([]redis.Z, len(frames))
+	for i, frame := range frames {
+		members[i] = redis.Z{Score: frame.Score, Member: int64(frame.Score)}
+	}
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, evictedKey, members...)
+		pipe.ZRemRangeByRank(ctx, evictedKey, 0, -int64(frameEvictedLimit()+1))
+		pipe.Expire(ctx, evictedKey, currentConfig().SSE.DeviceFrameExpireDuration)
+		return nil
+	})
+	if err != nil {
+		deviceLogger.Warn("Failed to record evicted frames", "device_id", d.DeviceID, "error", err)
+	}
 }
 
 func (d *Device) getCachedFrames(lastEventID int64) []Frame {
 	var frames []Frame
-	if globalConfig.SSE.DeviceFrameCacheSize <= 0 {
+	if currentConfig().SSE.DeviceFrameCacheSize <= 0 {
 		return frames
 	}
-	results, err := globalRedis.ZRangeByScore(fmt.Sprintf("%s%s", KEY_FRAME_CACHE_PREFIX, d.DeviceID), fmt.Sprintf("%f", float64(lastEventID+1)), "+inf")
+	cacheKey := redisKey(KEY_FRAME_CACHE_PREFIX, d.DeviceID)
+	results, err := globalRedis.ZRangeByScore(cacheKey, fmt.Sprintf("%f", float64(lastEventID+1)), "+inf")
 	if err != nil {
 		return frames
 	}
+	var expiredMembers []interface{}
 	for _, result := range results {
 		frame := Frame{}
 		json.Unmarshal([]byte(result), &frame)
+		// 跳过已过期的消息帧，避免重连时补发过时的消息
+		if frame.expired() {
+			expiredMembers = append(expiredMembers, result)
+			continue
+		}
 		frames = append(frames, frame)
 	}
+	if len(expiredMembers) > 0 {
+		if err := globalRedis.ZRem(cacheKey, expiredMembers...); err != nil {
+			deviceLogger.Warn("Failed to remove expired frames", "device_id", d.DeviceID, "error", err)
+		}
+	}
 	return frames
 }
 
-func (d *Device) addFrame(event string, data string) Frame {
-	frameId, err := globalRedis.HIncrBy(fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, d.DeviceID), "last_frame_id", 1)
+// 取得消息帧ID：发送时已按用户分配的直接使用；否则 frame_id_scope=user 时从用户序列分配，
+// 保证同一用户只有一个ID来源，其余情况由设备记录递增
+func (d *Device) nextFrameId(instruction *Instruction) (int64, error) {
+	deviceKey := redisKey(KEY_DEVICE_PREFIX, d.DeviceID)
+	if instruction.FrameID <= 0 {
+		if currentConfig().SSE.FrameIDScope != FRAME_ID_SCOPE_USER || d.UID == "" {
+			return globalRedis.HIncrBy(deviceKey, "last_frame_id", 1)
+		}
+		starts, err := reserveUserFrameIds(map[string]int64{d.UID: 1})
+		if err != nil {
+			return 0, err
+		}
+		instruction.FrameID = starts[d.UID]
+	}
+	// 并发发送时ID可能乱序到达，设备记录只保留最大值
+	if instruction.FrameID > d.LastFrameId {
+		if err := globalRedis.HSet(deviceKey, "last_frame_id", instruction.FrameID); err != nil {
+			deviceLogger.Warn("Failed to save last frame id", "device_id", d.DeviceID, "error", err)
+		}
+	}
+	return instruction.FrameID, nil
+}
+
+func (d *Device) addFrame(instruction *Instruction) Frame {
+	frameId, err := d.nextFrameId(instruction)
 	if err != nil {
-		log.Printf("Failed to get next frame id: %v\n", err)
+		deviceLogger.Error("Failed to get next frame id", "device_id", d.DeviceID, "error", err)
 		return Frame{
-			ID:    d.LastFrameId + 1,
-			Event: event,
-			Data:  data,
+			ID:          d.LastFrameId + 1,
+			Event:       instruction.Event,
+			Data:        instruction.Data,
+			ExpiresAt:   instruction.ExpiresAt,
+			CollapseKey: instruction.CollapseKey,
+			Time:        time.Now().UnixMilli(),
+			ContentType: instruction.ContentType,
+			Encoding:    instruction.Encoding,
 		}
 	}
-	d.LastFrameId = frameId
+	if frameId > d.LastFrameId {
+		d.LastFrameId = frameId
+	}
 	frame := Frame{
-		ID:    frameId,
-		Event: event,
-		Data:  data,
+		ID:          frameId,
+		Event:       instruction.Event,
+		Data:        instruction.Data,
+		ExpiresAt:   instruction.ExpiresAt,
+		CollapseKey: instruction.CollapseKey,
+		Time:        time.Now().UnixMilli(),
+		ContentType: instruction.ContentType,
+		Encoding:    instruction.Encoding,
 	}
-	if globalConfig.SSE.DeviceFrameCacheSize > 0 {
+	// 超过大小上限的消息不进入帧缓存(正常情况下在发送和分发时已被拒绝)
+	if err := checkPayloadSize(len(frame.Data)); err != nil {
+		deviceLogger.Warn("Frame not cached", "device_id", d.DeviceID, "frame_id", frame.ID, "error", err)
+	} else if currentConfig().SSE.DeviceFrameCacheSize > 0 {
 		ctx := context.Background()
-		stop := -int64(globalConfig.SSE.DeviceFrameCacheSize + 1)
-		cacheKey := fmt.Sprintf("%s%s", KEY_FRAME_CACHE_PREFIX, d.DeviceID)
+		stop := -int64(currentConfig().SSE.DeviceFrameCacheSize + 1)
+		cacheKey := redisKey(KEY_FRAME_CACHE_PREFIX, d.DeviceID)
+		collapseKey := redisKey(KEY_FRAME_COLLAPSE_PREFIX, d.DeviceID)
+		// 同一合并键只缓存最新一帧，重连时不再补发过时的状态
+		var collapsedId string
+		if frame.CollapseKey != "" {
+			collapsedId, _ = globalRedis.HGet(collapseKey, frame.CollapseKey)
+		}
+		var evicted *redis.ZSliceCmd
 		_, err = globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if collapsedId != "" {
+				pipe.ZRemRangeByScore(ctx, cacheKey, collapsedId, collapsedId)
+			}
 			pipe.ZAdd(ctx, cacheKey, redis.Z{Score: float64(frame.ID), Member: frame.String()})
+			// 事务内先取出即将被挤出的帧，再按大小裁剪
+			evicted = pipe.ZRangeWithScores(ctx, cacheKey, 0, stop)
 			pipe.ZRemRangeByRank(ctx, cacheKey, 0, stop)
-			pipe.Expire(ctx, cacheKey, globalConfig.SSE.DeviceFrameExpireDuration)
+			pipe.Expire(ctx, cacheKey, currentConfig().SSE.DeviceFrameExpireDuration)
+			pipe.Expire(ctx, redisKey(KEY_FRAME_EVICTED_PREFIX, d.DeviceID), currentConfig().SSE.DeviceFrameExpireDuration)
+			if frame.CollapseKey != "" {
+				pipe.HSet(ctx, collapseKey, frame.CollapseKey, frame.ID)
+				pipe.Expire(ctx, collapseKey, currentConfig().SSE.DeviceFrameExpireDuration)
+			}
 			return nil
 		})
 		if err != nil {
-			log.Printf("Failed to cache frame: %v\n", err)
+			deviceLogger.Error("Failed to cache frame", "device_id", d.DeviceID, "frame_id", frame.ID, "error", err)
+		} else if len(evicted.Val()) > 0 {
+			d.recordEvictedFrames(evicted.Val())
 		}
 	}
 	return frame
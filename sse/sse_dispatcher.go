@@ -2,10 +2,11 @@ package sse
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"sse-broker/funcs"
 )
 
+var dispatcherLogger = funcs.Logger("dispatcher")
+
 func dispatchInstructionBatch(channel string, instructions []Instruction) {
 	ctx := context.Background()
 	pipe := globalRedis.Pipeline()
@@ -14,17 +15,17 @@ func dispatchInstructionBatch(channel string, instructions []Instruction) {
 	}
 	_, err := pipe.Exec(ctx)
 	if err != nil {
-		log.Printf("Failed to dispatch instruction batch: %v\n", err)
+		dispatcherLogger.Error("Failed to dispatch instruction batch", "channel", channel, "count", len(instructions), "error", err)
 	}
 }
 
 func DispatchInstruction(instanceAddress string, instruction Instruction) {
-	channel := fmt.Sprintf("%s%s", TOPIC_INSTANCE_PREFIX, instanceAddress)
+	channel := redisTopic(TOPIC_INSTANCE_PREFIX, instanceAddress)
 	globalRedis.Publish(channel, instruction.String())
 }
 
 func DispatchInstructions(instanceAddress string, instructions []Instruction) {
-	channel := fmt.Sprintf("%s%s", TOPIC_INSTANCE_PREFIX, instanceAddress)
+	channel := redisTopic(TOPIC_INSTANCE_PREFIX, instanceAddress)
 	if len(instructions) == 1 {
 		instruction := instructions[0]
 		globalRedis.Publish(channel, instruction.String())
@@ -41,17 +42,17 @@ func DispatchInstructions(instanceAddress string, instructions []Instruction) {
 }
 
 func DispatchDeviceOnline(change StateChange) {
-	globalRedis.Publish(TOPIC_DEVICE_ONLINE, change.String())
+	globalRedis.Publish(redisTopic(TOPIC_DEVICE_ONLINE, ""), change.String())
 }
 
 func DispatchDeviceOffline(change StateChange) {
-	globalRedis.Publish(TOPIC_DEVICE_OFFLINE, change.String())
+	globalRedis.Publish(redisTopic(TOPIC_DEVICE_OFFLINE, ""), change.String())
 }
 
 func DispatchUserOnline(change StateChange) {
-	globalRedis.Publish(TOPIC_USER_ONLINE, change.String())
+	globalRedis.Publish(redisTopic(TOPIC_USER_ONLINE, ""), change.String())
 }
 
 func DispatchUserOffline(change StateChange) {
-	globalRedis.Publish(TOPIC_USER_OFFLINE, change.String())
+	globalRedis.Publish(redisTopic(TOPIC_USER_OFFLINE, ""), change.String())
 }
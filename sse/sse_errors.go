@@ -0,0 +1,76 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// BrokerError 接口错误：Code为机器可读的错误码，Status为对应的HTTP状态码
+type BrokerError struct {
+	Code   string `json:"code"`
+	Status int    `json:"status"`
+	Msg    string `json:"msg"`
+}
+
+func (e *BrokerError) Error() string {
+	return e.Msg
+}
+
+// 基于目录中的错误生成带具体描述的错误
+func (e *BrokerError) with(format string, args ...interface{}) *BrokerError {
+	return &BrokerError{
+		Code:   e.Code,
+		Status: e.Status,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+// 错误码目录
+var (
+	ErrInvalidParams        = &BrokerError{Code: "invalid_params", Status: http.StatusBadRequest, Msg: "Invalid parameters"}
+	ErrInvalidFilter        = &BrokerError{Code: "invalid_filter", Status: http.StatusBadRequest, Msg: "Invalid device filter expression"}
+	ErrMessageExpired       = &BrokerError{Code: "message_expired", Status: http.StatusBadRequest, Msg: "Message already expired"}
+	ErrPayloadTooLarge      = &BrokerError{Code: "payload_too_large", Status: http.StatusRequestEntityTooLarge, Msg: "Message data is too large"}
+	ErrInvalidPayload       = &BrokerError{Code: "invalid_payload", Status: http.StatusUnprocessableEntity, Msg: "Message data does not match the event schema"}
+	ErrPayloadQuarantined   = &BrokerError{Code: "payload_quarantined", Status: http.StatusUnprocessableEntity, Msg: "Message data does not match the event schema and was quarantined"}
+	ErrUnauthorized         = &BrokerError{Code: "unauthorized", Status: http.StatusUnauthorized, Msg: "Token and device are required"}
+	ErrInvalidToken         = &BrokerError{Code: "invalid_token", Status: http.StatusUnauthorized, Msg: "Invalid token"}
+	ErrInvalidDevice        = &BrokerError{Code: "invalid_device", Status: http.StatusUnauthorized, Msg: "Device does not match the token"}
+	ErrInvalidApiKey        = &BrokerError{Code: "invalid_api_key", Status: http.StatusUnauthorized, Msg: "Missing or invalid API key"}
+	ErrAdminRequired        = &BrokerError{Code: "admin_required", Status: http.StatusForbidden, Msg: "An API key with role admin is required"}
+	ErrAdminDisabled        = &BrokerError{Code: "admin_disabled", Status: http.StatusForbidden, Msg: "Admin APIs are disabled, configure an API key with role admin"}
+	ErrOriginNotAllowed     = &BrokerError{Code: "origin_not_allowed", Status: http.StatusForbidden, Msg: "Origin not allowed"}
+	ErrEventNotAllowed      = &BrokerError{Code: "event_not_allowed", Status: http.StatusForbidden, Msg: "Event type not allowed"}
+	ErrMethodNotAllowed     = &BrokerError{Code: "method_not_allowed", Status: http.StatusMethodNotAllowed, Msg: "Method not allowed"}
+	ErrUnsupportedMediaType = &BrokerError{Code: "unsupported_media_type", Status: http.StatusUnsupportedMediaType, Msg: "Unsupported media type"}
+	ErrInvalidConfig        = &BrokerError{Code: "invalid_config", Status: http.StatusInternalServerError, Msg: "Invalid configuration"}
+	ErrInternal             = &BrokerError{Code: "internal_error", Status: http.StatusInternalServerError, Msg: "Internal error"}
+	ErrStreamingUnsupported = &BrokerError{Code: "streaming_unsupported", Status: http.StatusInternalServerError, Msg: "Streaming unsupported"}
+	ErrRedisUnavailable     = &BrokerError{Code: "redis_unavailable", Status: http.StatusServiceUnavailable, Msg: "Redis is temporarily unavailable"}
+	ErrDraining             = &BrokerError{Code: "draining", Status: http.StatusServiceUnavailable, Msg: "Instance is draining, connect to another instance"}
+)
+
+// 全部错误码，供 /errors 接口输出
+var errorCatalog = []*BrokerError{
+	ErrInvalidParams,
+	ErrInvalidFilter,
+	ErrMessageExpired,
+	ErrPayloadTooLarge,
+	ErrInvalidPayload,
+	ErrPayloadQuarantined,
+	ErrUnauthorized,
+	ErrInvalidToken,
+	ErrInvalidDevice,
+	ErrInvalidApiKey,
+	ErrAdminRequired,
+	ErrAdminDisabled,
+	ErrOriginNotAllowed,
+	ErrEventNotAllowed,
+	ErrMethodNotAllowed,
+	ErrUnsupportedMediaType,
+	ErrInvalidConfig,
+	ErrInternal,
+	ErrStreamingUnsupported,
+	ErrRedisUnavailable,
+	ErrDraining,
+}
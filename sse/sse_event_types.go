@@ -0,0 +1,273 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"sort"
+	"sse-broker/funcs"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 登记的事件类型：按 event 名称校验消息内容，并限制可发布的调用方
+type EventType struct {
+	Name       string          `json:"name"`
+	Schema     json.RawMessage `json:"schema,omitempty"`     // JSON Schema，为空时不校验内容
+	Publishers []string        `json:"publishers,omitempty"` // 可发布的API密钥名称，为空时不限
+	Mode       string          `json:"mode,omitempty"`       // 校验失败时的处理，为空时使用 events.mode
+	Source     string          `json:"source"`               // config 或 api
+	UpdatedBy  string          `json:"updated_by,omitempty"`
+	UpdatedAt  string          `json:"updated_at,omitempty"`
+
+	schema *funcs.Schema
+}
+
+// 编译事件类型的Schema
+func (t *EventType) compile() error {
+	t.schema = nil
+	if len(t.Schema) == 0 {
+		return nil
+	}
+	schema, err := funcs.CompileSchema(t.Schema)
+	if err != nil {
+		return err
+	}
+	t.schema = schema
+	t.Schema = schema.Raw
+	return nil
+}
+
+func (t *EventType) allowPublisher(actor string) bool {
+	if len(t.Publishers) == 0 {
+		return true
+	}
+	for _, publisher := range t.Publishers {
+		if publisher == actor {
+			return true
+		}
+	}
+	return false
+}
+
+// 事件类型登记表：配置文件中的类型优先，接口登记的类型保存在Redis中，各实例定期刷新
+type eventRegistry struct {
+	mu       sync.RWMutex
+	config   map[string]*EventType
+	dynamic  map[string]*EventType
+	loadedAt time.Time
+}
+
+var eventTypes = &eventRegistry{}
+
+// 配置加载或热加载后更新配置文件中的类型
+func (r *eventRegistry) setConfigTypes(types []EventType) {
+	config := make(map[string]*EventType, len(types))
+	for i := range types {
+		eventType := types[i]
+		eventType.Source = EVENT_SOURCE_CONFIG
+		if err := eventType.compile(); err != nil {
+			// 配置在加载时已校验，这里只可能是代码错误
+			instanceLogger.Error("Invalid event schema", "event", eventType.Name, "error", err)
+			continue
+		}
+		config[eventType.Name] = &eventType
+	}
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+}
+
+// 从Redis重新加载接口登记的类型；force为false时只在超过刷新间隔后加载，Redis不可用时保留原有数据
+func (r *eventRegistry) refresh(force bool) error {
+	r.mu.RLock()
+	fresh := time.Since(r.loadedAt) < EVENT_TYPES_REFRESH
+	r.mu.RUnlock()
+	if fresh && !force {
+		return nil
+	}
+	values, err := globalRedis.HGetAll(redisKey(KEY_EVENT_TYPES, ""))
+	if err != nil {
+		// 失败后同样等待一个刷新间隔再重试
+		r.mu.Lock()
+		r.loadedAt = time.Now()
+		r.mu.Unlock()
+		return ErrRedisUnavailable.with("Failed to load event types: %s", err.Error())
+	}
+	dynamic := make(map[string]*EventType, len(values))
+	for name, value := range values {
+		eventType := &EventType{}
+		if err := json.Unmarshal([]byte(value), eventType); err != nil {
+			instanceLogger.Warn("Invalid event type in redis", "event", name, "error", err)
+			continue
+		}
+		if err := eventType.compile(); err != nil {
+			instanceLogger.Warn("Invalid event schema in redis", "event", name, "error", err)
+			continue
+		}
+		eventType.Source = EVENT_SOURCE_API
+		dynamic[name] = eventType
+	}
+	r.mu.Lock()
+	r.dynamic = dynamic
+	r.loadedAt = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *eventRegistry) lookup(name string) *EventType {
+	if err := r.refresh(false); err != nil {
+		instanceLogger.Warn("Use cached event types", "error", err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if eventType, ok := r.config[name]; ok {
+		return eventType
+	}
+	return r.dynamic[name]
+}
+
+func (r *eventRegistry) isConfigType(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.config[name]
+	return ok
+}
+
+// 全部事件类型，按名称排序；与配置重名的接口登记类型不生效，不列出
+func (r *eventRegistry) list() []EventType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]EventType, 0, len(r.config)+len(r.dynamic))
+	for _, eventType := range r.config {
+		types = append(types, *eventType)
+	}
+	for name, eventType := range r.dynamic {
+		if _, ok := r.config[name]; !ok {
+			types = append(types, *eventType)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// 校验消息内容：JSON值或声明为 application/json 的字符串按JSON校验，其他内容作为JSON字符串校验
+func validatePayload(schema *funcs.Schema, p *SendFrameParams, instruction *Instruction) error {
+	mediaType, _, _ := mime.ParseMediaType(instruction.ContentType)
+	if p.Data.IsJSON || (mediaType == "application/json" && instruction.Encoding == "") {
+		return schema.ValidateJSON([]byte(instruction.Data))
+	}
+	return schema.Validate(instruction.Data)
+}
+
+// 按事件类型检查一条消息：调用方是否可发布、内容是否符合Schema；不符合时按模式拒绝或隔离
+func checkEventType(actor string, p *SendFrameParams, instruction *Instruction) error {
+	name := p.Event
+	if name == "" {
+		name = EVENT_DEFAULT_NAME
+	}
+	eventType := eventTypes.lookup(name)
+	if eventType == nil {
+		if currentConfig().Events.Unknown == EVENT_UNKNOWN_REJECT {
+			return ErrEventNotAllowed.with("event %q is not registered", name)
+		}
+		return nil
+	}
+	if !eventType.allowPublisher(actor) {
+		return ErrEventNotAllowed.with("%s is not allowed to publish event %q", actor, name)
+	}
+	if eventType.schema == nil {
+		return nil
+	}
+	err := validatePayload(eventType.schema, p, instruction)
+	if err == nil {
+		return nil
+	}
+	mode := eventType.Mode
+	if mode == "" {
+		mode = currentConfig().Events.Mode
+	}
+	if mode == EVENT_MODE_QUARANTINE {
+		metrics.payloadQuarantined.Add(1)
+		id, qerr := quarantinePayload(actor, name, p, instruction, err)
+		if qerr != nil {
+			apiLogger.Error("Failed to quarantine message", "event", name, "error", qerr)
+			return ErrInvalidPayload.with("data does not match the schema of event %q: %s", name, err.Error())
+		}
+		return ErrPayloadQuarantined.with("data does not match the schema of event %q, quarantined as %s: %s", name, id, err.Error())
+	}
+	metrics.payloadRejected.Add(1)
+	return ErrInvalidPayload.with("data does not match the schema of event %q: %s", name, err.Error())
+}
+
+// 隔离的消息
+type QuarantineRecord struct {
+	ID          string `json:"id"`
+	Time        int64  `json:"time"` // unix毫秒
+	Actor       string `json:"actor"`
+	Event       string `json:"event"`
+	Target      string `json:"target"`
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Data        string `json:"data"`
+	Error       string `json:"error"`
+}
+
+// 将校验失败的消息写入隔离区(Redis Stream)，返回记录ID
+func quarantinePayload(actor string, name string, p *SendFrameParams, instruction *Instruction, reason error) (string, error) {
+	return globalRedis.Client().XAdd(context.Background(), &redis.XAddArgs{
+		Stream: redisKey(KEY_QUARANTINE_STREAM, ""),
+		MaxLen: currentConfig().Events.QuarantineMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"time":         time.Now().UnixMilli(),
+			"actor":        actor,
+			"event":        name,
+			"target":       auditTarget(p.UID, p.Device, p.Filter),
+			"content_type": instruction.ContentType,
+			"encoding":     instruction.Encoding,
+			"data":         instruction.Data,
+			"error":        reason.Error(),
+		},
+	}).Result()
+}
+
+// 读取隔离区中最新的记录，event 不为空时只返回该事件
+func queryQuarantine(event string, limit int) ([]QuarantineRecord, error) {
+	records := make([]QuarantineRecord, 0, limit)
+	end := "+"
+	for len(records) < limit {
+		messages, err := globalRedis.Client().XRevRangeN(context.Background(), redisKey(KEY_QUARANTINE_STREAM, ""), end, "-", int64(limit)).Result()
+		if err != nil {
+			return nil, ErrRedisUnavailable.with("Failed to read quarantine: %s", err.Error())
+		}
+		for _, message := range messages {
+			end = "(" + message.ID
+			record := QuarantineRecord{ID: message.ID}
+			record.Event, _ = message.Values["event"].(string)
+			if event != "" && record.Event != event {
+				continue
+			}
+			if value, ok := message.Values["time"].(string); ok {
+				record.Time, _ = strconv.ParseInt(value, 10, 64)
+			}
+			record.Actor, _ = message.Values["actor"].(string)
+			record.Target, _ = message.Values["target"].(string)
+			record.ContentType, _ = message.Values["content_type"].(string)
+			record.Encoding, _ = message.Values["encoding"].(string)
+			record.Data, _ = message.Values["data"].(string)
+			record.Error, _ = message.Values["error"].(string)
+			records = append(records, record)
+			if len(records) >= limit {
+				break
+			}
+		}
+		if len(messages) < limit {
+			break
+		}
+	}
+	return records, nil
+}
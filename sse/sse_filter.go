@@ -0,0 +1,312 @@
+package sse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 设备筛选表达式，例如：platform=ios AND app_version>=3.2 OR tag:beta
+//
+//	expr  := and ( OR and )*
+//	and   := unary ( AND unary )*
+//	unary := NOT unary | ( expr ) | term
+//	term  := tag:NAME | KEY OP VALUE,  OP: = == != >= <= > <
+type deviceFilter interface {
+	match(attrs map[string]string, tags []string) bool
+	// 可用于缩小候选集的Redis索引键，没有则返回空串
+	indexKey() string
+}
+
+type filterAnd struct{ left, right deviceFilter }
+type filterOr struct{ left, right deviceFilter }
+type filterNot struct{ inner deviceFilter }
+type filterTag struct{ tag string }
+type filterCompare struct{ key, op, value string }
+
+func (f *filterAnd) match(attrs map[string]string, tags []string) bool {
+	return f.left.match(attrs, tags) && f.right.match(attrs, tags)
+}
+
+func (f *filterAnd) indexKey() string {
+	if key := f.left.indexKey(); key != "" {
+		return key
+	}
+	return f.right.indexKey()
+}
+
+func (f *filterOr) match(attrs map[string]string, tags []string) bool {
+	return f.left.match(attrs, tags) || f.right.match(attrs, tags)
+}
+
+func (f *filterOr) indexKey() string {
+	return ""
+}
+
+func (f *filterNot) match(attrs map[string]string, tags []string) bool {
+	return !f.inner.match(attrs, tags)
+}
+
+func (f *filterNot) indexKey() string {
+	return ""
+}
+
+func (f *filterTag) match(attrs map[string]string, tags []string) bool {
+	for _, tag := range tags {
+		if tag == f.tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filterTag) indexKey() string {
+	return tagIndexKey(f.tag)
+}
+
+func (f *filterCompare) match(attrs map[string]string, tags []string) bool {
+	value, ok := attrs[f.key]
+	if !ok {
+		return f.op == "!="
+	}
+	switch f.op {
+	case "=":
+		return value == f.value
+	case "!=":
+		return value != f.value
+	case ">":
+		return compareAttrValue(value, f.value) > 0
+	case ">=":
+		return compareAttrValue(value, f.value) >= 0
+	case "<":
+		return compareAttrValue(value, f.value) < 0
+	case "<=":
+		return compareAttrValue(value, f.value) <= 0
+	}
+	return false
+}
+
+func (f *filterCompare) indexKey() string {
+	if f.op == "=" {
+		return attrIndexKey(f.key, f.value)
+	}
+	return ""
+}
+
+func attrIndexKey(key string, value string) string {
+	return redisKey(KEY_ATTR_INDEX_PREFIX, key+"="+value)
+}
+
+func tagIndexKey(tag string) string {
+	return redisKey(KEY_TAG_INDEX_PREFIX, tag)
+}
+
+// 比较属性值：两边都是版本号(数字和点)时逐段按数值比较，否则按字符串比较
+func compareAttrValue(a string, b string) int {
+	as, aok := parseVersion(a)
+	bs, bok := parseVersion(b)
+	if !aok || !bok {
+		return strings.Compare(a, b)
+	}
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int64
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(value string) ([]int64, bool) {
+	if value == "" {
+		return nil, false
+	}
+	parts := strings.Split(value, ".")
+	segments := make([]int64, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		segments[i] = n
+	}
+	return segments, true
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// 解析设备筛选表达式，空表达式返回nil
+func parseDeviceFilter(expr string) (deviceFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %q in filter", p.tokens[p.pos])
+	}
+	return filter, nil
+}
+
+func isFilterOperator(r rune) bool {
+	return r == '=' || r == '!' || r == '<' || r == '>'
+}
+
+func tokenizeFilter(expr string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("invalid operator %q in filter", string(r))
+			}
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case isFilterOperator(r):
+			j := i + 1
+			for j < len(runes) && runes[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			// 以引号开头，便于与关键字区分
+			tokens = append(tokens, string(runes[i:j]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && !isFilterOperator(runes[j]) &&
+				runes[j] != '(' && runes[j] != ')' && runes[j] != '&' && runes[j] != '|' {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) parseOr() (deviceFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for token := p.peek(); strings.EqualFold(token, "OR") || token == "||"; token = p.peek() {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (deviceFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for token := p.peek(); strings.EqualFold(token, "AND") || token == "&&"; token = p.peek() {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (deviceFilter, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case strings.EqualFold(token, "NOT") || token == "!":
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{inner: inner}, nil
+	case token == "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	case strings.HasPrefix(strings.ToLower(token), "tag:"):
+		tag := token[4:]
+		if tag == "" {
+			return nil, fmt.Errorf("empty tag in filter")
+		}
+		return &filterTag{tag: tag}, nil
+	}
+	key := token
+	op := p.next()
+	switch op {
+	case "==":
+		op = "="
+	case "=", "!=", ">", ">=", "<", "<=":
+	default:
+		return nil, fmt.Errorf("invalid operator %q after %q in filter", op, key)
+	}
+	value := p.next()
+	if value == "" || value == "(" || value == ")" {
+		return nil, fmt.Errorf("missing value after %s%s in filter", key, op)
+	}
+	if value[0] == '"' || value[0] == '\'' {
+		value = value[1:]
+	}
+	return &filterCompare{key: key, op: op, value: value}, nil
+}
@@ -0,0 +1,196 @@
+package sse
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// 以前缀形式描述表达式，便于比较解析结果的结构
+func describeFilter(f deviceFilter) string {
+	switch f := f.(type) {
+	case *filterAnd:
+		return fmt.Sprintf("(and %s %s)", describeFilter(f.left), describeFilter(f.right))
+	case *filterOr:
+		return fmt.Sprintf("(or %s %s)", describeFilter(f.left), describeFilter(f.right))
+	case *filterNot:
+		return fmt.Sprintf("(not %s)", describeFilter(f.inner))
+	case *filterTag:
+		return "tag:" + f.tag
+	case *filterCompare:
+		return fmt.Sprintf("[%s %s %s]", f.key, f.op, f.value)
+	case nil:
+		return "nil"
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+func TestParseDeviceFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "nil"},
+		{"   ", "nil"},
+		{"platform=ios", "[platform = ios]"},
+		{"platform == ios", "[platform = ios]"},
+		{"app_version>=3.2", "[app_version >= 3.2]"},
+		{"tag:beta", "tag:beta"},
+		{"TAG:beta", "tag:beta"},
+		// AND 优先于 OR，同级从左到右结合
+		{"a=1 AND b=2 OR c=3", "(or (and [a = 1] [b = 2]) [c = 3])"},
+		{"a=1 OR b=2 AND c=3", "(or [a = 1] (and [b = 2] [c = 3]))"},
+		{"a=1 AND b=2 AND c=3", "(and (and [a = 1] [b = 2]) [c = 3])"},
+		{"a=1 or b=2 and not c=3", "(or [a = 1] (and [b = 2] (not [c = 3])))"},
+		// NOT 只作用于紧随的一项
+		{"NOT a=1 AND b=2", "(and (not [a = 1]) [b = 2])"},
+		{"NOT (a=1 AND b=2)", "(not (and [a = 1] [b = 2]))"},
+		{"!tag:beta || x==1", "(or (not tag:beta) [x = 1])"},
+		{"NOT NOT a=1", "(not (not [a = 1]))"},
+		{"a=1 AND (b=2 OR c=3)", "(and [a = 1] (or [b = 2] [c = 3]))"},
+		{"(a=1)&&(b!=2)", "(and [a = 1] [b != 2])"},
+		{"((a<1))", "[a < 1]"},
+		// 引号中的空格、运算符和关键字都是值的一部分
+		{`name="hello world"`, "[name = hello world]"},
+		{`name='a AND b'`, "[name = a AND b]"},
+		{`name="a=b" AND x>"("`, "(and [name = a=b] [x > (])"},
+		{`name="OR"`, "[name = OR]"},
+		{`name=""`, "[name = ]"},
+		{"locale=zh-CN", "[locale = zh-CN]"},
+	}
+	for _, tt := range tests {
+		filter, err := parseDeviceFilter(tt.expr)
+		if err != nil {
+			t.Errorf("parseDeviceFilter(%q) error: %v", tt.expr, err)
+			continue
+		}
+		if got := describeFilter(filter); got != tt.want {
+			t.Errorf("parseDeviceFilter(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseDeviceFilterInvalid(t *testing.T) {
+	tests := []string{
+		"a",
+		"a=",
+		"=1",
+		"a ~ 1",
+		"a =! 1",
+		"a=1 AND",
+		"a=1 OR OR b=2",
+		"AND a=1",
+		"NOT",
+		"(a=1",
+		"a=1)",
+		"()",
+		"a=1 b=2",
+		"a=1 & b=2",
+		"a=1 | b=2",
+		`a="x`,
+		"a='x",
+		"tag:",
+		"a=(",
+		"a=)",
+	}
+	for _, expr := range tests {
+		if filter, err := parseDeviceFilter(expr); err == nil {
+			t.Errorf("parseDeviceFilter(%q) = %s, want error", expr, describeFilter(filter))
+		}
+	}
+}
+
+func TestDeviceFilterMatch(t *testing.T) {
+	attrs := map[string]string{"platform": "ios", "app_version": "3.10.1", "locale": "zh-CN"}
+	tags := []string{"beta", "vip"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"platform=ios", true},
+		{"platform=android", false},
+		{"platform!=android", true},
+		{"missing!=x", true},
+		{"missing=x", false},
+		{"missing>=0", false},
+		// 版本号逐段按数值比较
+		{"app_version>=3.2", true},
+		{"app_version>3.10", true},
+		{"app_version<3.9", false},
+		{"app_version<=3.10.1", true},
+		{"app_version>=3.10.1.0", true},
+		// 非版本号按字符串比较
+		{"locale>zh-AA", true},
+		{"locale<zh-AA", false},
+		{"tag:beta", true},
+		{"tag:alpha", false},
+		{"tag:alpha OR platform=ios AND tag:vip", true},
+		{"(tag:alpha OR platform=ios) AND NOT tag:vip", false},
+		{"NOT tag:alpha", true},
+	}
+	for _, tt := range tests {
+		filter, err := parseDeviceFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("parseDeviceFilter(%q) error: %v", tt.expr, err)
+		}
+		if got := filter.match(attrs, tags); got != tt.want {
+			t.Errorf("%q matched = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// 用索引缩小候选集后筛选的结果，须与逐台设备筛选的结果一致
+func TestDeviceFilterIndexMatchesScan(t *testing.T) {
+	devices := []*Device{
+		{DeviceID: "d1", Attrs: map[string]string{"platform": "ios", "app_version": "3.2"}, Tags: []string{"beta"}},
+		{DeviceID: "d2", Attrs: map[string]string{"platform": "ios", "app_version": "2.9"}},
+		{DeviceID: "d3", Attrs: map[string]string{"platform": "android", "app_version": "3.4"}, Tags: []string{"beta", "vip"}},
+		{DeviceID: "d4", Attrs: map[string]string{"platform": "web"}, Tags: []string{"vip"}},
+		{DeviceID: "d5"},
+		{DeviceID: "d6", Attrs: map[string]string{"locale": "en"}, Tags: []string{"beta"}},
+	}
+	loaded := make(map[string]*deviceAttrs, len(devices))
+	allIds := make([]string, 0, len(devices))
+	for _, device := range devices {
+		loaded[device.DeviceID] = &deviceAttrs{attrs: device.Attrs, tags: device.Tags}
+		allIds = append(allIds, device.DeviceID)
+	}
+	filters := []string{
+		"platform=ios",
+		"platform=ios AND app_version>=3",
+		"app_version>=3 AND platform=ios",
+		"tag:beta",
+		"tag:beta AND NOT platform=ios",
+		"NOT platform=ios AND tag:beta",
+		"platform=ios OR tag:vip",
+		"NOT platform=ios",
+		"platform!=ios",
+		"(platform=ios OR platform=android) AND tag:beta",
+		"tag:beta AND (platform=ios OR locale=en)",
+		"platform=missing",
+		"tag:missing OR platform=web",
+	}
+	for _, expr := range filters {
+		filter, err := parseDeviceFilter(expr)
+		if err != nil {
+			t.Fatalf("parseDeviceFilter(%q) error: %v", expr, err)
+		}
+		candidates := allIds
+		if key := filter.indexKey(); key != "" {
+			candidates = nil
+			for _, device := range devices {
+				for _, indexKey := range device.indexKeys() {
+					if indexKey == key {
+						candidates = append(candidates, device.DeviceID)
+						break
+					}
+				}
+			}
+		}
+		scanned := matchDeviceIds(allIds, filter, loaded)
+		indexed := matchDeviceIds(candidates, filter, loaded)
+		if !reflect.DeepEqual(indexed, scanned) {
+			t.Errorf("%q: index %v, scan %v", expr, indexed, scanned)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sse
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redis的可用状态：不可用期间拒绝新连接和依赖Redis的接口，已建立的连接继续保持
+type redisHealthState struct {
+	mu        sync.Mutex
+	available bool
+	lastError string
+	changedAt time.Time
+}
+
+var redisHealth = &redisHealthState{available: true}
+
+func (s *redisHealthState) update(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	available := err == nil
+	if available != s.available {
+		if available {
+			instanceLogger.Info("Redis is available again, leave degraded mode")
+		} else {
+			instanceLogger.Error("Redis is unavailable, enter degraded mode", "error", err)
+		}
+		s.available = available
+		s.changedAt = time.Now()
+	}
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+func (s *redisHealthState) isAvailable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.available
+}
+
+func (s *redisHealthState) snapshot() gin.H {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changedAt := ""
+	if !s.changedAt.IsZero() {
+		changedAt = s.changedAt.Format("2006-01-02 15:04:05")
+	}
+	return gin.H{
+		"available":  s.available,
+		"last_error": s.lastError,
+		"changed_at": changedAt,
+	}
+}
+
+// 定期探测Redis
+func watchRedis(ctx context.Context) {
+	ticker := time.NewTicker(REDIS_HEALTH_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, REDIS_HEALTH_CHECK_TIMEOUT)
+			err := globalRedis.Ping(pingCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			redisHealth.update(err)
+		}
+	}
+}
+
+// RequireRedis 中间件：Redis不可用时直接返回503，避免请求在Redis超时上堆积
+func RequireRedis() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !redisHealth.isAvailable() {
+			respondError(c, ErrRedisUnavailable)
+			return
+		}
+		c.Next()
+	}
+}
+
+// RejectWhenDraining 中间件：排空期间拒绝新的设备连接
+func RejectWhenDraining() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if draining.Load() {
+			respondError(c, ErrDraining)
+			return
+		}
+		c.Next()
+	}
+}
+
+// 本实例是否仍登记在集群实例集合中
+func isRegistered() bool {
+	if !redisHealth.isAvailable() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	registered, err := globalRedis.Client().SIsMember(ctx, redisKey(KEY_CLUSTER_INSTANCE_SET, ""), globalInstance.Address).Result()
+	if err != nil {
+		instanceLogger.Warn("Failed to check instance registration", "instance", globalInstance.Address, "error", err)
+		return false
+	}
+	return registered
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"sse-broker/funcs"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
+var instanceLogger = funcs.Logger("instance")
+
 type AbstractInstance struct {
 	Version     string `json:"version"`
 	Address     string `json:"address"`
@@ -31,14 +34,13 @@ func (s *AbstractInstance) exist() bool {
 	return s.Version != ""
 }
 
-func getRedisInstance(address string) *AbstractInstance {
-	info, err := globalRedis.HGetAll(fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, address))
+func getRedisInstance(address string) (*AbstractInstance, error) {
+	info, err := globalRedis.HGetAll(redisKey(KEY_INSTANCE_PREFIX, address))
 	if err != nil {
-		log.Fatalf("Failed to get instance: %v\n", err)
-		return nil
+		return nil, ErrRedisUnavailable.with("Failed to get instance %s: %s", address, err.Error())
 	}
 	if len(info) == 0 {
-		return nil
+		return nil, nil
 	}
 	instacne := &AbstractInstance{
 		Version:   info["version"],
@@ -47,13 +49,13 @@ func getRedisInstance(address string) *AbstractInstance {
 		DeviceCount: func() int {
 			id, err := strconv.ParseInt(info["device_count"], 10, 64)
 			if err != nil {
-				log.Printf("Failed to parse last frame id: %v\n", err)
+				instanceLogger.Warn("Failed to parse device count", "instance", address, "error", err)
 				return 0
 			}
 			return int(id)
 		}(),
 	}
-	return instacne
+	return instacne, nil
 }
 
 type ServiceInstance struct {
@@ -62,20 +64,65 @@ type ServiceInstance struct {
 	TopicCancel context.CancelFunc
 }
 
+// 实例Topic的订阅状态
+type subscriptionState struct {
+	mu         sync.Mutex
+	connected  bool
+	reconnects int
+	lastError  string
+	changedAt  time.Time
+}
+
+var subscription = &subscriptionState{}
+
+func (s *subscriptionState) update(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connected && !s.changedAt.IsZero() {
+		s.reconnects++
+	}
+	s.connected = connected
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	s.changedAt = time.Now()
+}
+
+func (s *subscriptionState) isConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+func (s *subscriptionState) snapshot() gin.H {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return gin.H{
+		"connected":  s.connected,
+		"reconnects": s.reconnects,
+		"last_error": s.lastError,
+		"changed_at": s.changedAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
 func subscribeInstanceTopic(ctx context.Context, topic string) {
-	err := globalRedis.Subscribe(ctx, func(channel string, payload string) {
+	subscribed := false
+	globalRedis.SubscribeForever(ctx, func(channel string, payload string) {
 		var instruction Instruction
 		err := json.Unmarshal([]byte(payload), &instruction)
 		if err != nil {
-			log.Printf("Failed to unmarshal instruction: %v\n", err)
+			instanceLogger.Error("Failed to unmarshal instruction", "channel", channel, "error", err)
 			return
 		}
 		globalInstance.handleInstruction(&instruction)
+	}, func(connected bool, err error) {
+		subscription.update(connected, err)
+		if connected && subscribed {
+			// 断线期间发给本实例的指令已丢失，重新登记实例并通知设备重新同步
+			globalInstance.recover()
+		}
+		subscribed = subscribed || connected
 	}, topic)
-	if err != nil {
-		log.Fatalf("Failed to subscribe instance topic: %v\n", err)
-		panic(fmt.Sprintf("Failed to subscribe instance topic: %v\n", err))
-	}
 }
 
 func NewServiceInstance(version string, address string) *ServiceInstance {
@@ -93,72 +140,129 @@ func NewServiceInstance(version string, address string) *ServiceInstance {
 
 // 处理发给本实例的指令
 func (s *ServiceInstance) handleInstruction(instruction *Instruction) {
-	if channel, ok := deviceChannels.Load(instruction.DeviceID); ok {
-		inschannel, ok := channel.(chan *Instruction)
+	if instruction.Command == CMD_DRAIN {
+		setDraining(instruction.Data == "true")
+		return
+	}
+	if instruction.Command == CMD_SEND_FRAME && instruction.expired() {
+		instanceLogger.Debug("Drop expired instruction", "device_id", instruction.DeviceID, "command", instruction.Command)
+		return
+	}
+	// 其他实例分发来的消息同样受大小上限约束
+	if instruction.Command == CMD_SEND_FRAME {
+		if err := checkPayloadSize(len(instruction.Data)); err != nil {
+			instanceLogger.Warn("Drop oversized instruction", "device_id", instruction.DeviceID, "error", err)
+			return
+		}
+	}
+	if value, ok := deviceChannels.Load(instruction.DeviceID); ok {
+		queue, ok := value.(*deviceQueue)
 		if !ok {
-			log.Printf("Device %s not found at %s\n", instruction.DeviceID, s.Address)
-		} else {
-			inschannel <- instruction
+			instanceLogger.Warn("Device not found", "device_id", instruction.DeviceID, "instance", s.Address)
+		} else if !queue.push(instruction) {
+			instanceLogger.Warn("Drop instruction, queue is full", "device_id", instruction.DeviceID, "command", instruction.Command)
 		}
 	}
 }
 
 // 启动前清理本实例上次关机导致的残留及异常
-func (s *ServiceInstance) clear() {
+func (s *ServiceInstance) clear() error {
 	ctx := context.Background()
-	deviceSetKey := fmt.Sprintf("%s%s", KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address)
+	deviceSetKey := redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address)
+	// clear from cluster instance set；全局的实例集合与本实例的键不在同一个slot，不放入事务
+	if _, err := globalRedis.SRem(redisKey(KEY_CLUSTER_INSTANCE_SET, ""), s.Address); err != nil {
+		return fmt.Errorf("failed to clear instance: %v", err)
+	}
 	cmds, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		pipe.SMembers(ctx, deviceSetKey)
-		// clear from cluster instance set
-		pipe.SRem(ctx, KEY_CLUSTER_INSTANCE_SET, s.Address)
 		// delete instance info
-		pipe.Del(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, s.Address))
+		pipe.Del(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address))
 		// delete device ids
 		pipe.Del(ctx, deviceSetKey)
 		return nil
 	})
 	if err != nil {
-		log.Fatalf("Failed to clear instance: %v\n", err)
-		return
+		return fmt.Errorf("failed to clear instance: %v", err)
 	}
 	deviceIDs, _ := cmds[0].(*redis.StringSliceCmd).Result()
 	for _, deviceID := range deviceIDs {
 		device := getRedisDevice(deviceID)
-		if device != nil {
-			device.offline(DCR_INSTANCE_CLEAR, s.Address)
+		// 已在其他实例重新连接的设备不做处理
+		if device != nil && device.InstanceAddress == s.Address && device.offline(DCR_INSTANCE_CLEAR, s.Address) {
 			user := NewUser(device.UID)
 			user.handleDeviceOffline(device)
 		}
 	}
+	return nil
 }
 
-func (s *ServiceInstance) start() bool {
+func (s *ServiceInstance) start() error {
 	// 启动前清理本实例上次关机导致的残留及异常
-	s.clear()
+	if err := s.clear(); err != nil {
+		return err
+	}
 
 	// 本实例上线，并添加到实例集合
 	ctx := context.Background()
 	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.HSet(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, s.Address),
+		pipe.HSet(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address),
 			"version", s.Version,
 			"address", s.Address,
 			"start_time", s.StartTime,
-			"device_count", 0)
-		pipe.SAdd(ctx, KEY_CLUSTER_INSTANCE_SET, s.Address)
+			"device_count", 0,
+			"settings", settingsDigest(clusterSettings()))
 		return nil
 	})
-
+	if err == nil {
+		_, err = globalRedis.SAdd(redisKey(KEY_CLUSTER_INSTANCE_SET, ""), s.Address)
+	}
 	if err != nil {
-		log.Fatalf("Failed to start instance: %v\n", err)
-		return false
+		return fmt.Errorf("failed to start instance: %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s.TopicCancel = cancel
 	// 订阅实例Topic
-	go subscribeInstanceTopic(ctx, fmt.Sprintf("%s%s", TOPIC_INSTANCE_PREFIX, s.Address))
+	go subscribeInstanceTopic(ctx, redisTopic(TOPIC_INSTANCE_PREFIX, s.Address))
+	// 探测Redis可用性
+	go watchRedis(ctx)
 
-	return true
+	return nil
+}
+
+// 重新订阅后的补偿：Redis故障转移可能丢失实例信息，按本地状态重新登记，并通知本实例的设备重新同步
+func (s *ServiceInstance) recover() {
+	var deviceIds []interface{}
+	s.Devices.Range(func(key, value interface{}) bool {
+		deviceIds = append(deviceIds, key)
+		return true
+	})
+	ctx := context.Background()
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address),
+			"version", s.Version,
+			"address", s.Address,
+			"start_time", s.StartTime,
+			"device_count", len(deviceIds),
+			"settings", settingsDigest(clusterSettings()))
+		if len(deviceIds) > 0 {
+			pipe.SAdd(ctx, redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address), deviceIds...)
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = globalRedis.SAdd(redisKey(KEY_CLUSTER_INSTANCE_SET, ""), s.Address)
+	}
+	if err != nil {
+		instanceLogger.Error("Failed to re-register instance", "instance", s.Address, "error", err)
+	}
+	deviceChannels.Range(func(key, value interface{}) bool {
+		if queue, ok := value.(*deviceQueue); ok {
+			queue.push(&Instruction{DeviceID: key.(string), Command: CMD_RESYNC})
+		}
+		return true
+	})
+	instanceLogger.Info("Instance recovered, devices notified to resync", "instance", s.Address, "devices", len(deviceIds))
 }
 
 func (s *ServiceInstance) stop() {
@@ -168,33 +272,34 @@ func (s *ServiceInstance) stop() {
 	// 主动关闭本实例上连接的全部设备
 	deviceChannels.Range(func(key, value interface{}) bool {
 		deviceId := key.(string)
-		channel, ok := value.(chan *Instruction)
+		queue, ok := value.(*deviceQueue)
 		if ok {
-			ins := &Instruction{
+			queue.push(&Instruction{
 				DeviceID: deviceId,
 				Command:  CMD_INSTANCE_CLOSE,
 				Event:    "",
 				Data:     s.Address,
-			}
-			channel <- ins
+			})
 		}
 		return true
 	})
 	// 等待所有设备连接关闭
 	deviceChannelWG.Wait()
-	log.Printf("Instance %s stopped\n", s.Address)
+	instanceLogger.Info("Instance stopped", "instance", s.Address)
 }
 
 func (s *ServiceInstance) dispose() {
 	ctx := context.Background()
+	if _, err := globalRedis.SRem(redisKey(KEY_CLUSTER_INSTANCE_SET, ""), s.Address); err != nil {
+		instanceLogger.Error("Failed to remove instance from cluster", "instance", s.Address, "error", err)
+	}
 	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.SRem(ctx, KEY_CLUSTER_INSTANCE_SET, s.Address)
-		pipe.Del(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, s.Address))
-		pipe.Del(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address))
+		pipe.Del(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address))
+		pipe.Del(ctx, redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address))
 		return nil
 	})
 	if err != nil {
-		log.Fatalf("Failed to dispose instance: %v\n", err)
+		instanceLogger.Error("Failed to dispose instance", "instance", s.Address, "error", err)
 	}
 }
 
@@ -212,28 +317,41 @@ func (s *ServiceInstance) getDevice(deviceID string) *Device {
 	return nil
 }
 
-func (s *ServiceInstance) addDevice(device *Device) {
+// 登记本实例的设备，Redis写入失败时撤销本地登记
+func (s *ServiceInstance) addDevice(device *Device) error {
 	s.Devices.Store(device.DeviceID, device)
 	ctx := context.Background()
 	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.SAdd(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address), device.DeviceID)
-		pipe.HIncrBy(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, s.Address), "device_count", 1)
+		pipe.SAdd(ctx, redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address), device.DeviceID)
+		pipe.HIncrBy(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address), "device_count", 1)
 		return nil
 	})
 	if err != nil {
-		log.Fatalf("Failed to add device: %v\n", err)
+		s.Devices.CompareAndDelete(device.DeviceID, device)
+		redisHealth.update(err)
+		return ErrRedisUnavailable.with("Failed to add device: %s", err.Error())
 	}
+	return nil
 }
 
-func (s *ServiceInstance) delDevice(device *Device) {
-	s.Devices.Delete(device.DeviceID)
+// 注销本实例的设备；同一设备已在本实例重新连接时，只扣减设备数，不删除新连接的登记，并返回false
+func (s *ServiceInstance) delDevice(device *Device) bool {
+	owned := s.Devices.CompareAndDelete(device.DeviceID, device)
+	if !owned {
+		_, taken := s.Devices.Load(device.DeviceID)
+		owned = !taken
+	}
 	ctx := context.Background()
 	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.SRem(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address), device.DeviceID)
-		pipe.HIncrBy(ctx, fmt.Sprintf("%s%s", KEY_INSTANCE_PREFIX, s.Address), "device_count", -1)
+		if owned {
+			pipe.SRem(ctx, redisKey(KEY_INSTANCE_DEVICE_SET_PREFIX, s.Address), device.DeviceID)
+		}
+		pipe.HIncrBy(ctx, redisKey(KEY_INSTANCE_PREFIX, s.Address), "device_count", -1)
 		return nil
 	})
 	if err != nil {
-		log.Fatalf("Failed to remove device: %v\n", err)
+		// 设备记录会随过期时间自动清除，这里只记录错误
+		instanceLogger.Error("Failed to remove device", "instance", s.Address, "device_id", device.DeviceID, "error", err)
 	}
+	return owned
 }
@@ -0,0 +1,178 @@
+package sse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	keyPrefix  = "sse_" // 全部Redis键和频道的前缀，同一Redis上的不同集群须使用不同前缀
+	keyHashTag = false  // 是否将键中的ID包裹为hash tag，使同一实例/用户/设备的键落在同一个slot
+)
+
+func initKeys(prefix string, hashTag bool) {
+	keyPrefix = prefix
+	keyHashTag = hashTag
+}
+
+// 生成Redis键：前缀 + 名称 + ID；开启hash tag时ID写作{ID}
+func redisKey(name string, id string) string {
+	if keyHashTag && id != "" {
+		return keyPrefix + name + "{" + id + "}"
+	}
+	return keyPrefix + name + id
+}
+
+// 生成Redis频道名：前缀 + 名称 + ID
+func redisTopic(name string, id string) string {
+	return keyPrefix + name + id
+}
+
+// 后加入的集群配置在旧集群中缺失时视为默认值，以便滚动升级
+var clusterSettingDefaults = map[string]string{
+	"frame_id_scope":   FRAME_ID_SCOPE_DEVICE,
+	"max_payload_size": "65536",
+}
+
+// 集群内须保持一致的配置，密钥只保存摘要
+func clusterSettings() map[string]string {
+	secret := sha256.Sum256([]byte(currentConfig().JWT.Secret))
+	return map[string]string{
+		"hash_tag":                  strconv.FormatBool(keyHashTag),
+		"jwt_secret_sha256":         hex.EncodeToString(secret[:8]),
+		"heartbeat_interval":        strconv.Itoa(int(currentConfig().SSE.HeartbeatDuration.Seconds())),
+		"device_frame_cache_size":   strconv.Itoa(currentConfig().SSE.DeviceFrameCacheSize),
+		"device_frame_cache_expire": strconv.Itoa(int(currentConfig().SSE.DeviceFrameExpireDuration.Seconds())),
+		"frame_id_scope":            currentConfig().SSE.FrameIDScope,
+		"max_payload_size":          strconv.Itoa(currentConfig().SSE.MaxPayloadSize),
+	}
+}
+
+// 集群配置的摘要，记录在各实例信息中，用于判断各实例是否使用相同的配置
+func settingsDigest(settings map[string]string) string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s=%s\n", name, settings[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// 其他存活实例的集群配置摘要；旧版本的实例没有摘要，记为空串
+func aliveInstanceDigests(selfAddress string) (map[string]string, error) {
+	ctx := context.Background()
+	addresses, err := globalRedis.SMembers(redisKey(KEY_CLUSTER_INSTANCE_SET, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster instances: %v", err)
+	}
+	pipe := globalRedis.Pipeline()
+	cmds := make(map[string]*redis.SliceCmd)
+	for _, address := range addresses {
+		if address != selfAddress {
+			cmds[address] = pipe.HMGet(ctx, redisKey(KEY_INSTANCE_PREFIX, address), "version", "settings")
+		}
+	}
+	digests := make(map[string]string)
+	if len(cmds) == 0 {
+		return digests, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to check cluster instances: %v", err)
+	}
+	for address, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 2 || values[0] == nil {
+			continue
+		}
+		digest, _ := values[1].(string)
+		digests[address] = digest
+	}
+	return digests, nil
+}
+
+// 加入集群前检查配置：集群中已有其他存活实例且配置不一致时拒绝启动
+// 集群正在逐台重新加载时，与任一存活实例的配置相同即可加入
+func checkClusterSettings(selfAddress string) error {
+	existing, err := globalRedis.HGetAll(redisKey(KEY_CLUSTER_SETTINGS, ""))
+	if err != nil {
+		return fmt.Errorf("failed to read cluster settings: %v", err)
+	}
+	current := clusterSettings()
+	if len(existing) > 0 {
+		digests, err := aliveInstanceDigests(selfAddress)
+		if err != nil {
+			return err
+		}
+		if len(digests) > 0 {
+			var errs []error
+			for name, value := range current {
+				if _, ok := existing[name]; !ok && clusterSettingDefaults[name] == value {
+					continue
+				}
+				if existing[name] != value {
+					errs = append(errs, fmt.Errorf("%s: cluster has %q, this instance has %q", name, existing[name], value))
+				}
+			}
+			if len(errs) == 0 {
+				return nil
+			}
+			digest := settingsDigest(current)
+			for address, instanceDigest := range digests {
+				if instanceDigest == digest {
+					instanceLogger.Warn("Cluster settings are being reloaded, joining with the settings of a reloaded instance", "instance", address)
+					return nil
+				}
+			}
+			return fmt.Errorf("settings mismatch with %d running instance(s) under key prefix %q:\n%w", len(digests), keyPrefix, errors.Join(errs...))
+		}
+	}
+	// 没有其他存活实例时，以本实例的配置为准
+	return saveClusterSettings(current)
+}
+
+// 热加载改变了集群配置：记录本实例的新配置摘要，全部存活实例都已使用新配置后才更新集群记录，
+// 以免尚未重新加载的实例在重启时被拒绝；返回仍在使用其他配置的实例
+func updateClusterSettings(settings map[string]string) ([]string, error) {
+	digest := settingsDigest(settings)
+	if err := globalRedis.HSet(redisKey(KEY_INSTANCE_PREFIX, globalInstance.Address), "settings", digest); err != nil {
+		return nil, fmt.Errorf("failed to save instance settings: %v", err)
+	}
+	digests, err := aliveInstanceDigests(globalInstance.Address)
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for address, instanceDigest := range digests {
+		if instanceDigest != digest {
+			pending = append(pending, address)
+		}
+	}
+	sort.Strings(pending)
+	if len(pending) > 0 {
+		return pending, nil
+	}
+	return nil, saveClusterSettings(settings)
+}
+
+// 记录集群配置
+func saveClusterSettings(settings map[string]string) error {
+	values := make([]interface{}, 0, len(settings)*2)
+	for name, value := range settings {
+		values = append(values, name, value)
+	}
+	if err := globalRedis.HSet(redisKey(KEY_CLUSTER_SETTINGS, ""), values...); err != nil {
+		return fmt.Errorf("failed to save cluster settings: %v", err)
+	}
+	return nil
+}
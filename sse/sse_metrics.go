@@ -0,0 +1,88 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+type brokerMetrics struct {
+	queueDepth         atomic.Int64 // 本实例全部设备队列中排队的消息帧数
+	slowConsumers      atomic.Int64 // 因队列溢出被断开的设备数
+	collapsed          atomic.Int64 // 因合并键被新消息替换的待发消息数
+	frameGaps          atomic.Int64 // 续传时帧缓存已缺失的次数
+	framesLost         atomic.Int64 // 续传时缺失的消息帧数(上限)
+	payloadRejected    atomic.Int64 // 不符合事件Schema被拒绝的消息数
+	payloadQuarantined atomic.Int64 // 不符合事件Schema被隔离的消息数
+	dropped            sync.Map     // 溢出策略 -> *atomic.Int64
+}
+
+var metrics = &brokerMetrics{}
+
+func (m *brokerMetrics) queueDropped(policy string, n int64) {
+	counter, _ := m.dropped.LoadOrStore(policy, &atomic.Int64{})
+	counter.(*atomic.Int64).Add(n)
+}
+
+func writeMetric(b *strings.Builder, name string, kind string, help string, samples ...string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintf(b, "%s%s\n", name, sample)
+	}
+}
+
+// HandleMetrics 以Prometheus文本格式输出本实例的指标
+func HandleMetrics(c *gin.Context) {
+	devices := 0
+	maxDepth := 0
+	deviceChannels.Range(func(key, value interface{}) bool {
+		if queue, ok := value.(*deviceQueue); ok {
+			devices++
+			if depth := queue.len(); depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+		return true
+	})
+
+	var b strings.Builder
+	writeMetric(&b, "sse_connected_devices", "gauge", "Devices connected to this instance.",
+		fmt.Sprintf(" %d", devices))
+	writeMetric(&b, "sse_device_queue_depth", "gauge", "Frames queued for all devices on this instance.",
+		fmt.Sprintf(" %d", metrics.queueDepth.Load()))
+	writeMetric(&b, "sse_device_queue_max_depth", "gauge", "Largest per-device queue on this instance.",
+		fmt.Sprintf(" %d", maxDepth))
+	writeMetric(&b, "sse_device_queue_capacity", "gauge", "Configured per-device queue capacity.",
+		fmt.Sprintf(" %d", currentConfig().SSE.DeviceQueueSize))
+	var dropped []string
+	metrics.dropped.Range(func(key, value interface{}) bool {
+		dropped = append(dropped, fmt.Sprintf("{policy=%q} %d", key, value.(*atomic.Int64).Load()))
+		return true
+	})
+	writeMetric(&b, "sse_device_queue_dropped_total", "counter", "Frames dropped because a device queue was full.", dropped...)
+	writeMetric(&b, "sse_device_queue_collapsed_total", "counter", "Queued frames replaced by a newer frame with the same collapse key.",
+		fmt.Sprintf(" %d", metrics.collapsed.Load()))
+	writeMetric(&b, "sse_frame_gaps_total", "counter", "Reconnects whose Last-Event-ID was older than the oldest cached frame.",
+		fmt.Sprintf(" %d", metrics.frameGaps.Load()))
+	writeMetric(&b, "sse_frames_lost_total", "counter", "Frames missing from the cache on reconnect (upper bound).",
+		fmt.Sprintf(" %d", metrics.framesLost.Load()))
+	writeMetric(&b, "sse_payload_schema_failures_total", "counter", "Messages whose data did not match the schema of their event type.",
+		fmt.Sprintf("{action=\"reject\"} %d", metrics.payloadRejected.Load()),
+		fmt.Sprintf("{action=\"quarantine\"} %d", metrics.payloadQuarantined.Load()))
+	writeMetric(&b, "sse_slow_consumer_disconnects_total", "counter", "Devices disconnected by the disconnect overflow policy.",
+		fmt.Sprintf(" %d", metrics.slowConsumers.Load()))
+	writeCompressionMetrics(&b)
+
+	redisAvailable := 0
+	if redisHealth.isAvailable() {
+		redisAvailable = 1
+	}
+	writeMetric(&b, "sse_redis_available", "gauge", "Whether Redis is reachable from this instance (0 means degraded mode).",
+		fmt.Sprintf(" %d", redisAvailable))
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
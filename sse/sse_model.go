@@ -2,6 +2,11 @@ package sse
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sse-broker/funcs"
+	"strings"
 	"time"
 )
 
@@ -11,28 +16,86 @@ type Config struct {
 		Port    int
 	}
 	JWT struct {
-		Secret string
-		Expire int
+		Secret        string
+		Expire        int
+		SecretOverlap time.Duration // 轮换密钥后旧密钥仍可校验的时长
 	}
 	Redis struct {
-		Addrs    []string
-		Password string
-		DB       int
-		PoolSize int
+		funcs.RedisOptions
+		KeyPrefix string
+		HashTag   bool
 	}
 	SSE struct {
 		HeartbeatDuration         time.Duration
 		DeviceUserExistDuration   time.Duration
 		DeviceFrameExpireDuration time.Duration
 		DeviceFrameCacheSize      int
+		DeviceQueueSize           int
+		DeviceQueueOverflow       string
+		MaxPayloadSize            int    // 消息内容的大小上限(字节)，0为不限
+		FrameIDScope              string // 消息帧ID的分配范围：device/user
 	}
+	API struct {
+		Keys []ApiKey // 为空时接口不校验调用方
+	}
+	Proxy struct {
+		TrustedProxies []netip.Prefix // 受信任的代理，只采信这些地址发来的转发头
+	}
+	CORS struct {
+		AllowedOrigins   []string      // 允许的来源，支持 * 和 https://*.example.com
+		AllowCredentials bool          // 是否允许携带Cookie等凭据
+		MaxAge           time.Duration // 预检结果的缓存时长
+		RestrictEvents   bool          // /events 是否只接受允许列表中的来源
+	}
+	Compression struct {
+		Enable        bool
+		Encodings     []string // 按优先顺序
+		GzipLevel     int
+		BrotliQuality int
+		FlushSize     int // 刷新阈值：不小于该大小的消息写出后立即刷新压缩器；所有消息都经压缩
+	}
+	Events struct {
+		Mode             string      // 校验失败时: reject 拒绝, quarantine 隔离
+		Unknown          string      // 未登记的事件: allow 允许, reject 拒绝
+		QuarantineMaxLen int64       // 隔离区保留的最大条数(近似)
+		Types            []EventType // 配置文件中登记的事件类型
+	}
+	Audit struct {
+		Enable            bool
+		Path              string // 本地JSONL文件
+		RedisStream       bool   // 是否同时写入Redis Stream
+		RedisStreamMaxLen int64  // Redis Stream 保留的最大条数(近似)
+	}
+}
+
+// ApiKey 调用方的API密钥，Name用于审计日志中标识调用方
+type ApiKey struct {
+	Name string
+	Key  string
+	Role string // admin 可调用 /admin 下的管理接口
 }
 
 type Instruction struct {
-	DeviceID string `json:"device_id"`
-	Command  string `json:"command"`
-	Event    string `json:"event"`
-	Data     string `json:"data"`
+	DeviceID    string `json:"device_id"`
+	Command     string `json:"command"`
+	Event       string `json:"event"`
+	Data        string `json:"data"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`   // 过期时间(unix秒)，0表示永不过期
+	Priority    int    `json:"priority,omitempty"`     // 消息优先级，PRIORITY_LOW/NORMAL/HIGH
+	CollapseKey string `json:"collapse_key,omitempty"` // 合并键，同键的待发消息只保留最新一条
+	FrameID     int64  `json:"frame_id,omitempty"`     // 发送时已分配的消息帧ID(frame_id_scope=user)，0时由设备自行分配
+	ContentType string `json:"content_type,omitempty"` // 内容类型提示
+	Encoding    string `json:"encoding,omitempty"`     // 传输编码提示，如 base64
+}
+
+// 是否为控制指令(踢下线、挤下线、实例关闭等)，控制指令不受队列容量限制
+func (i *Instruction) isControl() bool {
+	return i.Command != CMD_SEND_FRAME
+}
+
+// 指令携带的消息是否已过期
+func (i *Instruction) expired() bool {
+	return i.ExpiresAt > 0 && time.Now().Unix() >= i.ExpiresAt
 }
 
 func (i *Instruction) String() string {
@@ -44,9 +107,27 @@ func (i *Instruction) String() string {
 }
 
 type Frame struct {
-	ID    int64  `json:"id"`
-	Event string `json:"event"`
-	Data  string `json:"data"`
+	ID          int64  `json:"id"`
+	Event       string `json:"event"`
+	Data        string `json:"data"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`   // 过期时间(unix秒)，0表示永不过期
+	CollapseKey string `json:"collapse_key,omitempty"` // 合并键，帧缓存中同键只保留最新一帧
+	Time        int64  `json:"time,omitempty"`         // 生成时间(unix毫秒)
+	ContentType string `json:"content_type,omitempty"` // 内容类型提示
+	Encoding    string `json:"encoding,omitempty"`     // 传输编码提示，如 base64
+}
+
+// 续传时帧缓存中已缺失的消息帧，作为 sys_gap 事件的数据
+type FrameGap struct {
+	LastEventID int64 `json:"last_event_id"` // 客户端请求续传的ID
+	From        int64 `json:"from"`          // 缺失的第一个ID
+	To          int64 `json:"to"`            // 缺失的最后一个ID
+	Lost        int64 `json:"lost"`          // 缺失的数量，超出记录上限时只计入记录中的部分
+}
+
+// 消息帧是否已过期
+func (f *Frame) expired() bool {
+	return f.ExpiresAt > 0 && time.Now().Unix() >= f.ExpiresAt
 }
 
 func (f *Frame) String() string {
@@ -57,6 +138,76 @@ func (f *Frame) String() string {
 	return string(json)
 }
 
+// 设备属性，JSON为对象；表单/查询参数为 key:value,key:value
+type DeviceAttrs map[string]string
+
+func (a *DeviceAttrs) UnmarshalParam(param string) error {
+	attrs := DeviceAttrs{}
+	for _, pair := range strings.Split(param, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		index := strings.IndexAny(pair, ":=")
+		if index <= 0 {
+			return fmt.Errorf("invalid attribute: %s", pair)
+		}
+		attrs[strings.TrimSpace(pair[:index])] = strings.TrimSpace(pair[index+1:])
+	}
+	*a = attrs
+	return nil
+}
+
+func (a DeviceAttrs) validate() error {
+	if len(a) > DEVICE_ATTR_MAX_COUNT {
+		return fmt.Errorf("too many attributes, at most %d", DEVICE_ATTR_MAX_COUNT)
+	}
+	for key, value := range a {
+		if key == "" || strings.ContainsAny(key, " =!<>()&|:\"'") || len(key) > DEVICE_ATTR_MAX_LENGTH {
+			return fmt.Errorf("invalid attribute name: %q", key)
+		}
+		if len(value) > DEVICE_ATTR_MAX_LENGTH {
+			return fmt.Errorf("attribute %s is too long", key)
+		}
+	}
+	return nil
+}
+
+// 设备标签，JSON为数组；表单/查询参数以逗号分隔
+type DeviceTags []string
+
+func (t *DeviceTags) UnmarshalParam(param string) error {
+	*t = DeviceTags(splitParam(param))
+	return nil
+}
+
+func (t DeviceTags) validate() error {
+	if len(t) > DEVICE_ATTR_MAX_COUNT {
+		return fmt.Errorf("too many tags, at most %d", DEVICE_ATTR_MAX_COUNT)
+	}
+	for _, tag := range t {
+		if tag == "" || strings.ContainsAny(tag, " ()&|\"'") || len(tag) > DEVICE_ATTR_MAX_LENGTH {
+			return fmt.Errorf("invalid tag: %q", tag)
+		}
+	}
+	return nil
+}
+
+// 合并标签并去重排序
+func mergeTags(tags ...[]string) []string {
+	tagSet := make(map[string]bool)
+	for _, list := range tags {
+		for _, tag := range list {
+			tagSet[tag] = true
+		}
+	}
+	merged := make([]string, 0, len(tagSet))
+	for tag := range tagSet {
+		merged = append(merged, tag)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
 type StateChange struct {
 	UID         string `json:"uid"`
 	Device      string `json:"device"`
@@ -0,0 +1,100 @@
+package sse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
+// 消息内容：JSON中的字符串原样发送，其他JSON值(对象、数组、数字、布尔)压缩为一行后发送，无需再次编码
+type Payload struct {
+	Text   string
+	IsJSON bool // 是否由JSON值(非字符串)转换而来
+}
+
+func (p *Payload) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		*p = Payload{}
+		return nil
+	}
+	if data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*p = Payload{Text: text}
+		return nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return err
+	}
+	*p = Payload{Text: compact.String(), IsJSON: true}
+	return nil
+}
+
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if p.IsJSON {
+		return []byte(p.Text), nil
+	}
+	return json.Marshal(p.Text)
+}
+
+// 表单和查询参数中的 data 作为字符串
+func (p *Payload) UnmarshalParam(param string) error {
+	*p = Payload{Text: param}
+	return nil
+}
+
+// 校验消息内容及其类型提示，返回发给客户端的 content_type 和 encoding
+func checkPayload(payload Payload, contentType string, encoding string) (string, string, error) {
+	if payload.Text == "" {
+		return "", "", ErrInvalidParams.with("data cannot be empty")
+	}
+	if err := checkPayloadSize(len(payload.Text)); err != nil {
+		return "", "", err
+	}
+	if contentType == "" && payload.IsJSON {
+		contentType = "application/json"
+	}
+	if contentType != "" {
+		// 类型提示作为SSE字段发出，不能包含换行
+		if _, _, err := mime.ParseMediaType(contentType); err != nil || strings.ContainsAny(contentType, "\r\n") {
+			return "", "", ErrInvalidParams.with("invalid content_type: %s", contentType)
+		}
+	}
+	switch encoding {
+	case "":
+	case PAYLOAD_ENCODING_BASE64:
+		if payload.IsJSON {
+			return "", "", ErrInvalidParams.with("data must be a base64 string when encoding is base64")
+		}
+		if _, err := base64.StdEncoding.DecodeString(payload.Text); err != nil {
+			return "", "", ErrInvalidParams.with("data is not valid base64: %s", err.Error())
+		}
+	default:
+		return "", "", ErrInvalidParams.with("invalid encoding: %s", encoding)
+	}
+	return contentType, encoding, nil
+}
+
+// 消息内容的大小上限，/send、实例间分发和帧缓存使用同一限制；0为不限
+func checkPayloadSize(size int) error {
+	limit := currentConfig().SSE.MaxPayloadSize
+	if limit > 0 && size > limit {
+		return ErrPayloadTooLarge.with("data is %d bytes, larger than the limit of %d bytes", size, limit)
+	}
+	return nil
+}
+
+// /send 请求体的大小上限：消息内容经JSON转义或表单编码后最多膨胀为6倍，另加其余参数的余量
+func sendBodyLimit() int64 {
+	limit := currentConfig().SSE.MaxPayloadSize
+	if limit <= 0 {
+		return SEND_MAX_BODY_SIZE
+	}
+	return int64(limit)*6 + SEND_BODY_OVERHEAD
+}
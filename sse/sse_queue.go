@@ -0,0 +1,200 @@
+package sse
+
+import (
+	"sync"
+)
+
+// 优先级分桶的下标，下标越小越先出队
+const (
+	bucketHigh = iota
+	bucketNormal
+	bucketLow
+	bucketCount
+)
+
+func priorityBucket(priority int) int {
+	if priority > PRIORITY_NORMAL {
+		return bucketHigh
+	} else if priority < PRIORITY_NORMAL {
+		return bucketLow
+	}
+	return bucketNormal
+}
+
+// 设备指令队列：有界、按优先级出队，控制指令插队且不受容量限制
+type deviceQueue struct {
+	mu         sync.Mutex
+	control    []*Instruction
+	buckets    [bucketCount][]*Instruction
+	size       int // 消息帧指令数量，不含控制指令
+	capacity   int
+	overflow   string
+	notify     chan struct{}
+	closed     bool
+	overflowed bool
+}
+
+func newDeviceQueue(capacity int, overflow string) *deviceQueue {
+	if capacity <= 0 {
+		capacity = 256
+	}
+	switch overflow {
+	case OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST, OVERFLOW_DISCONNECT:
+	default:
+		overflow = OVERFLOW_DROP_OLDEST
+	}
+	return &deviceQueue{
+		capacity: capacity,
+		overflow: overflow,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// 唤醒消费者，notify有缓冲，不会阻塞
+func (q *deviceQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 入队，永不阻塞；返回false表示指令被丢弃
+func (q *deviceQueue) push(instruction *Instruction) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if instruction.isControl() {
+		q.control = append(q.control, instruction)
+		q.signal()
+		return true
+	}
+	if q.overflowed {
+		// 已判定为慢消费者，等待断开
+		metrics.queueDropped(q.overflow, 1)
+		return false
+	}
+	bucket := priorityBucket(instruction.Priority)
+	if instruction.CollapseKey != "" && q.collapse(bucket, instruction) {
+		q.signal()
+		return true
+	}
+	if q.size >= q.capacity && !q.makeRoom(bucket) {
+		return false
+	}
+	q.buckets[bucket] = append(q.buckets[bucket], instruction)
+	q.size++
+	metrics.queueDepth.Add(1)
+	q.signal()
+	return true
+}
+
+// 用新指令替换队列中合并键相同的待发指令；同一优先级原位替换，保持原有的排队位置
+func (q *deviceQueue) collapse(bucket int, instruction *Instruction) bool {
+	for b := 0; b < bucketCount; b++ {
+		for i, pending := range q.buckets[b] {
+			if pending.CollapseKey != instruction.CollapseKey {
+				continue
+			}
+			metrics.collapsed.Add(1)
+			if b == bucket {
+				q.buckets[b][i] = instruction
+				return true
+			}
+			// 优先级变化时移除旧指令，新指令按新优先级重新排队
+			q.buckets[b] = append(q.buckets[b][:i], q.buckets[b][i+1:]...)
+			q.size--
+			metrics.queueDepth.Add(-1)
+			return false
+		}
+	}
+	return false
+}
+
+// 队列已满时按溢出策略腾出空间，返回false表示应丢弃新指令
+func (q *deviceQueue) makeRoom(bucket int) bool {
+	switch q.overflow {
+	case OVERFLOW_DISCONNECT:
+		q.overflowed = true
+		metrics.queueDropped(q.overflow, int64(q.size+1))
+		metrics.queueDepth.Add(-int64(q.size))
+		metrics.slowConsumers.Add(1)
+		q.buckets = [bucketCount][]*Instruction{}
+		q.size = 0
+		q.control = append(q.control, &Instruction{Command: CMD_SLOW_CONSUMER})
+		q.signal()
+		return false
+	case OVERFLOW_DROP_NEWEST:
+		// 仅当存在更低优先级的指令时，才挤掉其中最新的一条
+		for b := bucketCount - 1; b > bucket; b-- {
+			if n := len(q.buckets[b]); n > 0 {
+				q.buckets[b] = q.buckets[b][:n-1]
+				q.size--
+				metrics.queueDepth.Add(-1)
+				metrics.queueDropped(q.overflow, 1)
+				return true
+			}
+		}
+		metrics.queueDropped(q.overflow, 1)
+		return false
+	default:
+		// 挤掉优先级不高于新指令的最旧一条
+		for b := bucketCount - 1; b >= bucket; b-- {
+			if len(q.buckets[b]) > 0 {
+				q.buckets[b][0] = nil
+				q.buckets[b] = q.buckets[b][1:]
+				q.size--
+				metrics.queueDepth.Add(-1)
+				metrics.queueDropped(q.overflow, 1)
+				return true
+			}
+		}
+		metrics.queueDropped(q.overflow, 1)
+		return false
+	}
+}
+
+// 出队，控制指令优先，其次按优先级从高到低；队列为空时返回nil
+func (q *deviceQueue) pop() *Instruction {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.control) > 0 {
+		instruction := q.control[0]
+		q.control[0] = nil
+		q.control = q.control[1:]
+		return instruction
+	}
+	for b := 0; b < bucketCount; b++ {
+		if len(q.buckets[b]) > 0 {
+			instruction := q.buckets[b][0]
+			q.buckets[b][0] = nil
+			q.buckets[b] = q.buckets[b][1:]
+			q.size--
+			metrics.queueDepth.Add(-1)
+			return instruction
+		}
+	}
+	return nil
+}
+
+// 当前排队的消息帧指令数量
+func (q *deviceQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// 关闭队列，丢弃剩余指令
+func (q *deviceQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	metrics.queueDepth.Add(-int64(q.size))
+	q.control = nil
+	q.buckets = [bucketCount][]*Instruction{}
+	q.size = 0
+}
@@ -0,0 +1,150 @@
+package sse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sse-broker/funcs"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的简易Redis：只实现用到的命令，数据为 键 -> 字段 -> 值
+type fakeRedis struct {
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	// hold 大于0时，各连接的第一条 HGET 等到 hold 个连接都已到达(或超时)后再一起回复，使并发的批次同时处理结果
+	hold    int
+	arrived int
+	release chan struct{}
+}
+
+// 启动简易Redis并替换 globalRedis，测试结束后恢复
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{hashes: make(map[string]map[string]string), release: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	client, _, _, err := funcs.NewRedisClient(&funcs.RedisOptions{Addrs: []string{listener.Addr().String()}})
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	previous := globalRedis
+	globalRedis = client
+	t.Cleanup(func() {
+		globalRedis = previous
+		client.Client().Close()
+		listener.Close()
+	})
+	return fake
+}
+
+func (f *fakeRedis) hset(key string, field string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hashes[key] == nil {
+		f.hashes[key] = make(map[string]string)
+	}
+	f.hashes[key][field] = value
+}
+
+// 等待足够多的连接到达
+func (f *fakeRedis) wait() {
+	f.mu.Lock()
+	if f.hold <= 0 {
+		f.mu.Unlock()
+		return
+	}
+	f.arrived++
+	if f.arrived == f.hold {
+		close(f.release)
+	}
+	f.mu.Unlock()
+	select {
+	case <-f.release:
+	case <-time.After(time.Second):
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	waited := false
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		if !waited && strings.EqualFold(args[0], "HGET") {
+			waited = true
+			f.wait()
+		}
+		if _, err := io.WriteString(conn, f.handle(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "HGET":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if value, ok := f.hashes[args[1]][args[2]]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		return "$-1\r\n"
+	}
+	// HELLO 等未实现的命令返回错误，客户端回退到RESP2
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// 读取一条RESP数组形式的命令
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
@@ -5,44 +5,86 @@ import (
 	"sse-broker/funcs"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
-	globalConfig    *Config
+	globalConfig    atomic.Pointer[Config] // 运行中的配置，热加载时整体替换
 	globalInstance  *ServiceInstance
 	globalRedis     *funcs.RedisClient
 	deviceChannels  = &sync.Map{}
 	deviceChannelWG sync.WaitGroup // 用于等待所有goroutines完成的WaitGroup
+	draining        atomic.Bool    // 排空中：不再接受新连接，就绪检查返回503
 )
 
 func Start(config Config) {
-	globalConfig = &config
-	jwtInit(config.JWT.Secret, config.JWT.Expire)
-	reidsClient, localIP, _, err := funcs.NewRedisClient(config.Redis.Addrs, config.Redis.Password, config.Redis.DB, config.Redis.PoolSize)
+	globalConfig.Store(&config)
+	jwtInit(config.JWT.Secret)
+	reidsClient, localIP, _, err := funcs.NewRedisClient(&config.Redis.RedisOptions)
 	globalRedis = reidsClient
 	if err != nil {
 		fmt.Printf("Failed to create redis client: %v\n", err)
 		panic(fmt.Sprintf("Failed to create redis client: %v\n", err))
 	}
+	initKeys(config.Redis.KeyPrefix, config.Redis.HashTag)
+	eventTypes.setConfigTypes(config.Events.Types)
 	globalInstance = NewServiceInstance(config.Server.Version, fmt.Sprintf("%s:%d", localIP, config.Server.Port))
-	globalInstance.clear()
-	globalInstance.start()
+	if err := checkClusterSettings(globalInstance.Address); err != nil {
+		fmt.Printf("Refuse to join cluster: %v\n", err)
+		panic(fmt.Sprintf("Refuse to join cluster: %v\n", err))
+	}
+	if config.Audit.Enable {
+		if err := audit.open(config.Audit.Path); err != nil {
+			fmt.Printf("Failed to open audit log: %v\n", err)
+			panic(fmt.Sprintf("Failed to open audit log: %v\n", err))
+		}
+	}
+	if err := globalInstance.start(); err != nil {
+		fmt.Printf("Failed to start instance: %v\n", err)
+		panic(fmt.Sprintf("Failed to start instance: %v\n", err))
+	}
+}
+
+// Drain 进入排空状态，负载均衡摘除本实例后不再有新连接进入，已有连接保持到Stop
+func Drain() {
+	setDraining(true)
+}
+
+// 设置排空状态，管理后台可以排空或恢复实例
+func setDraining(enable bool) {
+	if draining.Swap(enable) == enable {
+		return
+	}
+	if enable {
+		instanceLogger.Info("Instance is draining", "instance", globalInstance.Address)
+	} else {
+		instanceLogger.Info("Instance resumed accepting connections", "instance", globalInstance.Address)
+	}
 }
 
 func Stop() {
+	Drain()
 	globalInstance.stop()
 }
 
 func Dispose() {
 	// 容错，防止有的channel没有关闭
 	deviceChannels.Range(func(key, value interface{}) bool {
-		close(value.(chan *Instruction))
+		if queue, ok := value.(*deviceQueue); ok {
+			queue.close()
+		}
 		return true
 	})
 	globalInstance.dispose()
+	audit.close()
 	globalRedis.Close()
 }
 
+// 当前生效的配置
+func currentConfig() *Config {
+	return globalConfig.Load()
+}
+
 func GetIP() string {
 	index := strings.LastIndex(globalInstance.Address, ":")
 	if index == -1 {
@@ -52,7 +94,7 @@ func GetIP() string {
 }
 
 func GetPort() int {
-	return globalConfig.Server.Port
+	return currentConfig().Server.Port
 }
 
 func GetVersion() string {
@@ -2,13 +2,14 @@ package sse
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"sse-broker/funcs"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var userLogger = funcs.Logger("user")
+
 type User struct {
 	UID string `json:"uid"`
 }
@@ -19,14 +20,45 @@ func NewUser(uid string) *User {
 	}
 }
 
-func (u *User) touch() {
-	globalRedis.Expire(fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID), globalConfig.SSE.DeviceUserExistDuration)
+// 在事务中登记用户的在线设备并续期用户的键；用户的键都以uid为hash tag，在同一个slot，可以在一个事务中更新
+func (u *User) registerDevice(ctx context.Context, pipe redis.Pipeliner, deviceId string) {
+	userDeviceSetKey := redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID)
+	pipe.SAdd(ctx, userDeviceSetKey, deviceId)
+	pipe.Expire(ctx, userDeviceSetKey, currentConfig().SSE.DeviceUserExistDuration)
+	// 记录在用户名下，设备下线后仍可按用户查找帧缓存；在线期间随心跳续期，下线后与帧缓存同时过期
+	userFrameKey := redisKey(KEY_USER_FRAME_DEVICE_SET_PREFIX, u.UID)
+	pipe.SAdd(ctx, userFrameKey, deviceId)
+	pipe.Expire(ctx, userFrameKey, currentConfig().SSE.DeviceFrameExpireDuration)
+	if currentConfig().SSE.FrameIDScope == FRAME_ID_SCOPE_USER {
+		pipe.Expire(ctx, redisKey(KEY_USER_FRAME_SEQ_PREFIX, u.UID), userFrameSeqExpire())
+	}
+}
+
+// 登记在线用户；全局的在线用户集合与用户的键不在同一个slot，不放入用户的事务
+func (u *User) markOnline() {
+	if _, err := globalRedis.SAdd(redisKey(KEY_ONLINE_USER_SET, ""), u.UID); err != nil {
+		userLogger.Warn("Failed to add online user", "uid", u.UID, "error", err)
+	}
+}
+
+// 续期用户的设备集合；同时重新登记在线的设备，集合曾因过期被清除时可以自行恢复
+func (u *User) touch(deviceId string) {
+	ctx := context.Background()
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		u.registerDevice(ctx, pipe, deviceId)
+		return nil
+	})
+	if err != nil {
+		userLogger.Warn("Failed to touch user", "uid", u.UID, "error", err)
+		return
+	}
+	u.markOnline()
 }
 
 func (u *User) getDeviceIds() []string {
-	deviceIds, err := globalRedis.SMembers(fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID))
+	deviceIds, err := globalRedis.SMembers(redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID))
 	if err != nil {
-		log.Printf("Failed to get user device set: %v\n", err)
+		userLogger.Error("Failed to get user device set", "uid", u.UID, "error", err)
 		return []string{}
 	}
 	return u.validateDeviceSet(deviceIds)
@@ -41,7 +73,7 @@ func (u *User) validateDeviceSet(deviceIds []string) []string {
 		if deviceId == "" {
 			continue
 		}
-		deviceKeys = append(deviceKeys, fmt.Sprintf("%s%s", KEY_DEVICE_PREFIX, deviceId))
+		deviceKeys = append(deviceKeys, redisKey(KEY_DEVICE_PREFIX, deviceId))
 	}
 	if len(deviceKeys) == 0 {
 		return []string{}
@@ -54,7 +86,7 @@ func (u *User) validateDeviceSet(deviceIds []string) []string {
 	}
 	_, err := pipe.Exec(ctx)
 	if err != nil && err != redis.Nil {
-		log.Println("Pipeline error:", err)
+		userLogger.Error("Failed to check devices of user", "uid", u.UID, "error", err)
 		return []string{}
 	}
 	var validDeviceIds []string
@@ -62,10 +94,10 @@ func (u *User) validateDeviceSet(deviceIds []string) []string {
 	for i, cmd := range cmds {
 		exists, err := cmd.Result()
 		if err == redis.Nil {
-			log.Printf("Device %s not exists\n", deviceIds[i])
+			userLogger.Debug("Device not exists", "uid", u.UID, "device_id", deviceIds[i])
 			continue
 		} else if err != nil {
-			log.Printf("Error checking device existence: %v\n", err)
+			userLogger.Error("Failed to check device existence", "uid", u.UID, "device_id", deviceIds[i], "error", err)
 			continue
 		}
 		if exists == 1 {
@@ -76,28 +108,27 @@ func (u *User) validateDeviceSet(deviceIds []string) []string {
 	}
 	if len(invalidDeviceIds) > 0 {
 		// 清理无效设备
-		globalRedis.SRem(fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID), invalidDeviceIds)
+		globalRedis.SRem(redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID), invalidDeviceIds)
 	}
 	return validDeviceIds
 }
 
 func (u *User) handleDeviceOnline(device *Device) {
-	userDeviceSetKey := fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID)
+	userDeviceSetKey := redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID)
 
 	ctx := context.Background()
 	_cmds, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		pipe.SMembers(ctx, userDeviceSetKey)
-		pipe.SAdd(ctx, userDeviceSetKey, device.DeviceID)
-		pipe.Expire(ctx, userDeviceSetKey, globalConfig.SSE.DeviceUserExistDuration)
+		u.registerDevice(ctx, pipe, device.DeviceID)
 		return nil
 	})
 	if err != nil {
-		log.Printf("Failed to handle user device online: %v\n", err)
+		userLogger.Error("Failed to handle user device online", "uid", u.UID, "device_id", device.DeviceID, "error", err)
 		return
 	}
 	deviceIds, err := _cmds[0].(*redis.StringSliceCmd).Result()
 	if err != nil {
-		log.Printf("Failed to get user device set: %v\n", err)
+		userLogger.Error("Failed to get user device set", "uid", u.UID, "error", err)
 		return
 	}
 	deviceIds = u.validateDeviceSet(deviceIds)
@@ -109,13 +140,14 @@ func (u *User) handleDeviceOnline(device *Device) {
 
 func (u *User) online(deviceId string, deviceName string, reason string, payload string) {
 	ctx := context.Background()
-	userDeviceSetKey := fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID)
-	globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.SAdd(ctx, userDeviceSetKey, deviceId)
-		pipe.Expire(ctx, userDeviceSetKey, globalConfig.SSE.DeviceUserExistDuration)
-		pipe.SAdd(ctx, KEY_ONLINE_USER_SET, u.UID)
+	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		u.registerDevice(ctx, pipe, deviceId)
 		return nil
 	})
+	if err != nil {
+		userLogger.Error("Failed to online user", "uid", u.UID, "error", err)
+	}
+	u.markOnline()
 	DispatchUserOnline(StateChange{
 		UID:         u.UID,
 		Device:      deviceName,
@@ -126,22 +158,24 @@ func (u *User) online(deviceId string, deviceName string, reason string, payload
 }
 
 func (u *User) handleDeviceOffline(device *Device) {
-	userDeviceSetKey := fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID)
+	userDeviceSetKey := redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID)
 
 	ctx := context.Background()
 	_cmds, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		pipe.SRem(ctx, userDeviceSetKey, device.DeviceID)
 		pipe.SMembers(ctx, userDeviceSetKey)
-		pipe.Expire(ctx, userDeviceSetKey, globalConfig.SSE.DeviceUserExistDuration)
+		pipe.Expire(ctx, userDeviceSetKey, currentConfig().SSE.DeviceUserExistDuration)
+		// 设备只在连接期间写入帧缓存，下线时续期可保证索引不早于帧缓存过期
+		pipe.Expire(ctx, redisKey(KEY_USER_FRAME_DEVICE_SET_PREFIX, u.UID), currentConfig().SSE.DeviceFrameExpireDuration)
 		return nil
 	})
 	if err != nil {
-		log.Printf("Failed to handle user device offline: %v\n", err)
+		userLogger.Error("Failed to handle user device offline", "uid", u.UID, "device_id", device.DeviceID, "error", err)
 		return
 	}
 	deviceIds, err := _cmds[1].(*redis.StringSliceCmd).Result()
 	if err != nil {
-		log.Printf("Failed to get user device set: %v\n", err)
+		userLogger.Error("Failed to get user device set", "uid", u.UID, "error", err)
 		return
 	}
 	deviceIds = u.validateDeviceSet(deviceIds)
@@ -152,14 +186,11 @@ func (u *User) handleDeviceOffline(device *Device) {
 }
 
 func (u *User) offline(deviceName string, reason string, payload string) {
-	ctx := context.Background()
-	_, err := globalRedis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.Del(ctx, fmt.Sprintf("%s%s", KEY_USER_DEVICE_SET_PREFIX, u.UID))
-		pipe.SRem(ctx, KEY_ONLINE_USER_SET, u.UID)
-		return nil
-	})
-	if err != nil {
-		log.Printf("Failed to offline user: %v\n", err)
+	if err := globalRedis.Del(redisKey(KEY_USER_DEVICE_SET_PREFIX, u.UID)); err != nil {
+		userLogger.Error("Failed to offline user", "uid", u.UID, "error", err)
+	}
+	if _, err := globalRedis.SRem(redisKey(KEY_ONLINE_USER_SET, ""), u.UID); err != nil {
+		userLogger.Error("Failed to remove online user", "uid", u.UID, "error", err)
 	}
 	DispatchUserOffline(StateChange{
 		UID:         u.UID,
@@ -169,3 +200,116 @@ func (u *User) offline(deviceName string, reason string, payload string) {
 		Payload:     payload,
 	})
 }
+
+// 用户消息帧ID序列的有效期：序列须比用户名下的帧缓存和设备记录存活更久，
+// 否则序列重置后新消息的ID会小于客户端持有的 Last-Event-ID；在线期间随心跳续期
+func userFrameSeqExpire() time.Duration {
+	expire := currentConfig().SSE.DeviceFrameExpireDuration
+	if currentConfig().SSE.DeviceUserExistDuration > expire {
+		expire = currentConfig().SSE.DeviceUserExistDuration
+	}
+	return expire
+}
+
+// 为用户预留连续的消息帧ID：每个用户一次 IncrBy，返回各用户ID段的起始值
+func reserveUserFrameIds(counts map[string]int64) (map[string]int64, error) {
+	ctx := context.Background()
+	expire := userFrameSeqExpire()
+	cmds := make(map[string]*redis.IntCmd, len(counts))
+	pipe := globalRedis.Pipeline()
+	for uid, count := range counts {
+		seqKey := redisKey(KEY_USER_FRAME_SEQ_PREFIX, uid)
+		cmds[uid] = pipe.IncrBy(ctx, seqKey, count)
+		pipe.Expire(ctx, seqKey, expire)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, ErrRedisUnavailable.with("Failed to allocate frame ids: %s", err.Error())
+	}
+	starts := make(map[string]int64, len(cmds))
+	for uid, cmd := range cmds {
+		starts[uid] = cmd.Val() - counts[uid] + 1
+	}
+	return starts, nil
+}
+
+// 批量查询设备所属的用户，已下线的设备不在结果中
+func getDeviceUsers(deviceIds []string) (map[string]string, error) {
+	ctx := context.Background()
+	owners := make(map[string]string, len(deviceIds))
+	batchSize := 250 // 每批查询 250 个设备
+	for i := 0; i < len(deviceIds); i += batchSize {
+		end := i + batchSize
+		if end > len(deviceIds) {
+			end = len(deviceIds)
+		}
+		pipe := globalRedis.Pipeline()
+		cmds := make([]*redis.StringCmd, end-i)
+		for j := i; j < end; j++ {
+			cmds[j-i] = pipe.HGet(ctx, redisKey(KEY_DEVICE_PREFIX, deviceIds[j]), "uid")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, ErrRedisUnavailable.with("Failed to get users of devices: %s", err.Error())
+		}
+		for j, cmd := range cmds {
+			if uid, err := cmd.Result(); err == nil && uid != "" {
+				owners[deviceIds[i+j]] = uid
+			}
+		}
+	}
+	return owners, nil
+}
+
+// frame_id_scope=user 时，按用户分配消息帧ID：messages 中每组是同一条消息的指令，同一用户的设备共用一个ID
+// 整批只查询一次设备所属用户，每个用户只预留一次ID段，按消息顺序依次分配
+// 查不到所属用户的设备(已下线)保持0，投递时再由用户序列分配
+func assignUserFrameIds(messages ...[]Instruction) error {
+	if currentConfig().SSE.FrameIDScope != FRAME_ID_SCOPE_USER {
+		return nil
+	}
+	var deviceIds []string
+	for _, instructions := range messages {
+		for _, instruction := range instructions {
+			deviceIds = append(deviceIds, instruction.DeviceID)
+		}
+	}
+	if len(deviceIds) == 0 {
+		return nil
+	}
+	owners, err := getDeviceUsers(deviceIds)
+	if err != nil {
+		return err
+	}
+	// 每条消息中出现的用户各占一个ID
+	counts := make(map[string]int64)
+	for _, instructions := range messages {
+		seen := make(map[string]bool)
+		for _, instruction := range instructions {
+			if uid, ok := owners[instruction.DeviceID]; ok && !seen[uid] {
+				seen[uid] = true
+				counts[uid]++
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	next, err := reserveUserFrameIds(counts)
+	if err != nil {
+		return err
+	}
+	for _, instructions := range messages {
+		assigned := make(map[string]int64)
+		for i := range instructions {
+			uid, ok := owners[instructions[i].DeviceID]
+			if !ok {
+				continue
+			}
+			if _, ok := assigned[uid]; !ok {
+				assigned[uid] = next[uid]
+				next[uid]++
+			}
+			instructions[i].FrameID = assigned[uid]
+		}
+	}
+	return nil
+}